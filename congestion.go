@@ -0,0 +1,272 @@
+package kcp
+
+// CongestionState is a snapshot of the KCP connection handed to a CongestionController
+type CongestionState struct {
+	Current  uint32 // current timestamp in millisec
+	Mss      uint32 // maximum segment size
+	Inflight uint32 // segments sent but not acknowledged, snd_nxt - snd_una
+	Wnd      uint32 // effective send window of the current flush, min(cwnd, snd_wnd, rmt_wnd)
+	RmtWnd   uint32 // remote receive window
+	Resent   uint32 // fast retransmit threshold
+	Srtt     int32  // smoothed rtt in millisec
+	MinRtt   int32  // minimum rtt in millisec
+}
+
+// CongestionController decides the congestion window and pacing rate of a KCP connection.
+//
+// All methods are called with the owner of the KCP locked, a controller must not be
+// shared between connections.
+type CongestionController interface {
+	// OnAck is called when 'acked' segments are newly acknowledged by una
+	OnAck(st *CongestionState, acked uint32)
+	// OnLoss is called in flush when segments are retransmitted, 'fast' counts fast and
+	// early retransmissions, 'lost' counts segments retransmitted on RTO
+	OnLoss(st *CongestionState, fast, lost uint64)
+	// OnRTT is called with every rtt sample in millisec
+	OnRTT(st *CongestionState, rtt int32)
+	// OnFlush is called at the end of every flush
+	OnFlush(st *CongestionState)
+
+	// Cwnd returns the congestion window in segments
+	Cwnd() uint32
+	// Ssthresh returns the slow start threshold in segments
+	Ssthresh() uint32
+	// PacingRate returns the sending rate in bytes per second, 0 means unknown
+	PacingRate() uint64
+}
+
+// pacingRate derives a sending rate from a window and rtt.
+//
+// Callers should pass the minimum rtt, rtt samples include the time packets wait in
+// the pacer and a rate derived from srtt would keep slowing itself down.
+func pacingRate(cwnd, mss uint32, rtt int32) uint64 {
+	if rtt <= 0 {
+		return 0
+	}
+	return uint64(cwnd) * uint64(mss) * 1000 / uint64(rtt)
+}
+
+// RenoController is the default controller, slow start and congestion avoidance as in
+// https://tools.ietf.org/html/rfc5681, rate halving on fast retransmit as in
+// https://tools.ietf.org/html/rfc6937 and window collapse on RTO.
+type RenoController struct {
+	cwnd     uint32
+	ssthresh uint32
+	incr     uint32
+	mss      uint32
+	minrtt   int32
+}
+
+// NewRenoController creates the default reno-like controller
+func NewRenoController() *RenoController {
+	return &RenoController{
+		cwnd:     1,
+		ssthresh: IKCP_THRESH_INIT,
+	}
+}
+
+func (r *RenoController) OnAck(st *CongestionState, acked uint32) {
+	r.mss, r.minrtt = st.Mss, st.MinRtt
+	if r.cwnd >= st.RmtWnd {
+		return
+	}
+
+	mss := st.Mss
+	if r.cwnd < r.ssthresh {
+		r.cwnd++
+		r.incr += mss
+	} else {
+		if r.incr < mss {
+			r.incr = mss
+		}
+		r.incr += (mss*mss)/r.incr + (mss / 16)
+		if (r.cwnd+1)*mss <= r.incr {
+			if mss > 0 {
+				r.cwnd = (r.incr + mss - 1) / mss
+			} else {
+				r.cwnd = r.incr + mss - 1
+			}
+		}
+	}
+	if r.cwnd > st.RmtWnd {
+		r.cwnd = st.RmtWnd
+		r.incr = st.RmtWnd * mss
+	}
+}
+
+func (r *RenoController) OnLoss(st *CongestionState, fast, lost uint64) {
+	r.mss, r.minrtt = st.Mss, st.MinRtt
+
+	// update ssthresh
+	// rate halving, https://tools.ietf.org/html/rfc6937
+	if fast > 0 {
+		r.ssthresh = st.Inflight / 2
+		if r.ssthresh < IKCP_THRESH_MIN {
+			r.ssthresh = IKCP_THRESH_MIN
+		}
+		r.cwnd = r.ssthresh + st.Resent
+		r.incr = r.cwnd * st.Mss
+	}
+
+	// congestion control, https://tools.ietf.org/html/rfc5681
+	if lost > 0 {
+		r.ssthresh = st.Wnd / 2
+		if r.ssthresh < IKCP_THRESH_MIN {
+			r.ssthresh = IKCP_THRESH_MIN
+		}
+		r.cwnd = 1
+		r.incr = st.Mss
+	}
+}
+
+func (r *RenoController) OnRTT(st *CongestionState, rtt int32) {
+	r.minrtt = st.MinRtt
+}
+
+func (r *RenoController) OnFlush(st *CongestionState) {
+	r.mss, r.minrtt = st.Mss, st.MinRtt
+	if r.cwnd < 1 {
+		r.cwnd = 1
+		r.incr = st.Mss
+	}
+}
+
+func (r *RenoController) Cwnd() uint32       { return r.cwnd }
+func (r *RenoController) Ssthresh() uint32   { return r.ssthresh }
+func (r *RenoController) PacingRate() uint64 { return pacingRate(r.cwnd, r.mss, r.minrtt) }
+
+var (
+	DefaultVegasAlpha uint32 = 2 // grow the window when fewer segments are queued in the path
+	DefaultVegasBeta  uint32 = 4 // shrink the window when more segments are queued in the path
+	DefaultVegasGamma uint32 = 1 // leave slow start when more segments are queued in the path
+)
+
+// VegasController is a delay-based controller modeled after TCP Vegas.
+//
+// Once per rtt it compares the expected throughput cwnd/baseRTT with the actual throughput
+// cwnd/rtt and adjusts the window by the number of segments queued in the path. Losses only
+// scale the window down, so random loss on long-haul links does not collapse it to 1.
+type VegasController struct {
+	alpha, beta, gamma uint32
+
+	cwnd     uint32
+	ssthresh uint32
+	mss      uint32
+	srtt     int32
+
+	baseRTT    int32  // minimum rtt ever seen
+	minRTT     int32  // minimum rtt seen in current epoch
+	epochStart uint32 // timestamp current epoch starts
+	epochCount uint32 // rtt samples in current epoch
+}
+
+// NewVegasController creates a vegas controller, zero parameters take the defaults
+func NewVegasController(alpha, beta, gamma uint32) *VegasController {
+	if alpha == 0 {
+		alpha = DefaultVegasAlpha
+	}
+	if beta == 0 {
+		beta = DefaultVegasBeta
+	}
+	if gamma == 0 {
+		gamma = DefaultVegasGamma
+	}
+	if beta < alpha {
+		beta = alpha
+	}
+	return &VegasController{
+		alpha:    alpha,
+		beta:     beta,
+		gamma:    gamma,
+		cwnd:     1,
+		ssthresh: 0xffffffff,
+	}
+}
+
+func (v *VegasController) OnAck(st *CongestionState, acked uint32) {
+	v.mss, v.srtt = st.Mss, st.Srtt
+
+	if v.baseRTT == 0 {
+		// no rtt samples yet, grow as reno slow start
+		if v.cwnd < st.RmtWnd {
+			v.cwnd++
+		}
+		return
+	}
+	if v.epochCount == 0 || _itimediff(st.Current, v.epochStart) < v.srtt {
+		return
+	}
+
+	// segments queued in the path: cwnd * (rtt - baseRTT) / rtt
+	diff := uint32(uint64(v.cwnd) * uint64(v.minRTT-v.baseRTT) / uint64(v.minRTT))
+	if v.cwnd < v.ssthresh {
+		if diff > v.gamma {
+			// leave slow start
+			v.ssthresh = v.cwnd
+			if v.cwnd > 2 {
+				v.cwnd -= diff / 2
+			}
+		} else {
+			v.cwnd *= 2
+		}
+	} else if diff < v.alpha {
+		v.cwnd++
+	} else if diff > v.beta {
+		v.cwnd--
+	}
+
+	if v.cwnd < IKCP_THRESH_MIN {
+		v.cwnd = IKCP_THRESH_MIN
+	}
+	if st.RmtWnd > 0 && v.cwnd > st.RmtWnd {
+		v.cwnd = st.RmtWnd
+	}
+
+	v.epochStart = st.Current
+	v.epochCount = 0
+	v.minRTT = 0
+}
+
+func (v *VegasController) OnLoss(st *CongestionState, fast, lost uint64) {
+	v.mss, v.srtt = st.Mss, st.Srtt
+	if fast > 0 {
+		v.cwnd -= v.cwnd / 4
+	}
+	if lost > 0 {
+		v.cwnd /= 2
+	}
+	if v.cwnd < IKCP_THRESH_MIN {
+		v.cwnd = IKCP_THRESH_MIN
+	}
+	if v.cwnd < v.ssthresh {
+		v.ssthresh = v.cwnd
+	}
+}
+
+func (v *VegasController) OnRTT(st *CongestionState, rtt int32) {
+	v.srtt = st.Srtt
+	if rtt <= 0 {
+		rtt = 1
+	}
+	if v.baseRTT == 0 {
+		v.epochStart = st.Current
+	}
+	if v.baseRTT == 0 || rtt < v.baseRTT {
+		v.baseRTT = rtt
+	}
+	if v.minRTT == 0 || rtt < v.minRTT {
+		v.minRTT = rtt
+	}
+	v.epochCount++
+}
+
+func (v *VegasController) OnFlush(st *CongestionState) {
+	v.mss, v.srtt = st.Mss, st.Srtt
+	if v.cwnd < 1 {
+		v.cwnd = 1
+	}
+}
+
+func (v *VegasController) Cwnd() uint32       { return v.cwnd }
+func (v *VegasController) Ssthresh() uint32   { return v.ssthresh }
+func (v *VegasController) PacingRate() uint64 { return pacingRate(v.cwnd, v.mss, v.baseRTT) }
@@ -0,0 +1,132 @@
+package kcp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRenoController(t *testing.T) {
+	r := NewRenoController()
+	st := &CongestionState{Mss: 1000, RmtWnd: 128, Resent: 2}
+
+	if r.Cwnd() != 1 {
+		t.Fatal("initial cwnd")
+	}
+
+	// slow start
+	r.OnAck(st, 1)
+	if r.Cwnd() != 2 {
+		t.Fatalf("slow start cwnd:%v", r.Cwnd())
+	}
+
+	// congestion avoidance grows slower than one segment per ack
+	for i := 0; i < 10; i++ {
+		r.OnAck(st, 1)
+	}
+	if r.Cwnd() >= 12 {
+		t.Fatalf("congestion avoidance cwnd:%v", r.Cwnd())
+	}
+
+	// rate halving on fast retransmit
+	st.Inflight = 20
+	r.OnLoss(st, 1, 0)
+	if r.Ssthresh() != 10 || r.Cwnd() != 12 {
+		t.Fatalf("fast retransmit ssthresh:%v cwnd:%v", r.Ssthresh(), r.Cwnd())
+	}
+
+	// collapse on rto
+	st.Wnd = 12
+	r.OnLoss(st, 0, 1)
+	if r.Ssthresh() != 6 || r.Cwnd() != 1 {
+		t.Fatalf("rto ssthresh:%v cwnd:%v", r.Ssthresh(), r.Cwnd())
+	}
+
+	st.MinRtt = 100
+	r.OnFlush(st)
+	if r.PacingRate() != 10000 {
+		t.Fatalf("pacing rate:%v", r.PacingRate())
+	}
+}
+
+func TestVegasController(t *testing.T) {
+	v := NewVegasController(0, 0, 0)
+	st := &CongestionState{Mss: 1000, RmtWnd: 1024, Srtt: 50}
+
+	// no queueing delay, the window keeps growing
+	current := uint32(0)
+	for i := 0; i < 10; i++ {
+		current += 60
+		st.Current = current
+		v.OnRTT(st, 50)
+		v.OnAck(st, 1)
+	}
+	grown := v.Cwnd()
+	if grown < 16 {
+		t.Fatalf("vegas does not grow. cwnd:%v", grown)
+	}
+
+	// rtt doubles, segments are queued in the path, the window shrinks
+	st.Srtt = 100
+	for i := 0; i < 10; i++ {
+		current += 110
+		st.Current = current
+		v.OnRTT(st, 100)
+		v.OnAck(st, 1)
+	}
+	if v.Cwnd() >= grown {
+		t.Fatalf("vegas does not shrink. cwnd:%v grown:%v", v.Cwnd(), grown)
+	}
+
+	// rto halves the window instead of collapsing it
+	cwnd := v.Cwnd()
+	v.OnLoss(st, 0, 1)
+	if v.Cwnd() != cwnd/2 {
+		t.Fatalf("vegas loss cwnd:%v", v.Cwnd())
+	}
+}
+
+func kcpTransfer(t *testing.T, cc CongestionController, loss int) {
+	var sender, receiver *KCP
+	sender = NewKCP(1, func(buf []byte, size int, xmitMax uint32) {
+		if lossRand.Intn(100) >= loss {
+			receiver.Input(buf[:size], true, false)
+		}
+	})
+	receiver = NewKCP(1, func(buf []byte, size int, xmitMax uint32) {
+		sender.Input(buf[:size], true, false)
+	})
+	sender.NoDelay(1, 10, 2, 0)
+	receiver.NoDelay(1, 10, 2, 0)
+	sender.SetCongestionController(cc)
+
+	data := make([]byte, 64*1024)
+	lossRand.Read(data)
+	for i := 0; i < len(data); i += 1024 {
+		sender.Send(data[i : i+1024])
+	}
+
+	recv := make([]byte, 0, len(data))
+	buf := make([]byte, len(data))
+	for i := 0; i < 10000 && len(recv) < len(data); i++ {
+		sender.flush(false)
+		receiver.flush(false)
+		for {
+			n := receiver.Recv(buf)
+			if n < 0 {
+				break
+			}
+			recv = append(recv, buf[:n]...)
+		}
+		for k := range sender.snd_buf {
+			sender.snd_buf[k].resendts = currentMs()
+		}
+	}
+	if !bytes.Equal(data, recv) {
+		t.Fatalf("transfer failed. recv:%v", len(recv))
+	}
+}
+
+func TestCongestionTransfer(t *testing.T) {
+	kcpTransfer(t, nil, 5)
+	kcpTransfer(t, NewVegasController(0, 0, 0), 5)
+}
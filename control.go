@@ -0,0 +1,144 @@
+package kcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+var (
+	errProtoVersion = errors.New("err protocol version")
+	errControlFrame = errors.New("err control frame")
+)
+
+// protoVersion is carried by every control frame, a peer speaking another version is refused
+const protoVersion = 2
+
+// tlv types of control frames, unknown types are skipped
+const (
+	tlvCaps     = 1 // CAPS(4B)
+	tlvLocal    = 2 // one endpoint of the sender
+	tlvFEC      = 3 // DATASHARDS(1B) PARITYSHARDS(1B)
+	tlvMetadata = 4 // KLEN(2B) KEY VALUE, one pair
+	tlvReason   = 5 // REASON(1B) of RST
+	tlvPath     = 6 // OP(1B) ID(4B) of PATH
+)
+
+// reasons carried by RST
+const (
+	reasonNone    = 0
+	reasonVersion = 1 // the protocol versions differ
+)
+
+// Capabilities is a bitmap of protocol features, the dialer sends its own in SYN
+// and the acceptor answers with its own in SYN-ACK
+type Capabilities uint32
+
+const (
+	CapFEC               Capabilities = 1 << iota // forward error correction
+	CapEncryption                                 // packets are sealed
+	CapCompression                                // reserved, payload compression
+	CapMultipathParallel                          // packets duplicated on every path
+	CapWindowScaling                              // reserved, windows beyond 65535 segments
+	CapPathUpdate                                 // paths added and removed by PATH
+	CapPathProbe                                  // paths pinged to measure their health
+)
+
+// supportedCaps are the capabilities of this implementation regardless of configuration
+const supportedCaps = CapFEC | CapMultipathParallel | CapPathUpdate | CapPathProbe
+
+func (c Capabilities) String() string {
+	var names []string
+	for _, cap := range []struct {
+		c    Capabilities
+		name string
+	}{
+		{CapFEC, "fec"},
+		{CapEncryption, "encryption"},
+		{CapCompression, "compression"},
+		{CapMultipathParallel, "multipath-parallel"},
+		{CapWindowScaling, "window-scaling"},
+		{CapPathUpdate, "path-update"},
+		{CapPathProbe, "path-probe"},
+	} {
+		if c&cap.c != 0 {
+			names = append(names, cap.name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+type tlv struct {
+	typ   byte
+	value []byte
+}
+
+// encodeControl encodes the body of a control frame, following the flag byte
+//
+// | VERSION(1B) | TYPE(1B) | LEN(2B) | VALUE | ... |
+func encodeControl(tlvs ...tlv) ([]byte, error) {
+	buf := []byte{protoVersion}
+	for _, t := range tlvs {
+		if len(t.value) > 0xffff {
+			return nil, errControlFrame
+		}
+		buf = append(buf, t.typ)
+		buf = appendUint16(buf, uint16(len(t.value)))
+		buf = append(buf, t.value...)
+	}
+	return buf, nil
+}
+
+// decodeControl decodes the body of a control frame, the values point into data.
+// An empty body comes from a peer predating versioned frames.
+func decodeControl(data []byte) ([]tlv, error) {
+	if len(data) == 0 || data[0] != protoVersion {
+		return nil, errProtoVersion
+	}
+	var tlvs []tlv
+	data = data[1:]
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return nil, errControlFrame
+		}
+		l := int(binary.LittleEndian.Uint16(data[1:]))
+		if len(data) < 3+l {
+			return nil, errControlFrame
+		}
+		tlvs = append(tlvs, tlv{typ: data[0], value: data[3 : 3+l]})
+		data = data[3+l:]
+	}
+	return tlvs, nil
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v), byte(v>>8))
+}
+
+// controlFrame encodes a control frame without payload, it cannot fail
+func controlFrame(tlvs ...tlv) []byte {
+	buf, _ := encodeControl(tlvs...)
+	return buf
+}
+
+// rstFrame encodes RST, with the reason if any
+func rstFrame(reason byte) []byte {
+	if reason == reasonNone {
+		return controlFrame()
+	}
+	return controlFrame(tlv{tlvReason, []byte{reason}})
+}
+
+// rstReason returns the reason of RST, reasonVersion for a peer predating versioned frames
+func rstReason(data []byte) byte {
+	tlvs, err := decodeControl(data)
+	if err == errProtoVersion {
+		return reasonVersion
+	}
+	for _, t := range tlvs {
+		if t.typ == tlvReason && len(t.value) == 1 {
+			return t.value[0]
+		}
+	}
+	return reasonNone
+}
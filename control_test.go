@@ -0,0 +1,124 @@
+package kcp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	gouuid "github.com/satori/go.uuid"
+)
+
+func TestControlCodec(t *testing.T) {
+	data, err := encodeControl(tlv{tlvReason, []byte{reasonVersion}}, tlv{0xee, []byte("future")}, tlv{tlvCaps, nil})
+	checkError(t, err)
+	tlvs, err := decodeControl(data)
+	checkError(t, err)
+	if len(tlvs) != 3 || tlvs[1].typ != 0xee || !bytes.Equal(tlvs[1].value, []byte("future")) || len(tlvs[2].value) != 0 {
+		t.Fatalf("tlvs decoded wrong. tlvs:%v", tlvs)
+	}
+	if rstReason(data) != reasonVersion || rstReason(rstFrame(reasonNone)) != reasonNone {
+		t.Fatal("rst reason")
+	}
+
+	// frames of peers predating versioned frames are empty or free text
+	if _, err = decodeControl(nil); err != errProtoVersion {
+		t.Fatal("empty frame accepted")
+	}
+	if _, err = decodeControl([]byte("127.0.0.1:7001 127.0.0.1:7002")); err != errProtoVersion {
+		t.Fatal("text frame accepted")
+	}
+	if rstReason(nil) != reasonVersion {
+		t.Fatal("old rst not detected")
+	}
+	if _, err = decodeControl(data[:len(data)-1]); err != errControlFrame {
+		t.Fatal("truncated frame accepted")
+	}
+
+	if s := (CapFEC | CapMultipathParallel).String(); s != "fec|multipath-parallel" {
+		t.Fatalf("caps string:%v", s)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	lAddr, rAddr := "127.0.0.1:7261", "127.0.0.1:17261"
+	copt := &CryptOption{Method: CryptAESGCM, Key: []byte("0123456789abcdef")}
+
+	var dialerCaps Capabilities
+	serverSel, _ := NewTestSelector([]string{rAddr}, []string{lAddr})
+	server, err := NewUDPTransport(serverSel, &TransportOption{CryptOption: copt, AcceptFilter: func(info *AcceptInfo) AcceptDecision {
+		dialerCaps = info.Capabilities
+		return AcceptStream
+	}})
+	checkError(t, err)
+	defer server.Close()
+	_, err = server.NewTunnel(rAddr)
+	checkError(t, err)
+	accepted := make(chan *UDPStream, 1)
+	go func() {
+		stream, err := server.Accept()
+		if err == nil {
+			accepted <- stream
+			handleEchoClient(stream)
+		}
+	}()
+
+	clientSel, _ := NewTestSelector([]string{lAddr}, []string{rAddr})
+	client, err := NewUDPTransport(clientSel, &TransportOption{CryptOption: copt})
+	checkError(t, err)
+	defer client.Close()
+	_, err = client.NewTunnel(lAddr)
+	checkError(t, err)
+
+	stream, err := client.Open([]string{lAddr}, []string{rAddr})
+	checkError(t, err)
+	defer stream.Close()
+	checkError(t, echoTester(stream, 1024, 4))
+
+	want := Capabilities(supportedCaps | CapEncryption)
+	s := <-accepted
+	if dialerCaps != want || s.PeerCapabilities() != want || s.Capabilities() != want {
+		t.Fatalf("acceptor caps. dialer:%v peer:%v negotiated:%v", dialerCaps, s.PeerCapabilities(), s.Capabilities())
+	}
+	if stream.PeerCapabilities() != want || stream.Capabilities() != want {
+		t.Fatalf("dialer caps. peer:%v negotiated:%v", stream.PeerCapabilities(), stream.Capabilities())
+	}
+}
+
+func TestOldPeerRejected(t *testing.T) {
+	lAddr, rAddr := "127.0.0.1:7271", "127.0.0.1:17271"
+
+	serverSel, _ := NewTestSelector([]string{rAddr}, []string{lAddr})
+	server, err := NewUDPTransport(serverSel, nil)
+	checkError(t, err)
+	defer server.Close()
+	_, err = server.NewTunnel(rAddr)
+	checkError(t, err)
+	go server.Accept()
+
+	clientSel, _ := NewTestSelector([]string{lAddr}, []string{rAddr})
+	client, err := NewUDPTransport(clientSel, nil)
+	checkError(t, err)
+	defer client.Close()
+	_, err = client.NewTunnel(lAddr)
+	checkError(t, err)
+
+	// a dialer predating versioned frames sends its endpoints as text
+	uuid, _ := gouuid.NewV1()
+	stream, err := client.NewStream(uuid, false, []string{rAddr})
+	checkError(t, err)
+	defer stream.Close()
+	client.streamm.Set(stream.GetUUID(), stream)
+	stream.WriteFlag(SYN, []byte(lAddr))
+
+	select {
+	case <-stream.chRst:
+	case <-time.After(time.Second):
+		t.Fatal("old dialer not reset")
+	}
+	stream.mu.Lock()
+	reason := stream.dialErr
+	stream.mu.Unlock()
+	if reason != errProtoVersion {
+		t.Fatalf("version not reported. err:%v", reason)
+	}
+}
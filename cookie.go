@@ -0,0 +1,176 @@
+package kcp
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	gouuid "github.com/satori/go.uuid"
+)
+
+var (
+	DefaultCookieLifetime = time.Second * 30 // a cookie is valid for one to two lifetimes
+	DefaultOpenLimitHosts = 65536            // source ips tracked by the open rate limit, read when a transport is created
+)
+
+const (
+	cookieSize    = 32                 // a retry must not be shorter than the smallest packet read from a tunnel
+	cookieHdrSize = 4 + 1 + cookieSize // marker, type and cookie between uuid and packet
+)
+
+// cookieJar makes stateless retry cookies, a cookie proves the dialer receives packets
+// sent to its source address.
+type cookieJar struct {
+	secret [32]byte
+}
+
+func newCookieJar() (*cookieJar, error) {
+	jar := new(cookieJar)
+	if _, err := rand.Read(jar.secret[:]); err != nil {
+		return nil, err
+	}
+	return jar, nil
+}
+
+func (jar *cookieJar) cookie(uuid gouuid.UUID, addr net.Addr, epoch int64) []byte {
+	var ts [8]byte
+	binary.LittleEndian.PutUint64(ts[:], uint64(epoch))
+	mac := hmac.New(sha256.New, jar.secret[:])
+	mac.Write(uuid[:])
+	mac.Write([]byte(addr.String()))
+	mac.Write(ts[:])
+	return mac.Sum(nil)
+}
+
+func (jar *cookieJar) make(uuid gouuid.UUID, addr net.Addr) []byte {
+	return jar.cookie(uuid, addr, time.Now().UnixNano()/int64(DefaultCookieLifetime))
+}
+
+func (jar *cookieJar) valid(uuid gouuid.UUID, addr net.Addr, cookie []byte) bool {
+	epoch := time.Now().UnixNano() / int64(DefaultCookieLifetime)
+	return hmac.Equal(cookie, jar.cookie(uuid, addr, epoch)) || hmac.Equal(cookie, jar.cookie(uuid, addr, epoch-1))
+}
+
+// isCookie tells data packets wrapped with a cookie
+//
+// | UUID(16B) | MARKER(4B) | TYPE(1B) | COOKIE(32B) | PACKET |
+func isCookie(data []byte) bool {
+	return isHandshake(data) && len(data) >= gouuid.Size+cookieHdrSize && data[gouuid.Size+4] == hsCookie
+}
+
+// packetHeaderSize returns the bytes before the encrypted part of a packet
+func packetHeaderSize(data []byte) int {
+	if isCookie(data) {
+		return gouuid.Size + cookieHdrSize
+	} else if isPathProbe(data) {
+		return gouuid.Size + 4 + 1
+	}
+	return gouuid.Size
+}
+
+// wrapCookie inserts the cookie header after the uuid, buf must have room for it
+func wrapCookie(buf []byte, cookie []byte) []byte {
+	n := len(buf)
+	buf = buf[:n+cookieHdrSize]
+	copy(buf[gouuid.Size+cookieHdrSize:], buf[gouuid.Size:n])
+	binary.LittleEndian.PutUint32(buf[gouuid.Size:], hsMarker)
+	buf[gouuid.Size+4] = hsCookie
+	copy(buf[gouuid.Size+5:], cookie)
+	return buf
+}
+
+// unwrapCookie removes the cookie header in place
+func unwrapCookie(data []byte) (packet []byte, cookie []byte) {
+	cookie = append([]byte(nil), data[gouuid.Size+5:gouuid.Size+cookieHdrSize]...)
+	n := copy(data[gouuid.Size:], data[gouuid.Size+cookieHdrSize:])
+	return data[:gouuid.Size+n], cookie
+}
+
+type openBucket struct {
+	host   string
+	tokens float64
+	last   time.Time
+}
+
+// openLimiter is a token bucket per source ip limiting new streams, at most maxHosts
+// buckets are kept in an lru list
+type openLimiter struct {
+	mu       sync.Mutex
+	rate     float64
+	burst    float64
+	maxHosts int
+	hosts    map[string]*list.Element
+	lru      list.List // *openBucket, most recently used first
+}
+
+func newOpenLimiter(rate float64, burst int) *openLimiter {
+	if burst <= 0 {
+		burst = int(rate)
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	return &openLimiter{
+		rate:     rate,
+		burst:    float64(burst),
+		maxHosts: DefaultOpenLimitHosts,
+		hosts:    make(map[string]*list.Element),
+	}
+}
+
+func (l *openLimiter) allow(addr net.Addr) bool {
+	host := addr.String()
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		host = udpAddr.IP.String()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	e, ok := l.hosts[host]
+	if !ok {
+		// a host forgotten with a drained bucket would get a full one back, so a flood
+		// of new sources is refused until the least recently used buckets refill
+		if len(l.hosts) >= l.maxHosts && !l.evict(now) {
+			return false
+		}
+		e = l.lru.PushFront(&openBucket{host: host, tokens: l.burst, last: now})
+		l.hosts[host] = e
+	} else {
+		l.lru.MoveToFront(e)
+	}
+
+	b := e.Value.(*openBucket)
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// evict forgets the least recently used host if its bucket is full again, it returns false
+// if the host is kept
+func (l *openLimiter) evict(now time.Time) bool {
+	e := l.lru.Back()
+	if e == nil {
+		return false
+	}
+	b := e.Value.(*openBucket)
+	if b.tokens+now.Sub(b.last).Seconds()*l.rate < l.burst {
+		return false
+	}
+	l.lru.Remove(e)
+	delete(l.hosts, b.host)
+	return true
+}
@@ -0,0 +1,202 @@
+package kcp
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gouuid "github.com/satori/go.uuid"
+)
+
+func TestCookieJar(t *testing.T) {
+	jar, err := newCookieJar()
+	checkError(t, err)
+
+	uuid, _ := gouuid.NewV1()
+	addr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:7001")
+	other, _ := net.ResolveUDPAddr("udp", "127.0.0.1:7002")
+	cookie := jar.make(uuid, addr)
+	if !jar.valid(uuid, addr, cookie) {
+		t.Fatal("cookie not valid")
+	}
+	if jar.valid(uuid, other, cookie) {
+		t.Fatal("cookie valid for another address")
+	}
+	if jar.valid(uuid, addr, jar.cookie(uuid, addr, time.Now().UnixNano()/int64(DefaultCookieLifetime)-2)) {
+		t.Fatal("expired cookie valid")
+	}
+
+	payload := []byte("kcp packet")
+	buf := xmitBuf.Get().([]byte)[:gouuid.Size+len(payload)]
+	copy(buf, uuid[:])
+	copy(buf[gouuid.Size:], payload)
+	buf = wrapCookie(buf, cookie)
+	if !isHandshake(buf) || !isCookie(buf) || packetHeaderSize(buf) != gouuid.Size+cookieHdrSize {
+		t.Fatal("cookie header not detected")
+	}
+	pkt, echoed := unwrapCookie(buf)
+	if !bytes.Equal(echoed, cookie) || !bytes.Equal(pkt[:gouuid.Size], uuid[:]) || !bytes.Equal(pkt[gouuid.Size:], payload) {
+		t.Fatal("unwrap failed")
+	}
+	xmitBuf.Put(buf)
+
+	l := newOpenLimiter(1, 2)
+	if !l.allow(addr) || !l.allow(other) || l.allow(addr) {
+		t.Fatal("burst not enforced per ip")
+	}
+
+	// a full limiter refuses new sources until its least recently used bucket refills
+	l = newOpenLimiter(1, 1)
+	l.maxHosts = 2
+	hosts := []*net.UDPAddr{{IP: net.IPv4(10, 0, 0, 1)}, {IP: net.IPv4(10, 0, 0, 2)}, {IP: net.IPv4(10, 0, 0, 3)}}
+	if !l.allow(hosts[0]) || !l.allow(hosts[1]) || l.allow(hosts[2]) || len(l.hosts) != 2 {
+		t.Fatalf("new source admitted to a full limiter. hosts:%v", len(l.hosts))
+	}
+	l.hosts[hosts[0].IP.String()].Value.(*openBucket).last = time.Now().Add(-time.Second)
+	if !l.allow(hosts[2]) || len(l.hosts) != 2 || l.hosts[hosts[0].IP.String()] != nil {
+		t.Fatal("refilled bucket not evicted")
+	}
+}
+
+func TestSynCookie(t *testing.T) {
+	lAddr, rAddr, badAddr := "127.0.0.1:7211", "127.0.0.1:17211", "127.0.0.1:27211"
+	copt := &CryptOption{Method: CryptAESGCM, Key: []byte("0123456789abcdef"), PerStream: true}
+
+	serverSel, _ := NewTestSelector([]string{rAddr}, []string{lAddr, badAddr})
+	server, err := NewUDPTransport(serverSel, &TransportOption{CryptOption: copt, SynCookie: true})
+	checkError(t, err)
+	defer server.Close()
+	_, err = server.NewTunnel(rAddr)
+	checkError(t, err)
+	go func() {
+		for {
+			stream, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go handleEchoClient(stream)
+		}
+	}()
+
+	clientSel, _ := NewTestSelector([]string{lAddr}, []string{rAddr})
+	client, err := NewUDPTransport(clientSel, &TransportOption{CryptOption: copt})
+	checkError(t, err)
+	defer client.Close()
+	_, err = client.NewTunnel(lAddr)
+	checkError(t, err)
+
+	cookieOpens := atomic.LoadUint64(&DefaultSnmp.CookieOpens)
+	stream, err := client.Open([]string{lAddr}, []string{rAddr})
+	checkError(t, err)
+	defer stream.Close()
+	checkError(t, echoTester(stream, 4096, 16))
+	if atomic.LoadUint64(&DefaultSnmp.CookieOpens) == cookieOpens {
+		t.Fatal("CookieOpens not counted")
+	}
+
+	// an unknown stream only gets a retry, nothing is allocated
+	conn, err := net.ListenPacket("udp", badAddr)
+	checkError(t, err)
+	defer conn.Close()
+	dst, _ := net.ResolveUDPAddr("udp", rAddr)
+	c, err := newPacketCrypt(copt)
+	checkError(t, err)
+	uuid, _ := gouuid.NewV1()
+	sealed := func(cookie []byte) []byte {
+		buf := make([]byte, gouuid.Size+c.overhead()+64, mtuLimit)
+		copy(buf, uuid[:])
+		if cookie != nil {
+			buf = wrapCookie(buf, cookie)
+		}
+		c.seal(buf)
+		return buf
+	}
+
+	_, err = conn.WriteTo(sealed(nil), dst)
+	checkError(t, err)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, mtuLimit)
+	n, _, err := conn.ReadFrom(buf)
+	checkError(t, err)
+	msg, ok := decodeHandshake(buf[:n])
+	if !ok || msg.typ != hsRetry || msg.uuid != uuid {
+		t.Fatal("retry expected")
+	}
+	if n := len(server.streams()); n != 1 {
+		t.Fatalf("stream allocated without cookie. streams:%v", n)
+	}
+
+	// a forged cookie is rejected
+	rejected := atomic.LoadUint64(&DefaultSnmp.RejectedOpens)
+	_, err = conn.WriteTo(sealed(bytes.Repeat([]byte{1}, cookieSize)), dst)
+	checkError(t, err)
+	time.Sleep(time.Millisecond * 100)
+	if atomic.LoadUint64(&DefaultSnmp.RejectedOpens) == rejected {
+		t.Fatal("RejectedOpens not counted")
+	}
+	if n := len(server.streams()); n != 1 {
+		t.Fatalf("stream allocated with a forged cookie. streams:%v", n)
+	}
+}
+
+func TestSynCookieHandshake(t *testing.T) {
+	lAddr, rAddr := "127.0.0.1:7221", "127.0.0.1:17221"
+	copt := &CryptOption{Method: CryptAESGCM, Handshake: &HandshakeOption{PSK: []byte("kcp-go cookie test psk")}}
+
+	client, server := newTransportPair(t, []string{lAddr}, []string{rAddr}, &TransportOption{CryptOption: copt}, &TransportOption{CryptOption: copt, SynCookie: true})
+	defer server.Close()
+	defer client.Close()
+	acceptEcho(server)
+
+	cookieOpens := atomic.LoadUint64(&DefaultSnmp.CookieOpens)
+	stream, err := client.Open([]string{lAddr}, []string{rAddr})
+	checkError(t, err)
+	defer stream.Close()
+	checkError(t, echoTester(stream, 4096, 16))
+	if atomic.LoadUint64(&DefaultSnmp.CookieOpens) == cookieOpens {
+		t.Fatal("CookieOpens not counted")
+	}
+}
+
+func TestOpenRateLimit(t *testing.T) {
+	lAddr, rAddr := "127.0.0.1:7231", "127.0.0.1:17231"
+
+	serverSel, _ := NewTestSelector([]string{rAddr}, []string{lAddr})
+	server, err := NewUDPTransport(serverSel, &TransportOption{OpenRate: 0.1, OpenBurst: 2})
+	checkError(t, err)
+	defer server.Close()
+	_, err = server.NewTunnel(rAddr)
+	checkError(t, err)
+	go func() {
+		for {
+			stream, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go handleEchoClient(stream)
+		}
+	}()
+
+	clientSel, _ := NewTestSelector([]string{lAddr}, []string{rAddr})
+	client, err := NewUDPTransport(clientSel, nil)
+	checkError(t, err)
+	defer client.Close()
+	_, err = client.NewTunnel(lAddr)
+	checkError(t, err)
+
+	for i := 0; i < 2; i++ {
+		stream, err := client.Open([]string{lAddr}, []string{rAddr})
+		checkError(t, err)
+		defer stream.Close()
+	}
+
+	rejected := atomic.LoadUint64(&DefaultSnmp.RejectedOpens)
+	if _, err = client.OpenTimeout([]string{lAddr}, []string{rAddr}, time.Millisecond*300); err == nil {
+		t.Fatal("open over the rate limit")
+	}
+	if atomic.LoadUint64(&DefaultSnmp.RejectedOpens) == rejected {
+		t.Fatal("RejectedOpens not counted")
+	}
+}
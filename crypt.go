@@ -0,0 +1,347 @@
+package kcp
+
+import (
+	"container/list"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	gouuid "github.com/satori/go.uuid"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+var (
+	errCryptMethod = errors.New("err crypt method")
+	errCryptKey    = errors.New("err crypt key")
+)
+
+const (
+	CryptAESGCM           = "aes-gcm"
+	CryptChaCha20Poly1305 = "chacha20-poly1305"
+
+	maxCryptCache  = 4096 // derived stream keys kept in memory
+	sessionKeySize = 32   // negotiated keys are 256 bits for every method
+
+	// nonce counters remembered for every stream, the counter of a sender is shared by all its
+	// streams so the window is wide enough for interleaving and reordering between paths
+	replayWindowSize = 8192
+
+	// closed streams whose highest nonce counter is remembered, older packets of them are replays
+	maxReplayTombstones = 4 * maxCryptCache
+)
+
+// CryptOption enables authenticated encryption of every packet on the tunnels of a transport
+type CryptOption struct {
+	Method    string // CryptAESGCM or CryptChaCha20Poly1305
+	Key       []byte // pre-shared key, 16, 24 or 32 bytes for aes-gcm, 32 bytes for chacha20-poly1305
+	PerStream bool   // derive a key for every stream, HMAC-SHA256(Key, uuid) truncated to len(Key)
+
+	// negotiate a session key for every stream, Key and PerStream are ignored if set
+	Handshake *HandshakeOption
+}
+
+// packetCrypt seals and opens datagrams in place.
+//
+// | UUID(16B) | NONCE(12B) | CIPHERTEXT | TAG(16B) |
+//
+// The uuid stays in clear for routing and is authenticated as additional data,
+// so is the cookie header of a packet wrapped with a retry cookie.
+type packetCrypt struct {
+	method    string
+	key       []byte
+	perStream bool
+	aead      cipher.AEAD // keyed with the pre-shared key
+
+	nonce   [12]byte // random nonce base
+	counter uint64   // packets sealed
+
+	mu       sync.Mutex
+	cache    map[gouuid.UUID]cipher.AEAD   // derived stream keys
+	sessions map[gouuid.UUID]cipher.AEAD   // negotiated stream keys, nil without handshake
+	replay   map[gouuid.UUID]*list.Element // *replayEntry in live or closed
+	live     list.List                     // open streams, most recently used first
+	closed   list.List                     // tombstones of closed streams, most recently used first
+}
+
+// replayEntry is the replay window of an open stream or the tombstone of a closed one
+type replayEntry struct {
+	uuid   gouuid.UUID
+	window *replayWindow // nil once closed
+	high   uint64        // highest counter opened, kept once closed
+}
+
+func newAEAD(method string, key []byte) (cipher.AEAD, error) {
+	switch method {
+	case CryptAESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, errCryptKey
+		}
+		return cipher.NewGCM(block)
+	case CryptChaCha20Poly1305:
+		aead, err := chacha20poly1305.New(key)
+		if err != nil {
+			return nil, errCryptKey
+		}
+		return aead, nil
+	default:
+		return nil, errCryptMethod
+	}
+}
+
+func newPacketCrypt(opt *CryptOption) (*packetCrypt, error) {
+	key := opt.Key
+	if opt.Handshake != nil {
+		// only for the sizes, every stream has its own key
+		key = make([]byte, sessionKeySize)
+	}
+	aead, err := newAEAD(opt.Method, key)
+	if err != nil {
+		return nil, err
+	}
+
+	c := new(packetCrypt)
+	c.method = opt.Method
+	c.key = append([]byte(nil), opt.Key...)
+	c.perStream = opt.PerStream
+	c.aead = aead
+	c.cache = make(map[gouuid.UUID]cipher.AEAD)
+	c.replay = make(map[gouuid.UUID]*list.Element)
+	if opt.Handshake != nil {
+		c.sessions = make(map[gouuid.UUID]cipher.AEAD)
+	}
+	if _, err := rand.Read(c.nonce[:]); err != nil {
+		return nil, err
+	}
+	// the nonce takes the place of the handshake marker, it must never match it
+	if binary.LittleEndian.Uint32(c.nonce[:]) == hsMarker {
+		c.nonce[0] = 0
+	}
+	return c, nil
+}
+
+// overhead returns the bytes added to every packet
+func (c *packetCrypt) overhead() int {
+	return c.aead.NonceSize() + c.aead.Overhead()
+}
+
+// streamAEAD returns the cipher of a stream, cached reports whether the key was derived before.
+// aead is nil if the stream has no negotiated key.
+func (c *packetCrypt) streamAEAD(uuid gouuid.UUID) (aead cipher.AEAD, cached bool) {
+	if c.sessions != nil {
+		c.mu.Lock()
+		aead = c.sessions[uuid]
+		c.mu.Unlock()
+		return aead, true
+	}
+	if !c.perStream {
+		return c.aead, true
+	}
+
+	c.mu.Lock()
+	aead, cached = c.cache[uuid]
+	c.mu.Unlock()
+	if cached {
+		return aead, true
+	}
+
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write(uuid[:])
+	aead, _ = newAEAD(c.method, mac.Sum(nil)[:len(c.key)])
+	return aead, false
+}
+
+// remember caches a derived key, keys of packets failing authentication are never cached
+func (c *packetCrypt) remember(uuid gouuid.UUID, aead cipher.AEAD) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.cache) >= maxCryptCache {
+		c.cache = make(map[gouuid.UUID]cipher.AEAD)
+	}
+	c.cache[uuid] = aead
+}
+
+// setSession installs the key negotiated by the handshake of a stream
+func (c *packetCrypt) setSession(uuid gouuid.UUID, key []byte) error {
+	aead, err := newAEAD(c.method, key[:sessionKeySize])
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.sessions[uuid] = aead
+	c.mu.Unlock()
+	return nil
+}
+
+// forget drops the keys of a stream and keeps the highest nonce counter it opened,
+// so its old packets are still refused
+func (c *packetCrypt) forget(uuid gouuid.UUID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.cache, uuid)
+	delete(c.sessions, uuid)
+
+	e, ok := c.replay[uuid]
+	if !ok {
+		return
+	}
+	r := e.Value.(*replayEntry)
+	if r.window == nil {
+		return
+	}
+	c.live.Remove(e)
+	if !r.window.init {
+		delete(c.replay, uuid)
+		return
+	}
+	r.high, r.window = r.window.high, nil
+	c.replay[uuid] = c.closed.PushFront(r)
+	if c.closed.Len() > maxReplayTombstones {
+		c.evictReplay(&c.closed)
+	}
+}
+
+// fresh reports whether the nonce counter seq of a stream was not opened before and marks it
+func (c *packetCrypt) fresh(uuid gouuid.UUID, seq uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.replay[uuid]
+	if !ok {
+		if c.live.Len() >= maxCryptCache {
+			// streams closed without forget, the least recently used starts a new window
+			c.evictReplay(&c.live)
+		}
+		e = c.live.PushFront(&replayEntry{uuid: uuid, window: new(replayWindow)})
+		c.replay[uuid] = e
+	}
+	r := e.Value.(*replayEntry)
+	if r.window == nil {
+		c.closed.MoveToFront(e)
+		if int64(seq-r.high) <= 0 {
+			return false
+		}
+		r.high = seq
+		return true
+	}
+	c.live.MoveToFront(e)
+	return r.window.check(seq)
+}
+
+// evictReplay drops the least recently used entry of l, c.mu must be held
+func (c *packetCrypt) evictReplay(l *list.List) {
+	e := l.Back()
+	if e == nil {
+		return
+	}
+	l.Remove(e)
+	delete(c.replay, e.Value.(*replayEntry).uuid)
+}
+
+// seal encrypts buf in place, the plaintext starts after a gap of overhead() bytes following the header.
+// It returns false if the stream has no key.
+func (c *packetCrypt) seal(buf []byte) bool {
+	hdr := packetHeaderSize(buf)
+	var uuid gouuid.UUID
+	copy(uuid[:], buf)
+	aead, cached := c.streamAEAD(uuid)
+	if aead == nil {
+		return false
+	} else if !cached {
+		c.remember(uuid, aead)
+	}
+
+	ns := aead.NonceSize()
+	nonce := buf[hdr : hdr+ns]
+	copy(nonce, c.nonce[:])
+	binary.LittleEndian.PutUint64(nonce[4:], binary.LittleEndian.Uint64(c.nonce[4:])+atomic.AddUint64(&c.counter, 1))
+
+	// move the plaintext next to the nonce, the tag takes the end of the packet
+	dst := buf[hdr+ns:]
+	n := copy(dst, buf[hdr+c.overhead():])
+	aead.Seal(dst[:0], nonce, dst[:n], buf[:hdr])
+	return true
+}
+
+// open authenticates and decrypts buf in place, the returned packet is the header followed by the plaintext.
+// A packet whose nonce was opened before for the stream is a replay and fails.
+func (c *packetCrypt) open(buf []byte) ([]byte, bool) {
+	hdr := packetHeaderSize(buf)
+	if len(buf) < hdr+c.overhead() {
+		return nil, false
+	}
+
+	var uuid gouuid.UUID
+	copy(uuid[:], buf)
+	aead, cached := c.streamAEAD(uuid)
+	if aead == nil {
+		return nil, false
+	}
+
+	ns := aead.NonceSize()
+	ciphertext := buf[hdr+ns:]
+	plaintext, err := aead.Open(ciphertext[:0], buf[hdr:hdr+ns], ciphertext, buf[:hdr])
+	if err != nil {
+		return nil, false
+	}
+	if !c.fresh(uuid, binary.LittleEndian.Uint64(buf[hdr+4:hdr+ns])) {
+		return nil, false
+	}
+	if !cached {
+		c.remember(uuid, aead)
+	}
+
+	n := copy(buf[hdr:], plaintext)
+	return buf[:hdr+n], true
+}
+
+// replayWindow is a sliding bitmap of the nonce counters below the highest one opened
+type replayWindow struct {
+	init   bool
+	high   uint64
+	bitmap [replayWindowSize / 64]uint64
+}
+
+// check marks seq, it returns false if seq was marked before or is too old to tell
+func (w *replayWindow) check(seq uint64) bool {
+	if !w.init {
+		w.init, w.high = true, seq
+		w.set(seq)
+		return true
+	}
+
+	// serial arithmetic, the counter starts at a random base and may wrap
+	d := int64(seq - w.high)
+	switch {
+	case d > 0:
+		if d >= replayWindowSize {
+			w.bitmap = [replayWindowSize / 64]uint64{}
+		} else {
+			for i := uint64(1); i < uint64(d); i++ {
+				w.clear(w.high + i)
+			}
+		}
+		w.high = seq
+		w.set(seq)
+		return true
+	case -d >= replayWindowSize:
+		return false
+	case w.bitmap[seq/64%uint64(len(w.bitmap))]&(1<<(seq%64)) != 0:
+		return false
+	}
+	w.set(seq)
+	return true
+}
+
+func (w *replayWindow) set(seq uint64) {
+	w.bitmap[seq/64%uint64(len(w.bitmap))] |= 1 << (seq % 64)
+}
+
+func (w *replayWindow) clear(seq uint64) {
+	w.bitmap[seq/64%uint64(len(w.bitmap))] &^= 1 << (seq % 64)
+}
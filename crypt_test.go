@@ -0,0 +1,169 @@
+package kcp
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gouuid "github.com/satori/go.uuid"
+)
+
+func TestPacketCrypt(t *testing.T) {
+	key := make([]byte, 32)
+	lossRand.Read(key)
+
+	for _, opt := range []*CryptOption{
+		{Method: CryptAESGCM, Key: key[:16]},
+		{Method: CryptChaCha20Poly1305, Key: key},
+		{Method: CryptAESGCM, Key: key, PerStream: true},
+	} {
+		c, err := newPacketCrypt(opt)
+		checkError(t, err)
+
+		uuid, _ := gouuid.NewV1()
+		payload := make([]byte, 200)
+		lossRand.Read(payload)
+
+		pkt := xmitBuf.Get().([]byte)[:gouuid.Size+c.overhead()+len(payload)]
+		copy(pkt, uuid[:])
+		copy(pkt[gouuid.Size+c.overhead():], payload)
+		c.seal(pkt)
+		if bytes.Contains(pkt, payload[:32]) {
+			t.Fatalf("%v payload in clear", opt.Method)
+		}
+
+		// tampered uuid fails authentication
+		forged := append([]byte(nil), pkt...)
+		forged[0] ^= 1
+		if _, ok := c.open(forged); ok {
+			t.Fatalf("%v forged packet opened", opt.Method)
+		}
+
+		replayed := append([]byte(nil), pkt...)
+		plain, ok := c.open(pkt)
+		if !ok || !bytes.Equal(plain[:gouuid.Size], uuid[:]) || !bytes.Equal(plain[gouuid.Size:], payload) {
+			t.Fatalf("%v open failed", opt.Method)
+		}
+		if _, ok := c.open(replayed); ok {
+			t.Fatalf("%v replayed packet opened", opt.Method)
+		}
+		// the tombstone of a closed stream still refuses its old packets
+		c.forget(uuid)
+		if _, ok := c.open(append([]byte(nil), replayed...)); ok {
+			t.Fatalf("%v replayed packet opened after forget", opt.Method)
+		}
+	}
+
+	if _, err := newPacketCrypt(&CryptOption{Method: CryptChaCha20Poly1305, Key: key[:16]}); err != errCryptKey {
+		t.Fatal("short chacha20 key accepted")
+	}
+	if _, err := newPacketCrypt(&CryptOption{Method: "rc4", Key: key}); err != errCryptMethod {
+		t.Fatal("unknown method accepted")
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	base := ^uint64(0) - 10 // the counter wraps
+	for _, c := range []struct {
+		seq   uint64
+		fresh bool
+	}{
+		{base, true},
+		{base + 5, true},
+		{base + 3, true}, // reordered
+		{base + 5, false},
+		{base, false},
+		{base + 20, true},
+		{base + 4, true},
+		{base + 20 + replayWindowSize, true},
+		{base + 20, false}, // out of the window
+		{base + 21, true},
+		{base + 21, false},
+		{base + 19 + replayWindowSize, true},
+	} {
+		if fresh := w.check(c.seq); fresh != c.fresh {
+			t.Fatalf("replay window. seq:%v fresh:%v want:%v", c.seq-base, fresh, c.fresh)
+		}
+	}
+}
+
+func TestReplayEviction(t *testing.T) {
+	c, err := newPacketCrypt(&CryptOption{Method: CryptAESGCM, Key: make([]byte, 16)})
+	checkError(t, err)
+	uuids := make([]gouuid.UUID, maxCryptCache+1)
+	for i := range uuids {
+		uuids[i], _ = gouuid.NewV1()
+	}
+
+	// the least recently used stream is evicted, not the first one opened
+	for _, uuid := range uuids[:maxCryptCache] {
+		c.fresh(uuid, 1)
+	}
+	c.fresh(uuids[0], 2)
+	c.fresh(uuids[maxCryptCache], 1)
+	if c.fresh(uuids[0], 1) {
+		t.Fatal("recently used window evicted")
+	}
+	if !c.fresh(uuids[1], 1) {
+		t.Fatal("least recently used window kept")
+	}
+
+	// a closed stream accepts newer counters only
+	c.forget(uuids[0])
+	if c.fresh(uuids[0], 2) || !c.fresh(uuids[0], 3) || c.live.Len()+c.closed.Len() != len(c.replay) {
+		t.Fatal("tombstone")
+	}
+}
+
+func TestCryptEcho(t *testing.T) {
+	lAddr, rAddr, badAddr := "127.0.0.1:7181", "127.0.0.1:17181", "127.0.0.1:27181"
+	key := []byte("0123456789abcdef0123456789abcdef")
+	copt := &CryptOption{Method: CryptChaCha20Poly1305, Key: key, PerStream: true}
+
+	clientSel, _ := NewTestSelector([]string{lAddr}, []string{rAddr})
+	client, err := NewUDPTransport(clientSel, &TransportOption{CryptOption: copt, StreamOption: &StreamOption{DataShards: 4, ParityShards: 2}})
+	checkError(t, err)
+	defer client.Close()
+	_, err = client.NewTunnel(lAddr)
+	checkError(t, err)
+
+	serverSel, _ := NewTestSelector([]string{rAddr}, []string{lAddr, badAddr})
+	server, err := NewUDPTransport(serverSel, &TransportOption{CryptOption: copt})
+	checkError(t, err)
+	defer server.Close()
+	_, err = server.NewTunnel(rAddr)
+	checkError(t, err)
+
+	go func() {
+		for {
+			stream, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go handleEchoClient(stream)
+		}
+	}()
+
+	stream, err := client.Open([]string{lAddr}, []string{rAddr})
+	checkError(t, err)
+	defer stream.Close()
+	checkError(t, echoTester(stream, 4096, 16))
+
+	// a peer with a different key is dropped by the tunnels
+	badSel, _ := NewTestSelector([]string{badAddr}, []string{rAddr})
+	bad, err := NewUDPTransport(badSel, &TransportOption{CryptOption: &CryptOption{Method: CryptChaCha20Poly1305, Key: bytes.Repeat([]byte{1}, 32)}})
+	checkError(t, err)
+	defer bad.Close()
+	_, err = bad.NewTunnel(badAddr)
+	checkError(t, err)
+
+	csumErrors := atomic.LoadUint64(&DefaultSnmp.InCsumErrors)
+	if _, err = bad.OpenTimeout([]string{badAddr}, []string{rAddr}, time.Millisecond*200); err == nil {
+		t.Fatal("stream opened with a wrong key")
+	}
+	if atomic.LoadUint64(&DefaultSnmp.InCsumErrors) == csumErrors {
+		t.Fatal("InCsumErrors not counted")
+	}
+}
@@ -0,0 +1,96 @@
+package kcp
+
+import (
+	"encoding/binary"
+)
+
+// PacketKind tells what a packet of a stream carries, a packet may carry several kinds
+type PacketKind uint8
+
+const (
+	PacketAck     PacketKind = 1 << iota // acknowledges or window probes
+	PacketData                           // segments of PSH
+	PacketControl                        // segments of SYN, SYN-ACK, FIN, RST, HRT or PATH
+)
+
+// PacketInfo describes a packet about to be sent to a DuplicationPolicy
+type PacketInfo struct {
+	Kind     PacketKind
+	Size     int
+	XmitMax  uint32 // highest transmit count of its segments and acknowledges, 1 for a first transmission
+	Paths    int    // paths of the stream
+	Parallel bool   // the stream duplicates after SetParallelXmit
+	Level    int    // paths the ParallelPolicy of the remote host asks for, at least 1
+}
+
+// Retransmission reports if the packet carries a segment or an acknowledge sent before
+func (info PacketInfo) Retransmission() bool {
+	return info.XmitMax > 1
+}
+
+// DuplicationPolicy decides on how many paths a packet of a stream in redundant mode is sent,
+// the first path always gets it. In striped mode it decides for packets carrying acknowledges
+// or control frames only. The duplicate bytes are counted by Name, see Snmp.DupBytesByPolicy.
+type DuplicationPolicy interface {
+	Name() string
+	Paths(info PacketInfo) int
+}
+
+// ParallelDuplication copies every packet to every path while the stream is parallel and to
+// as many paths as the host level asks for otherwise, the default
+type ParallelDuplication struct{}
+
+func (ParallelDuplication) Name() string { return "parallel" }
+
+func (ParallelDuplication) Paths(info PacketInfo) int {
+	if info.Parallel {
+		return info.Paths
+	}
+	return info.Level
+}
+
+// SelectiveDuplication copies retransmissions, ack-only packets and control frames to every
+// path, first transmissions of data are sent on as many paths as the host level asks for
+type SelectiveDuplication struct{}
+
+func (SelectiveDuplication) Name() string { return "selective" }
+
+func (SelectiveDuplication) Paths(info PacketInfo) int {
+	if info.Retransmission() || info.Kind == PacketAck || info.Kind&PacketControl != 0 {
+		return info.Paths
+	}
+	return info.Level
+}
+
+// SetDuplicationPolicy changes what is duplicated, see DuplicationPolicy, nil restores ParallelDuplication
+func (s *UDPStream) SetDuplicationPolicy(policy DuplicationPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if policy == nil {
+		policy = ParallelDuplication{}
+	}
+	s.dupPolicy = policy
+}
+
+// packetKind reads the segments of a packet, every segment of PSH or a control frame
+// starts with its flag
+func packetKind(buf []byte) (kind PacketKind) {
+	for len(buf) >= IKCP_OVERHEAD {
+		cmd := buf[4]
+		length := int(binary.LittleEndian.Uint32(buf[20:]))
+		buf = buf[IKCP_OVERHEAD:]
+		if length > len(buf) {
+			break
+		}
+		switch {
+		case cmd != IKCP_CMD_PUSH:
+			kind |= PacketAck
+		case length > 0 && buf[0] != PSH:
+			kind |= PacketControl
+		default:
+			kind |= PacketData
+		}
+		buf = buf[length:]
+	}
+	return kind
+}
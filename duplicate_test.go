@@ -0,0 +1,134 @@
+package kcp
+
+import (
+	"testing"
+	"time"
+
+	gouuid "github.com/satori/go.uuid"
+)
+
+// testPacket encodes a packet of one segment with cmd and data behind the header of s
+func testPacket(s *UDPStream, cmd uint8, data []byte) []byte {
+	buf := make([]byte, s.headerSize+IKCP_OVERHEAD+len(data))
+	seg := segment{cmd: cmd, data: data}
+	copy(seg.encode(buf[s.headerSize:]), data)
+	return buf
+}
+
+func TestDuplicationPolicy(t *testing.T) {
+	sel := NewRoundRobinSelector()
+	for _, tunnel := range selectorTunnels(2) {
+		sel.Add(tunnel)
+	}
+	uuid, _ := gouuid.NewV1()
+	s, err := NewUDPStream(uuid, false, []string{"127.0.0.1:9200", "127.0.0.1:9201"}, nil, sel, func(gouuid.UUID) {})
+	checkError(t, err)
+	defer s.Close()
+
+	data := testPacket(s, IKCP_CMD_PUSH, []byte{PSH, 'x'})
+	fin := testPacket(s, IKCP_CMD_PUSH, []byte{FIN, protoVersion})
+	ack := testPacket(s, IKCP_CMD_ACK, nil)
+	if k := packetKind(data[s.headerSize:]); k != PacketData {
+		t.Fatalf("data kind. kind:%v", k)
+	}
+	if k := packetKind(fin[s.headerSize:]); k != PacketControl {
+		t.Fatalf("control kind. kind:%v", k)
+	}
+	if k := packetKind(append(ack, data[s.headerSize:]...)[s.headerSize:]); k != PacketAck|PacketData {
+		t.Fatalf("piggybacked kind. kind:%v", k)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = StateEstablish
+	for _, c := range []struct {
+		policy  DuplicationPolicy
+		buf     []byte
+		xmitMax uint32
+		paths   int
+	}{
+		{ParallelDuplication{}, data, 1, 1},
+		{ParallelDuplication{}, fin, 1, 1},
+		{ParallelDuplication{}, data, DefaultParallelXmit, 2},
+		{SelectiveDuplication{}, data, 1, 1},
+		{SelectiveDuplication{}, data, 2, 2},
+		{SelectiveDuplication{}, fin, 1, 2},
+		{SelectiveDuplication{}, ack, 1, 2},
+	} {
+		s.dupPolicy = c.policy
+		s.parallelExpire = time.Time{}
+		if paths := s.parallelTun(c.buf, c.xmitMax); paths != c.paths {
+			t.Fatalf("paths. policy:%v kind:%v xmitMax:%v paths:%v want:%v", c.policy.Name(), packetKind(c.buf[s.headerSize:]), c.xmitMax, paths, c.paths)
+		}
+	}
+}
+
+func TestHostLevelDuplication(t *testing.T) {
+	sel := NewRoundRobinSelector()
+	for _, tunnel := range selectorTunnels(3) {
+		sel.Add(tunnel)
+	}
+	uuid, _ := gouuid.NewV1()
+	s, err := NewUDPStream(uuid, false, []string{"127.0.0.1:9210", "127.0.0.1:9211", "127.0.0.1:9212"}, nil, sel, func(gouuid.UUID) {})
+	checkError(t, err)
+	defer s.Close()
+
+	// the stream goes parallel on retransmissions whatever the host level
+	data := testPacket(s, IKCP_CMD_PUSH, []byte{PSH, 'x'})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = StateEstablish
+	s.hp = newHostParallel("10.0.0.1", NewLossParallelPolicy(0, 0), DefaultSnmp)
+	s.hp.level = 2
+	for _, c := range []struct {
+		xmitMax uint32
+		paths   int
+	}{
+		{1, 2},
+		{DefaultParallelXmit, 3},
+		{1, 3}, // until the parallel time expires
+	} {
+		if paths := s.parallelTun(data, c.xmitMax); paths != c.paths {
+			t.Fatalf("paths. xmitMax:%v paths:%v want:%v", c.xmitMax, paths, c.paths)
+		}
+	}
+}
+
+func TestSelectiveDuplication(t *testing.T) {
+	lAddrs := []string{"127.0.0.1:7391", "127.0.0.1:27391"}
+	rAddrs := []string{"127.0.0.1:17391", "127.0.0.1:37391"}
+	client, server := newTransportPair(t, lAddrs, rAddrs, nil, nil)
+	dialer, acceptor := openPair(t, client, server, lAddrs, rAddrs, 2, true)
+	defer client.Close()
+	defer server.Close()
+	defer dialer.Close()
+	dialer.SetDuplicationPolicy(SelectiveDuplication{})
+
+	before := client.snmp.DupBytesByPolicy()["selective"]
+	acceptor.mu.Lock()
+	last := acceptor.pathRecv[1]
+	acceptor.mu.Unlock()
+	checkError(t, echoTester(dialer, 1024, 4))
+
+	// acknowledges of the echoes go on both paths with the next flush
+	deadline := time.Now().Add(time.Second)
+	for {
+		acceptor.mu.Lock()
+		used := acceptor.pathRecv[1].After(last)
+		acceptor.mu.Unlock()
+		if used && client.snmp.DupBytesByPolicy()["selective"] > before {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no duplicates. used:%v bytes:%v", used, client.snmp.DupBytesByPolicy()["selective"]-before)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	// counted by the transport of the stream only
+	if n := server.snmp.DupBytesByPolicy()["selective"]; n != 0 {
+		t.Fatalf("duplicates counted by another transport. bytes:%v", n)
+	}
+	if DefaultSnmp.DupBytesByPolicy()["selective"] < client.snmp.DupBytesByPolicy()["selective"] {
+		t.Fatal("duplicates not aggregated")
+	}
+}
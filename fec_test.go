@@ -0,0 +1,113 @@
+package kcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync/atomic"
+	"testing"
+
+	gouuid "github.com/satori/go.uuid"
+)
+
+func TestFECCodec(t *testing.T) {
+	const dataShards, parityShards = 10, 3
+	enc := newFECEncoder(dataShards, parityShards, gouuid.Size)
+	dec := newFECDecoder(dataShards, parityShards)
+	if enc == nil || dec == nil {
+		t.Fatal("codec create failed")
+	}
+
+	var pkts [][]byte
+	var payloads [][]byte
+	for i := 0; i < dataShards; i++ {
+		payload := make([]byte, 100+i*10)
+		lossRand.Read(payload)
+		payloads = append(payloads, payload)
+
+		pkt := make([]byte, gouuid.Size+fecHeaderSizePlus2+len(payload))
+		copy(pkt[gouuid.Size+fecHeaderSizePlus2:], payload)
+		ps := enc.encode(pkt)
+		pkts = append(pkts, pkt)
+		if i < dataShards-1 && ps != nil {
+			t.Fatal("parity before quorum")
+		}
+		for k := range ps {
+			pkts = append(pkts, append([]byte(nil), ps[k]...))
+		}
+	}
+	if len(pkts) != dataShards+parityShards {
+		t.Fatalf("parity shards missing. pkts:%v", len(pkts))
+	}
+
+	// lose as many data shards as parity shards
+	lost := map[int]bool{1: true, 4: true, 7: true}
+	var recovered [][]byte
+	for k, pkt := range pkts {
+		if lost[k] {
+			continue
+		}
+		if !fecPacket(pkt[gouuid.Size:]).isFEC() {
+			t.Fatal("fec packet not detected")
+		}
+		recovered = append(recovered, dec.decode(pkt[gouuid.Size:])...)
+	}
+	if len(recovered) != len(lost) {
+		t.Fatalf("recovered:%v", len(recovered))
+	}
+	for k, idx := range []int{1, 4, 7} {
+		sz := binary.LittleEndian.Uint16(recovered[k])
+		if !bytes.Equal(recovered[k][2:sz], payloads[idx]) {
+			t.Fatalf("shard %v recovered wrong", idx)
+		}
+	}
+}
+
+func TestFECEcho(t *testing.T) {
+	lAddr, rAddr := "127.0.0.1:7171", "127.0.0.1:17171"
+
+	clientSel, _ := NewTestSelector([]string{lAddr}, []string{rAddr})
+	client, err := NewUDPTransport(clientSel, &TransportOption{
+		StreamOption: &StreamOption{Nodelay: 1, Interval: 10, Resend: 2, Nc: 1, DataShards: 10, ParityShards: 3},
+	})
+	checkError(t, err)
+	defer client.Close()
+	clientTunnel, err := client.NewTunnel(lAddr)
+	checkError(t, err)
+
+	// the acceptor has no fec setting, it follows the dialer
+	serverSel, _ := NewTestSelector([]string{rAddr}, []string{lAddr})
+	server, err := NewUDPTransport(serverSel, nil)
+	checkError(t, err)
+	defer server.Close()
+	serverTunnel, err := server.NewTunnel(rAddr)
+	checkError(t, err)
+
+	accepted := make(chan *UDPStream, 1)
+	go func() {
+		stream, err := server.Accept()
+		if err == nil {
+			accepted <- stream
+			handleEchoClient(stream)
+		}
+	}()
+
+	stream, err := client.Open([]string{lAddr}, []string{rAddr})
+	checkError(t, err)
+	defer stream.Close()
+
+	s := <-accepted
+	s.mu.Lock()
+	dataShards, parityShards := s.dataShards, s.parityShards
+	s.mu.Unlock()
+	if dataShards != 10 || parityShards != 3 {
+		t.Fatalf("fec not negotiated. dataShards:%v parityShards:%v", dataShards, parityShards)
+	}
+
+	recovered := atomic.LoadUint64(&DefaultSnmp.FECRecovered)
+	clientTunnel.Simulate(0.05, 0, 0)
+	serverTunnel.Simulate(0.05, 0, 0)
+	checkError(t, echoTester(stream, 1024, 512))
+	if atomic.LoadUint64(&DefaultSnmp.FECRecovered) == recovered {
+		t.Fatal("nothing recovered by fec")
+	}
+}
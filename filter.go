@@ -0,0 +1,118 @@
+package kcp
+
+import (
+	"container/list"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	gouuid "github.com/satori/go.uuid"
+)
+
+var (
+	errStreamDropped  = errors.New("err stream dropped")
+	errStreamRejected = errors.New("err stream rejected")
+)
+
+var (
+	DefaultFilterVerdictTTL = time.Second * 10 // SYN retransmits of a refused stream are dropped for so long, read when a transport is created
+	DefaultFilterVerdicts   = 4096             // refused streams remembered at most, read when a transport is created
+)
+
+// AcceptDecision is the verdict of an AcceptFilter
+type AcceptDecision int
+
+const (
+	AcceptStream AcceptDecision = iota // queue the stream for Accept
+	DropStream                         // discard the stream silently, the dialer times out
+	RejectStream                       // discard the stream and answer with RST, the dial fails at once
+)
+
+func (d AcceptDecision) String() string {
+	switch d {
+	case AcceptStream:
+		return "accept"
+	case DropStream:
+		return "drop"
+	case RejectStream:
+		return "reject"
+	}
+	return "unknown"
+}
+
+// AcceptInfo describes an incoming stream whose SYN has been parsed
+type AcceptInfo struct {
+	UUID         gouuid.UUID
+	RemoteAddr   net.Addr     // source of the SYN
+	Remotes      []string     // endpoints the dialer listed in SYN
+	Metadata     Metadata     // sent by the dialer in SYN, nil if none
+	Capabilities Capabilities // of the dialer
+}
+
+// AcceptFilter decides about an incoming stream before it is queued for Accept,
+// nothing is sent to the dialer until it has returned. It is called on the input
+// goroutines of the transport and should not block.
+type AcceptFilter func(info *AcceptInfo) AcceptDecision
+
+// verdictCache remembers the streams AcceptFilter refused, so the SYN retransmits of their
+// dialers are dropped before a stream is allocated. A rejected dialer whose RST is lost
+// times out like a dropped one.
+type verdictCache struct {
+	ttl      time.Duration
+	max      int
+	mu       sync.Mutex
+	verdicts map[gouuid.UUID]*list.Element
+	fifo     list.List // *filterVerdict, the oldest and first to expire at the front
+}
+
+type filterVerdict struct {
+	uuid     gouuid.UUID
+	decision AcceptDecision
+	expire   time.Time
+}
+
+func newVerdictCache(ttl time.Duration, max int) *verdictCache {
+	return &verdictCache{
+		ttl:      ttl,
+		max:      max,
+		verdicts: make(map[gouuid.UUID]*list.Element),
+	}
+}
+
+// get returns the cached decision of uuid
+func (c *verdictCache) get(uuid gouuid.UUID, now time.Time) (AcceptDecision, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expire(now)
+	e, ok := c.verdicts[uuid]
+	if !ok {
+		return AcceptStream, false
+	}
+	return e.Value.(*filterVerdict).decision, true
+}
+
+func (c *verdictCache) put(uuid gouuid.UUID, decision AcceptDecision, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expire(now)
+	if _, ok := c.verdicts[uuid]; ok {
+		return
+	}
+	if c.fifo.Len() >= c.max {
+		c.remove(c.fifo.Front())
+	}
+	c.verdicts[uuid] = c.fifo.PushBack(&filterVerdict{uuid: uuid, decision: decision, expire: now.Add(c.ttl)})
+}
+
+// expire removes the verdicts older than ttl, c.mu must be held
+func (c *verdictCache) expire(now time.Time) {
+	for e := c.fifo.Front(); e != nil && !now.Before(e.Value.(*filterVerdict).expire); e = c.fifo.Front() {
+		c.remove(e)
+	}
+}
+
+func (c *verdictCache) remove(e *list.Element) {
+	c.fifo.Remove(e)
+	delete(c.verdicts, e.Value.(*filterVerdict).uuid)
+}
@@ -0,0 +1,173 @@
+package kcp
+
+import (
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gouuid "github.com/satori/go.uuid"
+)
+
+func TestAcceptFilter(t *testing.T) {
+	lAddr, rAddr, dropAddr, rejectAddr := "127.0.0.1:7241", "127.0.0.1:17241", "127.0.0.1:27241", "127.0.0.1:37241"
+
+	var filtered int32
+	filter := func(info *AcceptInfo) AcceptDecision {
+		atomic.AddInt32(&filtered, 1)
+		if len(info.Remotes) != 1 || info.Remotes[0] != info.RemoteAddr.String() {
+			t.Errorf("remotes not parsed. remotes:%v", info.Remotes)
+		}
+		switch info.RemoteAddr.String() {
+		case dropAddr:
+			return DropStream
+		case rejectAddr:
+			return RejectStream
+		}
+		return AcceptStream
+	}
+
+	serverSel, _ := NewTestSelector([]string{rAddr}, []string{lAddr})
+	server, err := NewUDPTransport(serverSel, &TransportOption{AcceptFilter: filter})
+	checkError(t, err)
+	defer server.Close()
+	_, err = server.NewTunnel(rAddr)
+	checkError(t, err)
+	go func() {
+		for {
+			stream, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go handleEchoClient(stream)
+		}
+	}()
+
+	newClient := func(addr string) *UDPTransport {
+		sel, _ := NewTestSelector([]string{addr}, []string{rAddr})
+		client, err := NewUDPTransport(sel, nil)
+		checkError(t, err)
+		_, err = client.NewTunnel(addr)
+		checkError(t, err)
+		return client
+	}
+
+	client := newClient(lAddr)
+	defer client.Close()
+	stream, err := client.Open([]string{lAddr}, []string{rAddr})
+	checkError(t, err)
+	defer stream.Close()
+	checkError(t, echoTester(stream, 4096, 16))
+
+	// dropped silently, the dialer sees nothing until its timeout
+	dropper := newClient(dropAddr)
+	defer dropper.Close()
+	if _, err = dropper.OpenTimeout([]string{dropAddr}, []string{rAddr}, time.Millisecond*300); err != errTimeout {
+		t.Fatalf("dropped stream. err:%v", err)
+	}
+
+	// rejected with RST, the dial fails before its timeout
+	rejected := atomic.LoadUint64(&DefaultSnmp.RejectedOpens)
+	rejecter := newClient(rejectAddr)
+	defer rejecter.Close()
+	start := time.Now()
+	if _, err = rejecter.OpenTimeout([]string{rejectAddr}, []string{rAddr}, time.Second); err != io.ErrUnexpectedEOF {
+		t.Fatalf("rejected stream. err:%v", err)
+	}
+	if time.Since(start) >= time.Second {
+		t.Fatal("reject waited for the dial timeout")
+	}
+	if atomic.LoadUint64(&DefaultSnmp.RejectedOpens) == rejected {
+		t.Fatal("RejectedOpens not counted")
+	}
+	if atomic.LoadInt32(&filtered) < 3 {
+		t.Fatalf("filter not called. filtered:%v", filtered)
+	}
+
+	// discarded streams are forgotten at once, well before CleanTimeout. A late segment
+	// of a failed dialer only makes a stray stream that is discarded as well.
+	deadline := time.Now().Add(time.Second)
+	for n := len(server.streams()); n != 1; n = len(server.streams()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("server kept discarded streams. streams:%v", n)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestAcceptFilterBacklog(t *testing.T) {
+	lAddr, rAddr, dropAddr := "127.0.0.1:7431", "127.0.0.1:17431", "127.0.0.1:27431"
+
+	serverSel, _ := NewTestSelector([]string{rAddr}, []string{lAddr, dropAddr})
+	var dropped int32
+	server, err := NewUDPTransport(serverSel, &TransportOption{AcceptBacklog: 1, AcceptFilter: func(info *AcceptInfo) AcceptDecision {
+		if info.RemoteAddr.String() == dropAddr {
+			atomic.AddInt32(&dropped, 1)
+			return DropStream
+		}
+		return AcceptStream
+	}})
+	checkError(t, err)
+	defer server.Close()
+	_, err = server.NewTunnel(rAddr)
+	checkError(t, err)
+	// passive opens are enabled but nothing takes the backlog yet
+	atomic.StoreInt32(&server.startAccept, 1)
+
+	dropSel, _ := NewTestSelector([]string{dropAddr}, []string{rAddr})
+	dropper, err := NewUDPTransport(dropSel, nil)
+	checkError(t, err)
+	defer dropper.Close()
+	_, err = dropper.NewTunnel(dropAddr)
+	checkError(t, err)
+	if _, err = dropper.OpenTimeout([]string{dropAddr}, []string{rAddr}, time.Millisecond*300); err == nil {
+		t.Fatal("dropped stream opened")
+	}
+	// SYN retransmits were dropped with the cached verdict
+	if n := atomic.LoadInt32(&dropped); n != 1 {
+		t.Fatalf("filter calls for a retransmitted SYN. calls:%v", n)
+	}
+
+	// dropped streams did not take the only slot
+	clientSel, _ := NewTestSelector([]string{lAddr}, []string{rAddr})
+	client, err := NewUDPTransport(clientSel, nil)
+	checkError(t, err)
+	defer client.Close()
+	_, err = client.NewTunnel(lAddr)
+	checkError(t, err)
+	stream, err := client.Open([]string{lAddr}, []string{rAddr})
+	checkError(t, err)
+	defer stream.Close()
+
+	accepted, err := server.Accept()
+	checkError(t, err)
+	if accepted.GetUUID() != stream.GetUUID() {
+		t.Fatal("accepted another stream")
+	}
+}
+
+func TestVerdictCache(t *testing.T) {
+	c := newVerdictCache(time.Second, 2)
+	uuids := make([]gouuid.UUID, 3)
+	for i := range uuids {
+		uuids[i], _ = gouuid.NewV1()
+	}
+	now := time.Now()
+	c.put(uuids[0], DropStream, now)
+	c.put(uuids[1], RejectStream, now.Add(time.Millisecond*500))
+	if d, ok := c.get(uuids[1], now); !ok || d != RejectStream {
+		t.Fatalf("cached verdict. decision:%v ok:%v", d, ok)
+	}
+
+	// the oldest verdict makes room, then verdicts expire after ttl
+	c.put(uuids[2], DropStream, now.Add(time.Millisecond*600))
+	if _, ok := c.get(uuids[0], now); ok {
+		t.Fatal("oldest verdict kept")
+	}
+	if _, ok := c.get(uuids[1], now.Add(time.Millisecond*1500)); ok {
+		t.Fatal("expired verdict kept")
+	}
+	if _, ok := c.get(uuids[2], now.Add(time.Millisecond*1500)); !ok || len(c.verdicts) != 1 {
+		t.Fatal("verdict expired early")
+	}
+}
@@ -1,9 +1,19 @@
 module github.com/ldcsoftware/kcp-go
 
 require (
+	github.com/klauspost/reedsolomon v1.10.0
 	github.com/satori/go.uuid v1.2.1-0.20181028125025-b2ce2384e17b
+	golang.org/x/crypto v0.29.0
+	golang.org/x/net v0.25.0
+)
+
+require (
+	github.com/cpuguy83/go-md2man/v2 v2.0.0-20190314233015-f79a8a8ca69d // indirect
+	github.com/klauspost/cpuid/v2 v2.1.0 // indirect
+	github.com/russross/blackfriday/v2 v2.0.1 // indirect
+	github.com/shurcooL/sanitized_anchor_name v1.0.0 // indirect
 	github.com/urfave/cli v1.22.4 // indirect
-	golang.org/x/net v0.0.0-20200602114024-627f9648deb9
+	golang.org/x/sys v0.27.0 // indirect
 )
 
-go 1.13
+go 1.20
@@ -0,0 +1,491 @@
+package kcp
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	gouuid "github.com/satori/go.uuid"
+	"golang.org/x/crypto/curve25519"
+)
+
+var (
+	errHandshake    = errors.New("err handshake")
+	errHandshakeKey = errors.New("err handshake key")
+)
+
+var (
+	DefaultHandshakeRetry   = time.Millisecond * 100 // hello retransmission interval
+	DefaultHandshakeTimeout = CleanTimeout           // accepted handshakes waiting for SYN
+)
+
+const (
+	hsMarker    = 0xffffffff // takes the place of KCP conv or FEC seqid, neither of them reaches it
+	hsHello     = 1
+	hsReply     = 2
+	hsRetry     = 3 // the acceptor asks to repeat with a cookie
+	hsCookie    = 4 // a stream packet wrapped with a cookie
+	hsChallenge = 5 // path challenge of a migrating stream
+	hsResponse  = 6 // path response echoing the challenge
+	hsPing      = 7 // health probe of a path
+	hsPong      = 8 // answer echoing the ping
+	hsKeySize   = 32
+	hsMsgSize   = gouuid.Size + 4 + 1 + 3*hsKeySize
+)
+
+var zeroKey = make([]byte, hsKeySize)
+
+// HandshakeOption authenticates peers and negotiates a session key for every stream.
+//
+// The dialer sends its ephemeral X25519 key in a hello, the acceptor answers with its own,
+// both derive the session key from the key exchange. A peer is authenticated by the PSK,
+// by its static key listed in PeerKeys, or both. A hello failing authentication is dropped
+// before any stream state is allocated. Without a PSK the transport requires SynCookie,
+// since a hello for a listed static key can be made by anyone.
+type HandshakeOption struct {
+	PrivateKey []byte   // static X25519 private key of this peer, optional
+	PeerKeys   [][]byte // static public keys of trusted peers, empty trusts any peer
+	PSK        []byte   // pre-shared key mixed into every key derivation, optional
+}
+
+// GenerateHandshakeKey generates a static X25519 key pair
+func GenerateHandshakeKey() (priv, pub []byte, err error) {
+	priv = make([]byte, hsKeySize)
+	if _, err = rand.Read(priv); err != nil {
+		return nil, nil, err
+	}
+	pub, err = curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	return priv, pub, nil
+}
+
+func isHandshake(data []byte) bool {
+	return len(data) >= gouuid.Size+4 && binary.LittleEndian.Uint32(data[gouuid.Size:]) == hsMarker
+}
+
+// isClearHandshake tells handshake packets sent in clear, cookie packets and path probes
+// are sealed behind their header
+func isClearHandshake(data []byte) bool {
+	return isHandshake(data) && !isCookie(data) && !isPathProbe(data)
+}
+
+// handshakeMsg is a hello, its reply or a retry
+//
+// | UUID(16B) | MARKER(4B) | TYPE(1B) | EPHEMERAL(32B) | STATIC(32B) | MAC(32B) | COOKIE(32B, optional) |
+// | UUID(16B) | MARKER(4B) | TYPE(1B) | COOKIE(32B) |
+//
+// A hello repeats the cookie of the last retry, the cookie is not covered by the mac.
+type handshakeMsg struct {
+	uuid      gouuid.UUID
+	typ       byte
+	ephemeral []byte
+	static    []byte // zero if the peer has no static key
+	mac       []byte
+	cookie    []byte
+	addr      net.Addr // source of a received message
+}
+
+func (m *handshakeMsg) encode() []byte {
+	if m.typ == hsRetry {
+		buf := make([]byte, gouuid.Size+5+cookieSize)
+		copy(buf, m.uuid[:])
+		binary.LittleEndian.PutUint32(buf[gouuid.Size:], hsMarker)
+		buf[gouuid.Size+4] = m.typ
+		copy(buf[gouuid.Size+5:], m.cookie)
+		return buf
+	}
+
+	buf := make([]byte, hsMsgSize, hsMsgSize+cookieSize)
+	copy(buf, m.uuid[:])
+	binary.LittleEndian.PutUint32(buf[gouuid.Size:], hsMarker)
+	buf[gouuid.Size+4] = m.typ
+	off := gouuid.Size + 5
+	copy(buf[off:], m.ephemeral)
+	copy(buf[off+hsKeySize:], m.static)
+	copy(buf[off+2*hsKeySize:], m.mac)
+	if m.cookie != nil {
+		buf = append(buf, m.cookie...)
+	}
+	return buf
+}
+
+func decodeHandshake(data []byte) (*handshakeMsg, bool) {
+	if len(data) < gouuid.Size+5 || !isHandshake(data) {
+		return nil, false
+	}
+	m := new(handshakeMsg)
+	copy(m.uuid[:], data)
+	m.typ = data[gouuid.Size+4]
+	off := gouuid.Size + 5
+
+	switch {
+	case m.typ == hsRetry && len(data) == off+cookieSize:
+		m.cookie = append([]byte(nil), data[off:]...)
+		return m, true
+	case m.typ == hsHello && len(data) == hsMsgSize+cookieSize:
+		m.cookie = append([]byte(nil), data[hsMsgSize:]...)
+	case (m.typ == hsHello || m.typ == hsReply) && len(data) == hsMsgSize:
+	default:
+		return nil, false
+	}
+	m.ephemeral = append([]byte(nil), data[off:off+hsKeySize]...)
+	m.static = append([]byte(nil), data[off+hsKeySize:off+2*hsKeySize]...)
+	m.mac = append([]byte(nil), data[off+2*hsKeySize:hsMsgSize]...)
+	return m, true
+}
+
+// handshakeAccept is a handshake answered by the acceptor, waiting for SYN
+type handshakeAccept struct {
+	ephemeral []byte
+	reply     []byte
+	ts        time.Time
+}
+
+type handshaker struct {
+	priv  []byte // static key, nil if not configured
+	pub   []byte
+	peers [][]byte
+	psk   []byte
+
+	mu      sync.Mutex
+	accepts map[gouuid.UUID]*handshakeAccept   // acceptor side
+	dials   map[gouuid.UUID]chan *handshakeMsg // dialer side
+	backlog int
+}
+
+func newHandshaker(opt *HandshakeOption, backlog int) (*handshaker, error) {
+	h := &handshaker{
+		pub:     zeroKey,
+		psk:     opt.PSK,
+		accepts: make(map[gouuid.UUID]*handshakeAccept),
+		dials:   make(map[gouuid.UUID]chan *handshakeMsg),
+		backlog: backlog,
+	}
+	if opt.PrivateKey != nil {
+		pub, err := curve25519.X25519(opt.PrivateKey, curve25519.Basepoint)
+		if err != nil {
+			return nil, errHandshakeKey
+		}
+		h.priv, h.pub = opt.PrivateKey, pub
+	}
+	for _, peer := range opt.PeerKeys {
+		if len(peer) != hsKeySize {
+			return nil, errHandshakeKey
+		}
+		h.peers = append(h.peers, peer)
+	}
+	return h, nil
+}
+
+func (h *handshaker) trusted(static []byte) bool {
+	if len(h.peers) == 0 {
+		return true
+	}
+	for _, peer := range h.peers {
+		if hmac.Equal(peer, static) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *handshaker) mac(key []byte, label string, parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	for _, part := range parts {
+		mac.Write(part)
+	}
+	return mac.Sum(nil)
+}
+
+// dh returns nil if either key is missing
+func dh(priv, pub []byte) ([]byte, error) {
+	if priv == nil || bytes.Equal(pub, zeroKey) {
+		return nil, nil
+	}
+	return curve25519.X25519(priv, pub)
+}
+
+// sessionKey mixes the ephemeral-ephemeral exchange with the static keys present:
+// the acceptor's static key with the dialer's ephemeral key, and the dialer's static key
+// with the acceptor's ephemeral key. Only the owners of the static keys derive the same key.
+func (h *handshaker) sessionKey(uuid gouuid.UUID, hello, reply *handshakeMsg, ee, es, se []byte) []byte {
+	return h.mac(h.psk, "kcp-go session", uuid[:], hello.ephemeral, hello.static, reply.ephemeral, reply.static, ee, es, se)
+}
+
+// hello creates the dialer's hello with a fresh ephemeral key
+func (h *handshaker) hello(uuid gouuid.UUID) (msg *handshakeMsg, priv []byte, err error) {
+	priv, pub, err := GenerateHandshakeKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	msg = &handshakeMsg{uuid: uuid, typ: hsHello, ephemeral: pub, static: h.pub}
+	msg.mac = h.mac(h.psk, "kcp-go hello", uuid[:], msg.ephemeral, msg.static)
+	return msg, priv, nil
+}
+
+// finish verifies the acceptor's reply and derives the session key on the dialer side
+func (h *handshaker) finish(hello *handshakeMsg, priv []byte, reply *handshakeMsg) ([]byte, error) {
+	if !h.trusted(reply.static) {
+		return nil, errHandshake
+	}
+	ee, err := curve25519.X25519(priv, reply.ephemeral)
+	if err != nil {
+		return nil, errHandshake
+	}
+	es, err := dh(priv, reply.static)
+	if err != nil {
+		return nil, errHandshake
+	}
+	se, err := dh(h.priv, reply.ephemeral)
+	if err != nil {
+		return nil, errHandshake
+	}
+	key := h.sessionKey(hello.uuid, hello, reply, ee, es, se)
+	if !hmac.Equal(reply.mac, h.mac(key, "kcp-go reply", hello.uuid[:], hello.ephemeral, reply.ephemeral)) {
+		return nil, errHandshake
+	}
+	return key, nil
+}
+
+// accept authenticates a hello on the acceptor side. It returns the reply to send and
+// the session key to install, key is nil when the hello is a retransmission.
+func (h *handshaker) accept(hello *handshakeMsg) (reply []byte, key []byte, expired []gouuid.UUID, err error) {
+	if !hmac.Equal(hello.mac, h.mac(h.psk, "kcp-go hello", hello.uuid[:], hello.ephemeral, hello.static)) {
+		return nil, nil, nil, errHandshake
+	}
+	if !h.trusted(hello.static) {
+		return nil, nil, nil, errHandshake
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	for uuid, acc := range h.accepts {
+		if now.Sub(acc.ts) > DefaultHandshakeTimeout {
+			delete(h.accepts, uuid)
+			expired = append(expired, uuid)
+		}
+	}
+
+	if acc, ok := h.accepts[hello.uuid]; ok {
+		if !bytes.Equal(acc.ephemeral, hello.ephemeral) {
+			return nil, nil, expired, errHandshake
+		}
+		return acc.reply, nil, expired, nil
+	}
+	if len(h.accepts) >= h.backlog {
+		return nil, nil, expired, errHandshake
+	}
+
+	priv, pub, err := GenerateHandshakeKey()
+	if err != nil {
+		return nil, nil, expired, err
+	}
+	ee, err := curve25519.X25519(priv, hello.ephemeral)
+	if err != nil {
+		return nil, nil, expired, errHandshake
+	}
+	es, err := dh(h.priv, hello.ephemeral)
+	if err != nil {
+		return nil, nil, expired, errHandshake
+	}
+	se, err := dh(priv, hello.static)
+	if err != nil {
+		return nil, nil, expired, errHandshake
+	}
+
+	msg := &handshakeMsg{uuid: hello.uuid, typ: hsReply, ephemeral: pub, static: h.pub}
+	key = h.sessionKey(hello.uuid, hello, msg, ee, es, se)
+	msg.mac = h.mac(key, "kcp-go reply", hello.uuid[:], hello.ephemeral, msg.ephemeral)
+	reply = msg.encode()
+
+	h.accepts[hello.uuid] = &handshakeAccept{ephemeral: hello.ephemeral, reply: reply, ts: now}
+	return reply, key, expired, nil
+}
+
+// pending reports whether a hello of uuid was accepted and waits for SYN
+func (h *handshaker) pending(uuid gouuid.UUID) bool {
+	h.mu.Lock()
+	_, ok := h.accepts[uuid]
+	h.mu.Unlock()
+	return ok
+}
+
+// done forgets an accepted handshake once its stream exists
+func (h *handshaker) done(uuid gouuid.UUID) {
+	h.mu.Lock()
+	delete(h.accepts, uuid)
+	h.mu.Unlock()
+}
+
+func (h *handshaker) register(uuid gouuid.UUID) chan *handshakeMsg {
+	ch := make(chan *handshakeMsg, 1)
+	h.mu.Lock()
+	h.dials[uuid] = ch
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *handshaker) unregister(uuid gouuid.UUID) {
+	h.mu.Lock()
+	delete(h.dials, uuid)
+	h.mu.Unlock()
+}
+
+// deliver hands a reply or a retry to the dialer waiting for it
+func (h *handshaker) deliver(reply *handshakeMsg) {
+	h.mu.Lock()
+	ch, ok := h.dials[reply.uuid]
+	h.mu.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case ch <- reply:
+	default:
+	}
+}
+
+// handshake runs the dialer side of the handshake for stream, the hello is retransmitted
+// on every path until a valid reply arrives. A retry from the acceptor is answered at once
+// with the cookie repeated on its path.
+func (t *UDPTransport) handshake(ctx context.Context, stream *UDPStream) error {
+	uuid := stream.GetUUID()
+	Logf(INFO, "UDPTransport::handshake uuid:%v", uuid)
+
+	hello, priv, err := t.hs.hello(uuid)
+	if err != nil {
+		return err
+	}
+	ch := t.hs.register(uuid)
+	defer t.hs.unregister(uuid)
+	// retries are delivered from any path, the channel keeps only one
+	cookies := make(map[string][]byte)
+
+	stream.mu.Lock()
+	tunnels := append([]*UDPTunnel(nil), stream.tunnels...)
+	remotes := append([]*net.UDPAddr(nil), stream.remotes...)
+	stream.mu.Unlock()
+
+	send := func() {
+		for i, tunnel := range tunnels {
+			hello.cookie = cookies[remotes[i].String()]
+			tunnel.outputRaw(hello.encode(), remotes[i])
+		}
+	}
+
+	ticker := time.NewTicker(DefaultHandshakeRetry)
+	defer ticker.Stop()
+
+	send()
+	for {
+		select {
+		case reply := <-ch:
+			if reply.typ == hsRetry {
+				cookies[reply.addr.String()] = reply.cookie
+				send()
+				continue
+			}
+			key, err := t.hs.finish(hello, priv, reply)
+			if err != nil {
+				// forged or stale reply, wait for the real one
+				Logf(WARN, "UDPTransport::handshake bad reply. uuid:%v", uuid)
+				t.snmp.add(func(m *Snmp) *uint64 { return &m.HandshakeErrs }, 1)
+				continue
+			}
+			return t.crypt.setSession(uuid, key)
+		case <-ticker.C:
+			send()
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				t.snmp.add(func(m *Snmp) *uint64 { return &m.DialTimeout }, 1)
+				return errTimeout
+			}
+			return ctx.Err()
+		case <-t.die:
+			return io.ErrClosedPipe
+		}
+	}
+}
+
+// handleHandshake answers hellos, hands replies and retries to the dialing streams,
+// unwraps the packets carrying a cookie and hands path probes to migrating streams
+func (t *UDPTransport) handleHandshake(tunnel *UDPTunnel, data []byte, rAddr net.Addr) {
+	if isCookie(data) {
+		pkt, cookie := unwrapCookie(data)
+		t.handleData(tunnel, pkt, rAddr, cookie)
+		return
+	}
+	if isPathProbe(data) {
+		t.handlePathProbe(tunnel, data, rAddr)
+		return
+	}
+
+	msg, ok := decodeHandshake(data)
+	if !ok || (t.hs == nil && msg.typ != hsRetry) {
+		t.snmp.add(func(m *Snmp) *uint64 { return &m.HandshakeErrs }, 1)
+		return
+	}
+	msg.addr = rAddr
+
+	switch msg.typ {
+	case hsReply:
+		t.hs.deliver(msg)
+	case hsRetry:
+		if t.hs != nil {
+			t.hs.deliver(msg)
+		} else if s, ok := t.streamm.Get(msg.uuid); ok {
+			s.(*UDPStream).retry(rAddr, msg.cookie)
+		}
+	case hsHello:
+		if atomic.LoadInt32(&t.startAccept) == 0 || atomic.LoadInt32(&t.closing) != 0 {
+			return
+		}
+		if _, ok := t.streamm.Get(msg.uuid); ok {
+			return
+		}
+		// retransmitted hellos were admitted already
+		if !t.hs.pending(msg.uuid) && !t.admit(msg.uuid, rAddr, msg.cookie) {
+			return
+		}
+
+		reply, key, expired, err := t.hs.accept(msg)
+		for _, uuid := range expired {
+			if _, ok := t.streamm.Get(uuid); !ok {
+				t.crypt.forget(uuid)
+			}
+		}
+		if err != nil {
+			Logf(WARN, "UDPTransport::handleHandshake rejected. uuid:%v remote:%v err:%v", msg.uuid, rAddr, err)
+			t.snmp.add(func(m *Snmp) *uint64 { return &m.HandshakeErrs }, 1)
+			return
+		}
+		if key != nil {
+			if err = t.crypt.setSession(msg.uuid, key); err != nil {
+				t.hs.done(msg.uuid)
+				return
+			}
+		}
+
+		tunnels := t.sel.Pick([]string{rAddr.String()})
+		if len(tunnels) == 0 {
+			return
+		}
+		tunnels[0].outputRaw(reply, rAddr)
+	default:
+		t.snmp.add(func(m *Snmp) *uint64 { return &m.HandshakeErrs }, 1)
+	}
+}
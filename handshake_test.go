@@ -0,0 +1,112 @@
+package kcp
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gouuid "github.com/satori/go.uuid"
+)
+
+// handshakeOption encrypts with a handshake of hs
+func handshakeOption(hs *HandshakeOption) *TransportOption {
+	return &TransportOption{CryptOption: &CryptOption{Method: CryptAESGCM, Handshake: hs}}
+}
+
+func TestHandshakeStaticKey(t *testing.T) {
+	lAddr, rAddr, badAddr := "127.0.0.1:7191", "127.0.0.1:17191", "127.0.0.1:27191"
+	serverPriv, serverPub, err := GenerateHandshakeKey()
+	checkError(t, err)
+	clientPriv, clientPub, err := GenerateHandshakeKey()
+	checkError(t, err)
+	badPriv, _, err := GenerateHandshakeKey()
+	checkError(t, err)
+
+	client, server := newTransportPair(t, []string{lAddr}, []string{rAddr},
+		handshakeOption(&HandshakeOption{PrivateKey: clientPriv, PeerKeys: [][]byte{serverPub}}),
+		handshakeOption(&HandshakeOption{PrivateKey: serverPriv, PeerKeys: [][]byte{clientPub}}))
+	defer server.Close()
+	defer client.Close()
+	acceptEcho(server)
+	stream, err := client.Open([]string{lAddr}, []string{rAddr})
+	checkError(t, err)
+	defer stream.Close()
+	checkError(t, echoTester(stream, 4096, 16))
+
+	// without a psk a hello from an unverified source only gets a retry, even for a trusted key
+	conn, err := net.ListenPacket("udp", badAddr)
+	checkError(t, err)
+	dst, _ := net.ResolveUDPAddr("udp", rAddr)
+	uuid, _ := gouuid.NewV1()
+	hello, _, err := client.hs.hello(uuid)
+	checkError(t, err)
+	_, err = conn.WriteTo(hello.encode(), dst)
+	checkError(t, err)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, mtuLimit)
+	n, _, err := conn.ReadFrom(buf)
+	conn.Close()
+	checkError(t, err)
+	if msg, ok := decodeHandshake(buf[:n]); !ok || msg.typ != hsRetry || msg.uuid != uuid {
+		t.Fatal("retry expected")
+	}
+	if server.hs.pending(uuid) {
+		t.Fatal("handshake slot taken without cookie")
+	}
+
+	// unknown static key is rejected on hello, no stream state on the server
+	bad := newTestTransport(t, []string{badAddr}, nil, handshakeOption(&HandshakeOption{PrivateKey: badPriv, PeerKeys: [][]byte{serverPub}}))
+	defer bad.Close()
+
+	hsErrs := atomic.LoadUint64(&DefaultSnmp.HandshakeErrs)
+	if _, err = bad.OpenTimeout([]string{badAddr}, []string{rAddr}, time.Millisecond*300); err == nil {
+		t.Fatal("untrusted peer opened a stream")
+	}
+	if atomic.LoadUint64(&DefaultSnmp.HandshakeErrs) == hsErrs {
+		t.Fatal("HandshakeErrs not counted")
+	}
+	if n := len(server.streams()); n != 1 {
+		t.Fatalf("server allocated streams for untrusted peer. streams:%v", n)
+	}
+	server.hs.mu.Lock()
+	accepts := len(server.hs.accepts)
+	server.hs.mu.Unlock()
+	if accepts != 0 {
+		t.Fatalf("server kept handshakes for untrusted peer. accepts:%v", accepts)
+	}
+}
+
+func TestHandshakePSK(t *testing.T) {
+	lAddr, rAddr, badAddr := "127.0.0.1:7201", "127.0.0.1:17201", "127.0.0.1:27201"
+	psk := []byte("kcp-go handshake test psk")
+
+	client, server := newTransportPair(t, []string{lAddr}, []string{rAddr}, handshakeOption(&HandshakeOption{PSK: psk}), handshakeOption(&HandshakeOption{PSK: psk}))
+	defer server.Close()
+	defer client.Close()
+	acceptEcho(server)
+	stream, err := client.Open([]string{lAddr}, []string{rAddr})
+	checkError(t, err)
+	defer stream.Close()
+	checkError(t, echoTester(stream, 1024, 16))
+
+	// session keys differ between streams
+	stream2, err := client.Open([]string{lAddr}, []string{rAddr})
+	checkError(t, err)
+	defer stream2.Close()
+	client.crypt.mu.Lock()
+	k1, k2 := client.crypt.sessions[stream.GetUUID()], client.crypt.sessions[stream2.GetUUID()]
+	client.crypt.mu.Unlock()
+	if k1 == nil || k2 == nil || k1 == k2 {
+		t.Fatal("session keys not installed per stream")
+	}
+
+	bad := newTestTransport(t, []string{badAddr}, nil, handshakeOption(&HandshakeOption{PSK: []byte("wrong")}))
+	defer bad.Close()
+	if _, err = bad.OpenTimeout([]string{badAddr}, []string{rAddr}, time.Millisecond*300); err == nil {
+		t.Fatal("wrong psk opened a stream")
+	}
+	if n := len(server.streams()); n != 2 {
+		t.Fatalf("server allocated streams for wrong psk. streams:%v", n)
+	}
+}
@@ -0,0 +1,279 @@
+package kcp
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	DefaultPathProbeInterval = time.Duration(0) // every path of a stream is pinged this often, 0 disables probing
+	DefaultPathProbeTimeout  = time.Second * 2  // a ping not answered within this is lost
+	DefaultAckRTTInterval    = time.Second      // the ack rtt of a path is sampled at most this often for the rtt histogram and a PathObserver
+)
+
+const maxPendingPings = 8
+
+// PathStats is the health of one path of a stream, measured by pings sent on it
+type PathStats struct {
+	Local    net.Addr
+	Remote   net.Addr
+	RTT      time.Duration // smoothed round trip time, 0 until a ping is answered
+	Jitter   time.Duration // smoothed variation between consecutive round trips
+	Loss     float64       // smoothed fraction of pings lost
+	Sent     uint64        // pings sent
+	Received uint64        // pongs received
+	Lost     uint64        // pings not answered in time
+}
+
+// TunnelStats is the health of a tunnel, aggregating the pings of all streams sent from it
+type TunnelStats struct {
+	Local    net.Addr
+	RTT      time.Duration
+	Jitter   time.Duration
+	Loss     float64
+	Sent     uint64
+	Received uint64
+	Lost     uint64
+}
+
+type pathPing struct {
+	token []byte
+	sent  time.Time
+}
+
+// pathHealth keeps the estimators of a path or a tunnel
+type pathHealth struct {
+	srtt    time.Duration
+	jitter  time.Duration
+	lastRTT time.Duration
+	loss    float64
+	sent    uint64
+	recvd   uint64
+	lost    uint64
+	pings   []pathPing // waiting for pongs, oldest first
+}
+
+// ack takes a round trip, rtt is smoothed by 1/8 and jitter by 1/16 as RFC 3550 does
+func (h *pathHealth) ack(rtt time.Duration) {
+	h.recvd++
+	if h.recvd == 1 {
+		h.srtt = rtt
+	} else {
+		h.srtt += (rtt - h.srtt) / 8
+		d := rtt - h.lastRTT
+		if d < 0 {
+			d = -d
+		}
+		h.jitter += (d - h.jitter) / 16
+	}
+	h.lastRTT = rtt
+	h.loss -= h.loss / 8
+}
+
+func (h *pathHealth) miss() {
+	h.lost++
+	h.loss += (1 - h.loss) / 8
+}
+
+// expire counts the pings sent before deadline as lost
+func (h *pathHealth) expire(deadline time.Time) (lost int) {
+	for len(h.pings) > 0 && h.pings[0].sent.Before(deadline) {
+		h.pings = h.pings[1:]
+		h.miss()
+		lost++
+	}
+	return lost
+}
+
+// match returns the round trip of the ping answered by token
+func (h *pathHealth) match(token []byte, now time.Time) (time.Duration, bool) {
+	for k, p := range h.pings {
+		if subtle.ConstantTimeCompare(p.token, token) == 1 {
+			h.pings = append(h.pings[:k:k], h.pings[k+1:]...)
+			return now.Sub(p.sent), true
+		}
+	}
+	return 0, false
+}
+
+// tunnelHealth aggregates the pings of all streams on a tunnel
+type tunnelHealth struct {
+	mu sync.Mutex
+	pathHealth
+}
+
+func (th *tunnelHealth) ping() {
+	th.mu.Lock()
+	th.sent++
+	th.mu.Unlock()
+}
+
+func (th *tunnelHealth) pong(rtt time.Duration) {
+	th.mu.Lock()
+	th.ack(rtt)
+	th.mu.Unlock()
+}
+
+func (th *tunnelHealth) lose(n int) {
+	th.mu.Lock()
+	for i := 0; i < n; i++ {
+		th.miss()
+	}
+	th.mu.Unlock()
+}
+
+// Stats returns the health of the tunnel measured by the pings of all streams using it
+func (t *UDPTunnel) Stats() TunnelStats {
+	t.health.mu.Lock()
+	defer t.health.mu.Unlock()
+	h := &t.health.pathHealth
+	return TunnelStats{
+		Local:    t.LocalAddr(),
+		RTT:      h.srtt,
+		Jitter:   h.jitter,
+		Loss:     h.loss,
+		Sent:     h.sent,
+		Received: h.recvd,
+		Lost:     h.lost,
+	}
+}
+
+// TunnelStats returns the health of every tunnel of the transport
+func (t *UDPTransport) TunnelStats() []TunnelStats {
+	t.tunnelMu.Lock()
+	defer t.tunnelMu.Unlock()
+	stats := make([]TunnelStats, 0, len(t.tunnelHostM))
+	for _, tunnel := range t.tunnelHostM {
+		stats = append(stats, tunnel.Stats())
+	}
+	return stats
+}
+
+// PathStats returns the health of every path of the stream, in the order of RemoteAddrs
+func (s *UDPStream) PathStats() []PathStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make([]PathStats, len(s.health))
+	for i, h := range s.health {
+		stats[i] = PathStats{
+			Local:    s.locals[i],
+			Remote:   s.remotes[i],
+			RTT:      h.srtt,
+			Jitter:   h.jitter,
+			Loss:     h.loss,
+			Sent:     h.sent,
+			Received: h.recvd,
+			Lost:     h.lost,
+		}
+	}
+	return stats
+}
+
+// SetPathProbeInterval pings every path this often while the stream is established and the
+// peer advertised CapPathProbe, 0 disables probing
+func (s *UDPStream) SetPathProbeInterval(interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.probeInterval = interval
+	s.probeGen++
+	if interval > 0 {
+		gen := s.probeGen
+		SystemTimedSched.Put(func() { s.probePaths(gen) }, time.Now().Add(interval))
+	}
+}
+
+// probePaths counts the pings not answered in time and pings every path again,
+// it runs on SystemTimedSched until the stream is closed or the interval changed
+func (s *UDPStream) probePaths(gen uint32) {
+	select {
+	case <-s.chClose:
+		return
+	case <-s.chRst:
+		return
+	default:
+	}
+
+	s.mu.Lock()
+	interval := s.probeInterval
+	if gen != s.probeGen {
+		s.mu.Unlock()
+		return
+	}
+	pinged := false
+	observer, _ := s.sel.(PathObserver)
+	// a peer without CapPathProbe would drop the pings
+	if s.state >= StateEstablish && s.state != StateClosed && s.peerCaps&CapPathProbe != 0 {
+		now := time.Now()
+		for i, h := range s.health {
+			if lost := h.expire(now.Add(-DefaultPathProbeTimeout)); lost > 0 {
+				s.tunnels[i].health.lose(lost)
+				for k := 0; observer != nil && k < lost; k++ {
+					observer.ObservePath(s.tunnels[i], s.remotes[i], 0, true)
+				}
+			}
+			if len(h.pings) >= maxPendingPings {
+				continue
+			}
+			token := make([]byte, pathTokenSize)
+			if _, err := rand.Read(token[4:]); err != nil {
+				continue
+			}
+			binary.LittleEndian.PutUint32(token, s.pathIDs[i])
+			h.pings = append(h.pings, pathPing{token: token, sent: now})
+			h.sent++
+			s.tunnels[i].health.ping()
+			s.queueRaw(i, s.remotes[i], pathProbe(s.uuid, hsPing, token, s.cryptOverhead))
+			pinged = true
+		}
+	}
+	s.mu.Unlock()
+
+	if pinged {
+		s.notifyFlushEvent(true)
+	}
+	SystemTimedSched.Put(func() { s.probePaths(gen) }, time.Now().Add(interval))
+}
+
+// recvPong takes the answer to a ping sent on the path of tunnel to rAddr
+func (s *UDPStream) recvPong(tunnel *UDPTunnel, rAddr net.Addr, token []byte) {
+	addr, ok := rAddr.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, h := range s.health {
+		if s.tunnels[i] != tunnel || !sameUDPAddr(s.remotes[i], addr) {
+			continue
+		}
+		if rtt, ok := h.match(token, now); ok {
+			h.ack(rtt)
+			tunnel.health.pong(rtt)
+			s.rttHist.observe(rtt)
+			s.pathRecv[i] = now
+			if observer, ok := s.sel.(PathObserver); ok {
+				observer.ObservePath(tunnel, s.remotes[i], rtt, false)
+			}
+			return
+		}
+	}
+}
+
+// observeAckRTT samples the rtt KCP measured for an ack received on path i into the rtt
+// histogram and the PathObserver of the selector, so both learn without probing. s.mu must be held.
+func (s *UDPStream) observeAckRTT(i int, rtt time.Duration) {
+	now := time.Now()
+	if now.Sub(s.traffic[i].ackRTT) < DefaultAckRTTInterval {
+		return
+	}
+	s.traffic[i].ackRTT = now
+	s.rttHist.observe(rtt)
+	if observer, ok := s.sel.(PathObserver); ok {
+		observer.ObservePath(s.tunnels[i], s.remotes[i], rtt, false)
+	}
+}
@@ -0,0 +1,111 @@
+package kcp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestPathHealth(t *testing.T) {
+	h := &pathHealth{}
+	h.ack(time.Millisecond * 80)
+	if h.srtt != time.Millisecond*80 || h.jitter != 0 {
+		t.Fatalf("first sample. srtt:%v jitter:%v", h.srtt, h.jitter)
+	}
+	h.ack(time.Millisecond * 160)
+	if h.srtt != time.Millisecond*90 || h.jitter != time.Millisecond*5 {
+		t.Fatalf("second sample. srtt:%v jitter:%v", h.srtt, h.jitter)
+	}
+
+	now := time.Now()
+	old := bytes.Repeat([]byte{1}, pathTokenSize)
+	recent := bytes.Repeat([]byte{2}, pathTokenSize)
+	h.pings = []pathPing{{old, now.Add(-time.Second * 3)}, {recent, now}}
+	if lost := h.expire(now.Add(-DefaultPathProbeTimeout)); lost != 1 || h.lost != 1 || h.loss != 0.125 {
+		t.Fatalf("expire. lost:%v total:%v loss:%v", lost, h.lost, h.loss)
+	}
+	if _, ok := h.match(old, now); ok {
+		t.Fatal("expired ping matched")
+	}
+	if rtt, ok := h.match(recent, now.Add(time.Millisecond*50)); !ok || rtt != time.Millisecond*50 || len(h.pings) != 0 {
+		t.Fatalf("match. rtt:%v ok:%v pings:%v", rtt, ok, len(h.pings))
+	}
+}
+
+func TestPathStats(t *testing.T) {
+	lAddrs := []string{"127.0.0.1:7351", "127.0.0.1:27351"}
+	rAddrs := []string{"127.0.0.1:17351", "127.0.0.1:37351"}
+	client, server := newTransportPair(t, lAddrs, rAddrs, nil, nil)
+	dialer, _ := openPair(t, client, server, lAddrs, rAddrs, 2, true)
+	defer client.Close()
+	defer server.Close()
+	defer dialer.Close()
+
+	interval := time.Millisecond * 50
+	dialer.SetPathProbeInterval(interval)
+	time.Sleep(interval * 6)
+	stats := dialer.PathStats()
+	if len(stats) != 2 {
+		t.Fatalf("path stats. len:%v", len(stats))
+	}
+	for i, st := range stats {
+		if st.Local.String() != lAddrs[i] || st.Remote.String() != rAddrs[i] {
+			t.Fatalf("path addrs. local:%v remote:%v", st.Local, st.Remote)
+		}
+		if st.Sent == 0 || st.Received == 0 || st.RTT <= 0 || st.Lost != 0 {
+			t.Fatalf("path health. path:%v stats:%+v", i, st)
+		}
+	}
+
+	tunnels := client.TunnelStats()
+	if len(tunnels) != 2 {
+		t.Fatalf("tunnel stats. len:%v", len(tunnels))
+	}
+	for _, st := range tunnels {
+		if st.Received == 0 || st.RTT <= 0 {
+			t.Fatalf("tunnel health. stats:%+v", st)
+		}
+	}
+
+	// the peer stops answering on the second path
+	server.sel.Pick(lAddrs[1:])[0].Close()
+	deadline := time.Now().Add(DefaultPathProbeTimeout + time.Second)
+	for dialer.PathStats()[1].Lost == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("loss not detected. stats:%+v", dialer.PathStats()[1])
+		}
+		time.Sleep(interval)
+	}
+	if st := dialer.PathStats()[0]; st.Lost != 0 {
+		t.Fatalf("healthy path lost pings. stats:%+v", st)
+	}
+}
+
+func TestPathProbeCapability(t *testing.T) {
+	lAddrs := []string{"127.0.0.1:7441", "127.0.0.1:27441"}
+	rAddrs := []string{"127.0.0.1:17441", "127.0.0.1:37441"}
+	client, server := newTransportPair(t, lAddrs, rAddrs, nil, nil)
+	dialer, _ := openPair(t, client, server, lAddrs, rAddrs, 2, true)
+	defer client.Close()
+	defer server.Close()
+	defer dialer.Close()
+
+	// an older peer does not answer pings, it is never sent any
+	dialer.mu.Lock()
+	dialer.peerCaps &^= CapPathProbe
+	dialer.mu.Unlock()
+	interval := time.Millisecond * 20
+	dialer.SetPathProbeInterval(interval)
+	time.Sleep(interval * 5)
+	if st := dialer.PathStats()[0]; st.Sent != 0 {
+		t.Fatalf("pinged without capability. stats:%+v", st)
+	}
+
+	dialer.mu.Lock()
+	dialer.peerCaps |= CapPathProbe
+	dialer.mu.Unlock()
+	time.Sleep(interval * 5)
+	if st := dialer.PathStats()[0]; st.Sent == 0 || st.Received == 0 {
+		t.Fatalf("not pinged. stats:%+v", st)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/binary"
 	"math"
 	"sync"
-	"sync/atomic"
 	"time"
 )
 
@@ -132,6 +131,7 @@ type segment struct {
 	resendts uint32
 	fastack  uint32
 	acked    uint32 // mark if the seg has acked
+	path     int8   // path of the last transmit, set by stripe, -1 once that path is removed
 	data     []byte
 }
 
@@ -145,7 +145,6 @@ func (seg *segment) encode(ptr []byte) []byte {
 	ptr = ikcp_encode32u(ptr, seg.sn)
 	ptr = ikcp_encode32u(ptr, seg.una)
 	ptr = ikcp_encode32u(ptr, uint32(len(seg.data)))
-	atomic.AddUint64(&DefaultSnmp.OutSegs, 1)
 	return ptr
 }
 
@@ -154,13 +153,13 @@ type KCP struct {
 	conv, mtu, mss, state                  uint32
 	snd_una, snd_nxt, rcv_nxt              uint32
 	ssthresh                               uint32
-	rx_rttvar, rx_srtt                     int32
+	rx_rttvar, rx_srtt, rx_minrtt          int32
 	rx_rto, rx_minrto                      uint32
 	snd_wnd, rcv_wnd, rmt_wnd, cwnd, probe uint32
 	interval, ts_flush                     uint32
 	nodelay, updated                       uint32
 	ts_probe, probe_wait                   uint32
-	dead_link, incr                        uint32
+	dead_link                              uint32
 
 	fastresend     int32
 	nocwnd, stream int32
@@ -176,6 +175,32 @@ type KCP struct {
 	buffer   []byte
 	reserved int
 	output   output_callback
+	cc       CongestionController
+	ccst     CongestionState
+
+	// stripe picks the path of each data segment sent, a packet carries the segments of
+	// one path which output reads from outPath. -1 means any path, nil disables striping.
+	stripe  func(seg *segment) int
+	outPath int
+
+	ackRTT int32 // rtt sampled by the last regular Input, -1 if it acknowledged nothing
+
+	stats kcpStats
+	snmp  *Snmp // counters of the owner, DefaultSnmp unless set
+}
+
+// kcpStats are the totals of one connection, snmp adds up those of all connections
+type kcpStats struct {
+	inSegs           uint64
+	outSegs          uint64
+	xmitSegs         uint64 // data segments transmitted, retransmissions included
+	fastRetransSegs  uint64
+	earlyRetransSegs uint64
+	lostSegs         uint64 // retransmitted on timeout
+}
+
+func (st *kcpStats) retransSegs() uint64 {
+	return st.fastRetransSegs + st.earlyRetransSegs + st.lostSegs
 }
 
 type ackItem struct {
@@ -202,16 +227,61 @@ func NewKCP(conv uint32, output output_callback) *KCP {
 	kcp.mtu = IKCP_MTU_DEF
 	kcp.mss = kcp.mtu - IKCP_OVERHEAD
 	kcp.buffer = make([]byte, kcp.mtu)
+	kcp.snmp = DefaultSnmp
 	kcp.rx_rto = IKCP_RTO_DEF
 	kcp.rx_minrto = IKCP_RTO_MIN
 	kcp.interval = IKCP_INTERVAL
 	kcp.ts_flush = IKCP_INTERVAL
-	kcp.ssthresh = IKCP_THRESH_INIT
 	kcp.dead_link = IKCP_DEADLINK
 	kcp.output = output
+	kcp.SetCongestionController(NewRenoController())
 	return kcp
 }
 
+// SetCongestionController replaces the congestion controller, nil restores the default one
+func (kcp *KCP) SetCongestionController(cc CongestionController) {
+	if cc == nil {
+		cc = NewRenoController()
+	}
+	kcp.cc = cc
+	kcp.cwnd = cc.Cwnd()
+	kcp.ssthresh = cc.Ssthresh()
+}
+
+// congestionState snapshots the connection for the congestion controller
+func (kcp *KCP) congestionState(current, wnd uint32) *CongestionState {
+	resent := uint32(kcp.fastresend)
+	if kcp.fastresend <= 0 {
+		resent = 0xffffffff
+	}
+	kcp.ccst = CongestionState{
+		Current:  current,
+		Mss:      kcp.mss,
+		Inflight: kcp.snd_nxt - kcp.snd_una,
+		Wnd:      wnd,
+		RmtWnd:   kcp.rmt_wnd,
+		Resent:   resent,
+		Srtt:     kcp.rx_srtt,
+		MinRtt:   kcp.rx_minrtt,
+	}
+	return &kcp.ccst
+}
+
+// syncCongestion copies the decision of the congestion controller
+func (kcp *KCP) syncCongestion() {
+	kcp.cwnd = kcp.cc.Cwnd()
+	kcp.ssthresh = kcp.cc.Ssthresh()
+}
+
+// PacingRate returns the sending rate in bytes per second suggested by the congestion controller,
+// or derived from the send window if congestion control is disabled
+func (kcp *KCP) PacingRate() uint64 {
+	if kcp.nocwnd != 0 {
+		return pacingRate(kcp.calc_cwnd(), kcp.mss, kcp.rx_minrtt)
+	}
+	return kcp.cc.PacingRate()
+}
+
 // newSegment creates a KCP segment
 func (kcp *KCP) newSegment(size int) (seg segment) {
 	seg.data = xmitBuf.Get().([]byte)[:size]
@@ -399,6 +469,9 @@ func (kcp *KCP) Send(buffer []byte) int {
 func (kcp *KCP) update_ack(rtt int32) {
 	// https://tools.ietf.org/html/rfc6298
 	var rto uint32
+	if kcp.rx_minrtt == 0 || rtt < kcp.rx_minrtt {
+		kcp.rx_minrtt = rtt
+	}
 	if kcp.rx_srtt == 0 {
 		kcp.rx_srtt = rtt
 		kcp.rx_rttvar = rtt >> 1
@@ -419,6 +492,9 @@ func (kcp *KCP) update_ack(rtt int32) {
 	}
 	rto = uint32(kcp.rx_srtt) + _imax_(kcp.interval, uint32(kcp.rx_rttvar)<<2)
 	kcp.rx_rto = _ibound_(kcp.rx_minrto, rto, IKCP_RTO_MAX)
+
+	kcp.cc.OnRTT(kcp.congestionState(currentMs(), kcp.calc_cwnd()), rtt)
+	kcp.syncCongestion()
 }
 
 func (kcp *KCP) shrink_buf() {
@@ -613,6 +689,9 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 	var latest uint32 // the latest ack packet
 	var flag int
 	var inSegs uint64
+	if regular {
+		kcp.ackRTT = -1
+	}
 
 	for {
 		var ts, sn, length, una, conv uint32
@@ -674,7 +753,7 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 				}
 			}
 			if regular && repeat {
-				atomic.AddUint64(&DefaultSnmp.RepeatSegs, 1)
+				kcp.snmp.add(func(m *Snmp) *uint64 { return &m.RepeatSegs }, 1)
 			}
 		} else if cmd == IKCP_CMD_WASK {
 			// ready to send back IKCP_CMD_WINS in Ikcp_flush
@@ -689,43 +768,24 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 		inSegs++
 		data = data[length:]
 	}
-	atomic.AddUint64(&DefaultSnmp.InSegs, inSegs)
+	kcp.snmp.add(func(m *Snmp) *uint64 { return &m.InSegs }, inSegs)
+	kcp.stats.inSegs += inSegs
 
 	// update rtt with the latest ts
 	// ignore the FEC packet
 	if flag != 0 && regular {
 		current := currentMs()
-		if _itimediff(current, latest) >= 0 {
-			kcp.update_ack(_itimediff(current, latest))
+		if rtt := _itimediff(current, latest); rtt >= 0 {
+			kcp.update_ack(rtt)
+			kcp.ackRTT = rtt
 		}
 	}
 
 	// cwnd update when packet arrived
 	if kcp.nocwnd == 0 {
-		if _itimediff(kcp.snd_una, snd_una) > 0 {
-			if kcp.cwnd < kcp.rmt_wnd {
-				mss := kcp.mss
-				if kcp.cwnd < kcp.ssthresh {
-					kcp.cwnd++
-					kcp.incr += mss
-				} else {
-					if kcp.incr < mss {
-						kcp.incr = mss
-					}
-					kcp.incr += (mss*mss)/kcp.incr + (mss / 16)
-					if (kcp.cwnd+1)*mss <= kcp.incr {
-						if mss > 0 {
-							kcp.cwnd = (kcp.incr + mss - 1) / mss
-						} else {
-							kcp.cwnd = kcp.incr + mss - 1
-						}
-					}
-				}
-				if kcp.cwnd > kcp.rmt_wnd {
-					kcp.cwnd = kcp.rmt_wnd
-					kcp.incr = kcp.rmt_wnd * mss
-				}
-			}
+		if acked := kcp.snd_una - snd_una; _itimediff(kcp.snd_una, snd_una) > 0 {
+			kcp.cc.OnAck(kcp.congestionState(currentMs(), kcp.calc_cwnd()), acked)
+			kcp.syncCongestion()
 		}
 	}
 
@@ -762,6 +822,13 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 	var ptr []byte
 
 	var xmitMax uint32
+	kcp.outPath = -1
+	outSegs := kcp.stats.outSegs
+	defer func() {
+		if n := kcp.stats.outSegs - outSegs; n > 0 {
+			kcp.snmp.add(func(m *Snmp) *uint64 { return &m.OutSegs }, n)
+		}
+	}()
 
 	makeBuffer := func() {
 		buffer = xmitBuf.Get().([]byte)[:kcp.mtu]
@@ -790,6 +857,16 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 		}
 	}
 
+	// makePathSpace makes room for writing to path, a packet of another path is flushed
+	makePathSpace := func(space int, path int) {
+		if kcp.outPath >= 0 && path != kcp.outPath {
+			flushBuffer()
+			makeBuffer()
+		}
+		makeSpace(space)
+		kcp.outPath = path
+	}
+
 	// flush acknowledges
 	for i, ack := range kcp.acklist {
 		makeSpace(IKCP_OVERHEAD)
@@ -797,6 +874,7 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 		if _itimediff(ack.sn, kcp.rcv_nxt) >= 0 || len(kcp.acklist)-1 == i {
 			seg.sn, seg.ts = ack.sn, ack.ts
 			ptr = seg.encode(ptr)
+			kcp.stats.outSegs++
 			xmit := kcp.incre_ackxmit(seg.sn)
 			if xmit > xmitMax {
 				xmitMax = xmit
@@ -839,6 +917,7 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 		seg.cmd = IKCP_CMD_WASK
 		makeSpace(IKCP_OVERHEAD)
 		ptr = seg.encode(ptr)
+		kcp.stats.outSegs++
 	}
 
 	// flush window probing commands
@@ -846,6 +925,7 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 		seg.cmd = IKCP_CMD_WINS
 		makeSpace(IKCP_OVERHEAD)
 		ptr = seg.encode(ptr)
+		kcp.stats.outSegs++
 	}
 
 	kcp.probe = 0
@@ -924,13 +1004,21 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 		if needsend {
 			current = currentMs()
 			segment.xmit++
+			kcp.stats.xmitSegs++
 			segment.ts = current
 			segment.wnd = seg.wnd
 			segment.una = seg.una
 
 			need := IKCP_OVERHEAD + len(segment.data)
-			makeSpace(need)
+			if kcp.stripe != nil {
+				path := kcp.stripe(segment)
+				segment.path = int8(path)
+				makePathSpace(need, path)
+			} else {
+				makeSpace(need)
+			}
 			ptr = segment.encode(ptr)
+			kcp.stats.outSegs++
 			copy(ptr, segment.data)
 			ptr = ptr[len(segment.data):]
 
@@ -954,48 +1042,31 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 	// counter updates
 	sum := lostSegs
 	if lostSegs > 0 {
-		atomic.AddUint64(&DefaultSnmp.LostSegs, lostSegs)
+		kcp.snmp.add(func(m *Snmp) *uint64 { return &m.LostSegs }, lostSegs)
 	}
 	if fastRetransSegs > 0 {
-		atomic.AddUint64(&DefaultSnmp.FastRetransSegs, fastRetransSegs)
+		kcp.snmp.add(func(m *Snmp) *uint64 { return &m.FastRetransSegs }, fastRetransSegs)
 		sum += fastRetransSegs
 	}
 	if earlyRetransSegs > 0 {
-		atomic.AddUint64(&DefaultSnmp.EarlyRetransSegs, earlyRetransSegs)
+		kcp.snmp.add(func(m *Snmp) *uint64 { return &m.EarlyRetransSegs }, earlyRetransSegs)
 		sum += earlyRetransSegs
 	}
 	if sum > 0 {
-		atomic.AddUint64(&DefaultSnmp.RetransSegs, sum)
+		kcp.snmp.add(func(m *Snmp) *uint64 { return &m.RetransSegs }, sum)
 	}
+	kcp.stats.fastRetransSegs += fastRetransSegs
+	kcp.stats.earlyRetransSegs += earlyRetransSegs
+	kcp.stats.lostSegs += lostSegs
 
 	// cwnd update
 	if kcp.nocwnd == 0 {
-		// update ssthresh
-		// rate halving, https://tools.ietf.org/html/rfc6937
-		if change > 0 {
-			inflight := kcp.snd_nxt - kcp.snd_una
-			kcp.ssthresh = inflight / 2
-			if kcp.ssthresh < IKCP_THRESH_MIN {
-				kcp.ssthresh = IKCP_THRESH_MIN
-			}
-			kcp.cwnd = kcp.ssthresh + resent
-			kcp.incr = kcp.cwnd * kcp.mss
-		}
-
-		// congestion control, https://tools.ietf.org/html/rfc5681
-		if lostSegs > 0 {
-			kcp.ssthresh = cwnd / 2
-			if kcp.ssthresh < IKCP_THRESH_MIN {
-				kcp.ssthresh = IKCP_THRESH_MIN
-			}
-			kcp.cwnd = 1
-			kcp.incr = kcp.mss
-		}
-
-		if kcp.cwnd < 1 {
-			kcp.cwnd = 1
-			kcp.incr = kcp.mss
+		st := kcp.congestionState(current, cwnd)
+		if change > 0 || lostSegs > 0 {
+			kcp.cc.OnLoss(st, change, lostSegs)
 		}
+		kcp.cc.OnFlush(st)
+		kcp.syncCongestion()
 	}
 
 	if kcp.rmt_wnd != 0 && kcp.WaitSnd() == 0 {
@@ -2,6 +2,7 @@ package kcp
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"fmt"
 	"io"
@@ -38,6 +39,15 @@ func (sel *TestSelector) Add(tunnel *UDPTunnel) {
 	sel.tunnels = append(sel.tunnels, tunnel)
 }
 
+func (sel *TestSelector) Remove(tunnel *UDPTunnel) {
+	for i, t := range sel.tunnels {
+		if t == tunnel {
+			sel.tunnels = append(sel.tunnels[:i], sel.tunnels[i+1:]...)
+			return
+		}
+	}
+}
+
 func (sel *TestSelector) PickAddrs(count int) (locals, remotes []string) {
 	return sel.locals[:count], sel.remotes[:count]
 }
@@ -702,8 +712,8 @@ func TestSNMP(t *testing.T) {
 	Logf(INFO, "DefaultSnmp.ToSlice:%v", DefaultSnmp.ToSlice())
 	Logf(INFO, "DefaultSnmp.ToSlice:%v", DefaultSnmp.ToSlice())
 
-	currEstab := DefaultSnmp.CurrEstab
-	Logf(INFO, "start establish:%v", DefaultSnmp.CurrEstab)
+	currEstab := DefaultSnmp.Copy().CurrEstab
+	Logf(INFO, "start establish:%v", DefaultSnmp.Copy().CurrEstab)
 
 	locals := []string{"127.0.0.1:10001"}
 	remotes := []string{"127.0.0.1:10002"}
@@ -712,8 +722,8 @@ func TestSNMP(t *testing.T) {
 		t.Fatalf("test snmp failed")
 	}
 
-	Logf(INFO, "open invalid establish:%v", DefaultSnmp.CurrEstab)
-	if currEstab != DefaultSnmp.CurrEstab {
+	Logf(INFO, "open invalid establish:%v", DefaultSnmp.Copy().CurrEstab)
+	if currEstab != DefaultSnmp.Copy().CurrEstab {
 		t.Fatalf("test snmp failed")
 	}
 
@@ -724,16 +734,16 @@ func TestSNMP(t *testing.T) {
 		t.Fatalf("test snmp failed")
 	}
 
-	Logf(INFO, "connect establish:%v", DefaultSnmp.CurrEstab)
-	if currEstab+2 != DefaultSnmp.CurrEstab {
+	Logf(INFO, "connect establish:%v", DefaultSnmp.Copy().CurrEstab)
+	if currEstab+2 != DefaultSnmp.Copy().CurrEstab {
 		t.Fatalf("test snmp failed")
 	}
 
 	stream.Close()
 	time.Sleep(time.Millisecond * 500)
 
-	Logf(INFO, "after close establish:%v", DefaultSnmp.CurrEstab)
-	if currEstab != DefaultSnmp.CurrEstab {
+	Logf(INFO, "after close establish:%v", DefaultSnmp.Copy().CurrEstab)
+	if currEstab != DefaultSnmp.Copy().CurrEstab {
 		t.Fatalf("test snmp failed")
 	}
 }
@@ -781,6 +791,243 @@ func TestAcceptBackuplog(t *testing.T) {
 	wg.Wait()
 }
 
+// routeSelector picks the tunnel bound to the local address routed to each remote, the first one by default
+type routeSelector struct {
+	mu      sync.Mutex
+	tunnels []*UDPTunnel
+	routes  map[string]string
+}
+
+func (sel *routeSelector) Add(tunnel *UDPTunnel) {
+	sel.mu.Lock()
+	defer sel.mu.Unlock()
+	sel.tunnels = append(sel.tunnels, tunnel)
+}
+
+func (sel *routeSelector) Remove(tunnel *UDPTunnel) {
+	sel.mu.Lock()
+	defer sel.mu.Unlock()
+	for i, t := range sel.tunnels {
+		if t == tunnel {
+			sel.tunnels = append(sel.tunnels[:i], sel.tunnels[i+1:]...)
+			return
+		}
+	}
+}
+
+func (sel *routeSelector) Pick(remotes []string) (tunnels []*UDPTunnel) {
+	sel.mu.Lock()
+	defer sel.mu.Unlock()
+	for _, remote := range remotes {
+		picked := sel.tunnels[0]
+		for _, t := range sel.tunnels {
+			if t.LocalAddr().String() == sel.routes[remote] {
+				picked = t
+			}
+		}
+		tunnels = append(tunnels, picked)
+	}
+	return tunnels
+}
+
+// selectorTunnels creates tunnels without sockets, only their addresses and queues are used
+func selectorTunnels(n int) []*UDPTunnel {
+	tunnels := make([]*UDPTunnel, n)
+	for i := range tunnels {
+		tunnels[i] = &UDPTunnel{
+			addr:  &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000 + i},
+			msgsm: make(map[string]*MsgQueue),
+		}
+	}
+	return tunnels
+}
+
+// newTestTransport creates a transport with a tunnel on every address of locals,
+// routes maps a remote to the local address of its tunnel
+func newTestTransport(t *testing.T, locals []string, routes map[string]string, opt *TransportOption) *UDPTransport {
+	transport, err := NewUDPTransport(&routeSelector{routes: routes}, opt)
+	checkError(t, err)
+	for _, local := range locals {
+		if _, err = transport.NewTunnel(local); err != nil {
+			transport.Close()
+			t.Fatal(err)
+		}
+	}
+	return transport
+}
+
+// newTransportPair creates a client with tunnels on lAddrs and a server with tunnels on rAddrs,
+// lAddrs[i] and rAddrs[i] reach each other. Nothing is accepted on the server.
+func newTransportPair(t *testing.T, lAddrs, rAddrs []string, clientOpt, serverOpt *TransportOption) (client, server *UDPTransport) {
+	clientRoutes := make(map[string]string)
+	serverRoutes := make(map[string]string)
+	for i := 0; i < len(lAddrs) && i < len(rAddrs); i++ {
+		clientRoutes[rAddrs[i]] = lAddrs[i]
+		serverRoutes[lAddrs[i]] = rAddrs[i]
+	}
+	server = newTestTransport(t, rAddrs, serverRoutes, serverOpt)
+	client = newTestTransport(t, lAddrs, clientRoutes, clientOpt)
+	return client, server
+}
+
+// acceptEcho echoes every stream server accepts until it closes
+func acceptEcho(server *UDPTransport) {
+	go func() {
+		for {
+			stream, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go handleEchoClient(stream)
+		}
+	}()
+}
+
+// openPair opens a stream from client on the first paths of lAddrs and rAddrs and returns it
+// with the stream server accepted, which is echoed if echo is set
+func openPair(t *testing.T, client, server *UDPTransport, lAddrs, rAddrs []string, paths int, echo bool) (dialer, acceptor *UDPStream) {
+	accepted := make(chan *UDPStream, 1)
+	go func() {
+		stream, err := server.Accept()
+		if err == nil {
+			accepted <- stream
+			if echo {
+				handleEchoClient(stream)
+			}
+		}
+	}()
+
+	dialer, err := client.Open(lAddrs[:paths], rAddrs[:paths])
+	if err != nil {
+		t.Fatalf("open. err:%v", err)
+	}
+	if echo {
+		checkError(t, echoTester(dialer, 1024, 4))
+	}
+	select {
+	case acceptor = <-accepted:
+	case <-time.After(time.Second):
+		t.Fatal("accept timeout")
+	}
+	return dialer, acceptor
+}
+
+func TestTransportClose(t *testing.T) {
+	client, server := newTransportPair(t, []string{"127.0.0.1:7101"}, []string{"127.0.0.1:17101"}, nil, nil)
+	defer client.Close()
+
+	accepted := make(chan *UDPStream, 1)
+	go func() {
+		stream, _ := server.Accept()
+		accepted <- stream
+	}()
+
+	stream, err := client.Open([]string{"127.0.0.1:7101"}, []string{"127.0.0.1:17101"})
+	checkError(t, err)
+	defer stream.Close()
+	if <-accepted == nil {
+		t.Fatal("accept failed")
+	}
+
+	err = server.Close()
+	checkError(t, err)
+	if server.Close() != io.ErrClosedPipe {
+		t.Fatal("Close after Close misbehavior")
+	}
+	if _, err = server.Accept(); err != io.ErrClosedPipe {
+		t.Fatal("Accept after Close misbehavior")
+	}
+	if _, err = server.NewTunnel("127.0.0.1:17102"); err != io.ErrClosedPipe {
+		t.Fatal("NewTunnel after Close misbehavior")
+	}
+}
+
+func TestTransportShutdown(t *testing.T) {
+	client, server := newTransportPair(t, []string{"127.0.0.1:7111"}, []string{"127.0.0.1:17111"}, nil, nil)
+	defer client.Close()
+
+	go func() {
+		stream, err := server.Accept()
+		if err == nil {
+			handleSinkClient(stream)
+		}
+	}()
+
+	stream, err := client.Open([]string{"127.0.0.1:7111"}, []string{"127.0.0.1:17111"})
+	checkError(t, err)
+	defer stream.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	checkError(t, err)
+
+	// the peer has received FIN
+	stream.SetReadDeadline(time.Now().Add(time.Second * 2))
+	buf := make([]byte, 10)
+	if _, err = stream.Read(buf); err != io.EOF {
+		t.Fatalf("Read after Shutdown misbehavior. err:%v", err)
+	}
+
+	if _, err = client.Open([]string{"127.0.0.1:7111"}, []string{"127.0.0.1:17111"}); err == nil {
+		t.Fatal("Open after Shutdown misbehavior")
+	}
+}
+
+func TestOpenContext(t *testing.T) {
+	client, server := newTransportPair(t, []string{"127.0.0.1:7141"}, []string{"127.0.0.1:17141"}, nil, nil)
+	defer client.Close()
+	defer server.Close()
+
+	// no one accepts on server, cancel the dial halfway
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(time.Millisecond * 200)
+		cancel()
+	}()
+	start := time.Now()
+	_, err := client.OpenContext(ctx, []string{"127.0.0.1:7141"}, []string{"127.0.0.1:17141"})
+	if err != context.Canceled {
+		t.Fatalf("OpenContext cancel misbehavior. err:%v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("OpenContext does not return on cancel")
+	}
+	if len(client.streams()) != 0 {
+		t.Fatal("half-open stream not removed")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	if _, err = client.OpenContext(ctx, []string{"127.0.0.1:7141"}, []string{"127.0.0.1:17141"}); err != errTimeout {
+		t.Fatalf("OpenContext timeout misbehavior. err:%v", err)
+	}
+}
+
+func TestAcceptContext(t *testing.T) {
+	client, server := newTransportPair(t, []string{"127.0.0.1:7151"}, []string{"127.0.0.1:17151"}, nil, nil)
+	defer client.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	if _, err := server.AcceptContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("AcceptContext timeout misbehavior. err:%v", err)
+	}
+
+	accepted := make(chan *UDPStream, 1)
+	go func() {
+		stream, _ := server.AcceptContext(context.Background())
+		accepted <- stream
+	}()
+	stream, err := client.OpenContext(context.Background(), []string{"127.0.0.1:7151"}, []string{"127.0.0.1:17151"})
+	checkError(t, err)
+	defer stream.Close()
+	if <-accepted == nil {
+		t.Fatal("AcceptContext failed")
+	}
+}
+
 func TestGlobalParallel(t *testing.T) {
 	hpc := clientTransport.pc.getHostParallel("127.0.0.1")
 	hpc.reset()
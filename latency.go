@@ -0,0 +1,238 @@
+package kcp
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	DefaultLatencyHysteresis  = 0.2             // a remote moves to another tunnel once its score is this much lower
+	DefaultLatencyLossPenalty = 10              // the score of a path losing every ping is this many times its rtt
+	DefaultLatencyIdle        = time.Minute * 5 // a remote not picked or a path not observed for so long is forgotten
+)
+
+// PathObserver is implemented by a TunnelSelector that learns from the acknowledges and pings of streams.
+// ObservePath is called for the rtt of an ack at most every DefaultAckRTTInterval on a path, for every
+// pong, and with lost set and rtt 0 for every ping not answered in time.
+type PathObserver interface {
+	ObservePath(tunnel *UDPTunnel, remote net.Addr, rtt time.Duration, lost bool)
+}
+
+// LatencyScore is how LatencySelector rates a tunnel for a remote, lower is better
+type LatencyScore struct {
+	Remote   string
+	Local    string
+	RTT      time.Duration
+	Loss     float64
+	Score    float64 // rtt in ms scaled by loss, 0 until measured
+	Measured bool    // false if the tunnel has not been measured to the remote and its aggregate is used
+	Chosen   bool    // the tunnel Pick returns for the remote
+}
+
+type latencyKey struct {
+	tunnel *UDPTunnel
+	remote string
+}
+
+type latencyPath struct {
+	health *pathHealth
+	seen   time.Time // last observed
+}
+
+type latencyChoice struct {
+	tunnel *UDPTunnel
+	used   time.Time // last picked
+}
+
+// LatencySelector picks the tunnel with the lowest rtt and loss to each remote, as measured by
+// the acknowledges and pings of streams. A tunnel not measured to a remote is rated by its pings
+// to other remotes, a tunnel never measured is tried first. A remote keeps its tunnel until
+// another one scores better by the hysteresis. Remotes and paths idle for DefaultLatencyIdle
+// are forgotten.
+type LatencySelector struct {
+	mu          sync.Mutex
+	hysteresis  float64
+	lossPenalty float64
+	idle        time.Duration
+	swept       time.Time
+	tunnels     []*UDPTunnel
+	paths       map[latencyKey]*latencyPath
+	chosen      map[string]*latencyChoice // by remote
+}
+
+func NewLatencySelector() *LatencySelector {
+	return &LatencySelector{
+		hysteresis:  DefaultLatencyHysteresis,
+		lossPenalty: float64(DefaultLatencyLossPenalty),
+		idle:        DefaultLatencyIdle,
+		swept:       time.Now(),
+		paths:       make(map[latencyKey]*latencyPath),
+		chosen:      make(map[string]*latencyChoice),
+	}
+}
+
+// SetHysteresis changes how much lower a score has to be to move a remote, 0.2 means 20%
+func (sel *LatencySelector) SetHysteresis(hysteresis float64) {
+	sel.mu.Lock()
+	defer sel.mu.Unlock()
+	sel.hysteresis = hysteresis
+}
+
+func (sel *LatencySelector) Add(tunnel *UDPTunnel) {
+	sel.mu.Lock()
+	defer sel.mu.Unlock()
+	for _, t := range sel.tunnels {
+		if t == tunnel {
+			return
+		}
+	}
+	sel.tunnels = append(sel.tunnels, tunnel)
+}
+
+func (sel *LatencySelector) Remove(tunnel *UDPTunnel) {
+	sel.mu.Lock()
+	defer sel.mu.Unlock()
+	for i, t := range sel.tunnels {
+		if t == tunnel {
+			sel.tunnels = append(sel.tunnels[:i], sel.tunnels[i+1:]...)
+			break
+		}
+	}
+	for key := range sel.paths {
+		if key.tunnel == tunnel {
+			delete(sel.paths, key)
+		}
+	}
+	for remote, c := range sel.chosen {
+		if c.tunnel == tunnel {
+			delete(sel.chosen, remote)
+		}
+	}
+}
+
+// sweep forgets the remotes and paths idle for sel.idle, at most once per sel.idle.
+// sel.mu must be held.
+func (sel *LatencySelector) sweep(now time.Time) {
+	if now.Sub(sel.swept) < sel.idle {
+		return
+	}
+	sel.swept = now
+	for key, p := range sel.paths {
+		if now.Sub(p.seen) >= sel.idle {
+			delete(sel.paths, key)
+		}
+	}
+	for remote, c := range sel.chosen {
+		if now.Sub(c.used) >= sel.idle {
+			delete(sel.chosen, remote)
+		}
+	}
+}
+
+func (sel *LatencySelector) ObservePath(tunnel *UDPTunnel, remote net.Addr, rtt time.Duration, lost bool) {
+	sel.mu.Lock()
+	defer sel.mu.Unlock()
+	now := time.Now()
+	sel.sweep(now)
+	key := latencyKey{tunnel, remote.String()}
+	p, ok := sel.paths[key]
+	if !ok {
+		p = &latencyPath{health: &pathHealth{}}
+		sel.paths[key] = p
+	}
+	p.seen = now
+	if lost {
+		p.health.miss()
+	} else {
+		p.health.ack(rtt)
+	}
+}
+
+func (sel *LatencySelector) Pick(remotes []string) (tunnels []*UDPTunnel) {
+	sel.mu.Lock()
+	defer sel.mu.Unlock()
+	if len(sel.tunnels) == 0 {
+		return nil
+	}
+	now := time.Now()
+	sel.sweep(now)
+	tunnels = make([]*UDPTunnel, len(remotes))
+	for i, remote := range remotes {
+		tunnels[i] = sel.choose(remote, now)
+	}
+	return tunnels
+}
+
+// choose returns the tunnel of remote, moving it if another one is better by the hysteresis.
+// sel.mu must be held.
+func (sel *LatencySelector) choose(remote string, now time.Time) *UDPTunnel {
+	var best *UDPTunnel
+	bestScore := 0.0
+	for _, t := range sel.tunnels {
+		score, _, _, _ := sel.score(t, remote)
+		if best == nil || score < bestScore {
+			best, bestScore = t, score
+		}
+	}
+	c, ok := sel.chosen[remote]
+	if !ok {
+		c = &latencyChoice{tunnel: best}
+		sel.chosen[remote] = c
+	}
+	c.used = now
+	if current := c.tunnel; current != best {
+		score, _, _, _ := sel.score(current, remote)
+		if bestScore >= score*(1-sel.hysteresis) {
+			return current
+		}
+		Logf(INFO, "LatencySelector::choose move remote:%v from:%v to:%v score:%.2f->%.2f", remote, current.LocalAddr(), best.LocalAddr(), score, bestScore)
+		c.tunnel = best
+	}
+	return best
+}
+
+// score rates tunnel for remote, sel.mu must be held
+func (sel *LatencySelector) score(tunnel *UDPTunnel, remote string) (score float64, rtt time.Duration, loss float64, measured bool) {
+	if p, ok := sel.paths[latencyKey{tunnel, remote}]; ok && p.health.recvd+p.health.lost > 0 {
+		rtt, loss, measured = p.health.srtt, p.health.loss, true
+	} else {
+		stats := tunnel.Stats()
+		rtt, loss = stats.RTT, stats.Loss
+	}
+	if rtt == 0 && loss > 0 {
+		// nothing answered yet, rate it as a lossy path of a second
+		rtt = time.Second
+	}
+	score = float64(rtt) / float64(time.Millisecond) * (1 + sel.lossPenalty*loss)
+	return score, rtt, loss, measured
+}
+
+// Scores returns the rating of every tunnel for every remote picked so far, best first by remote
+func (sel *LatencySelector) Scores() []LatencyScore {
+	sel.mu.Lock()
+	defer sel.mu.Unlock()
+	var scores []LatencyScore
+	for remote, c := range sel.chosen {
+		for _, t := range sel.tunnels {
+			score, rtt, loss, measured := sel.score(t, remote)
+			scores = append(scores, LatencyScore{
+				Remote:   remote,
+				Local:    t.LocalAddr().String(),
+				RTT:      rtt,
+				Loss:     loss,
+				Score:    score,
+				Measured: measured,
+				Chosen:   t == c.tunnel,
+			})
+		}
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].Remote != scores[j].Remote {
+			return scores[i].Remote < scores[j].Remote
+		}
+		return scores[i].Score < scores[j].Score
+	})
+	return scores
+}
@@ -0,0 +1,112 @@
+package kcp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func observe(sel *LatencySelector, tunnel *UDPTunnel, remote string, rtt time.Duration, count int) {
+	addr, _ := net.ResolveUDPAddr("udp", remote)
+	for i := 0; i < count; i++ {
+		sel.ObservePath(tunnel, addr, rtt, false)
+	}
+}
+
+func TestLatencySelector(t *testing.T) {
+	remote := "10.0.0.1:7000"
+	sel := NewLatencySelector()
+	if sel.Pick([]string{remote}) != nil {
+		t.Fatal("pick without tunnels")
+	}
+	tunnels := selectorTunnels(2)
+	for _, tunnel := range tunnels {
+		sel.Add(tunnel)
+	}
+	observe(sel, tunnels[0], remote, time.Millisecond*50, 1)
+	observe(sel, tunnels[1], remote, time.Millisecond*20, 1)
+	if picked := sel.Pick([]string{remote}); picked[0] != tunnels[1] {
+		t.Fatal("slower tunnel picked")
+	}
+
+	// a slightly better tunnel does not take the remote
+	observe(sel, tunnels[1], remote, time.Millisecond*22, 40)
+	observe(sel, tunnels[0], remote, time.Millisecond*20, 40)
+	if picked := sel.Pick([]string{remote}); picked[0] != tunnels[1] {
+		t.Fatal("choice flapped within hysteresis")
+	}
+
+	// losing pings makes the chosen one worse than the other
+	addr, _ := net.ResolveUDPAddr("udp", remote)
+	for i := 0; i < 4; i++ {
+		sel.ObservePath(tunnels[1], addr, 0, true)
+	}
+	if picked := sel.Pick([]string{remote}); picked[0] != tunnels[0] {
+		t.Fatal("lossy tunnel kept")
+	}
+
+	scores := sel.Scores()
+	if len(scores) != 2 || !scores[0].Chosen || scores[0].Local != tunnels[0].LocalAddr().String() || scores[1].Loss == 0 || !scores[1].Measured {
+		t.Fatalf("scores. %+v", scores)
+	}
+
+	sel.Remove(tunnels[0])
+	if picked := sel.Pick([]string{remote}); picked[0] != tunnels[1] {
+		t.Fatal("removed tunnel picked")
+	}
+
+	// idle remotes and paths are forgotten
+	sel.mu.Lock()
+	sel.sweep(time.Now().Add(DefaultLatencyIdle))
+	paths, chosen := len(sel.paths), len(sel.chosen)
+	sel.mu.Unlock()
+	if paths != 0 || chosen != 0 {
+		t.Fatalf("idle entries kept. paths:%v chosen:%v", paths, chosen)
+	}
+}
+
+func TestLatencySelectorAcks(t *testing.T) {
+	lAddr, rAddr := "127.0.0.1:7371", "127.0.0.1:17371"
+	serverSel, _ := NewTestSelector([]string{rAddr}, []string{lAddr})
+	server, err := NewUDPTransport(serverSel, nil)
+	checkError(t, err)
+	defer server.Close()
+	_, err = server.NewTunnel(rAddr)
+	checkError(t, err)
+	go func() {
+		for {
+			stream, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go handleEchoClient(stream)
+		}
+	}()
+
+	sel := NewLatencySelector()
+	client, err := NewUDPTransport(sel, nil)
+	checkError(t, err)
+	defer client.Close()
+	_, err = client.NewTunnel(lAddr)
+	checkError(t, err)
+	stream, err := client.Open([]string{lAddr}, []string{rAddr})
+	checkError(t, err)
+	defer stream.Close()
+	checkError(t, echoTester(stream, 1024, 4))
+
+	// the acknowledges of the stream rate its path without probing
+	deadline := time.Now().Add(time.Second)
+	for {
+		scores := sel.Scores()
+		if len(scores) == 1 && scores[0].Measured {
+			if scores[0].Remote != rAddr || scores[0].Local != lAddr || !scores[0].Chosen {
+				t.Fatalf("scores. %+v", scores)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("path not measured. scores:%+v", scores)
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
@@ -0,0 +1,85 @@
+package kcp
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+)
+
+var _ net.Conn = (*UDPStream)(nil)
+var _ net.Listener = (*Listener)(nil)
+
+// Listener implements net.Listener on top of the passive opens of a UDPTransport
+type Listener struct {
+	t    *UDPTransport
+	addr net.Addr
+
+	die     chan struct{} // notify the listener has closed
+	dieOnce sync.Once
+}
+
+// NewListener creates a listener accepting streams from t, lAddr is the tunnel
+// address reported by Addr, the tunnel is created if t does not own it yet.
+func NewListener(t *UDPTransport, lAddr string) (*Listener, error) {
+	tunnel, err := t.NewTunnel(lAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{
+		t:    t,
+		addr: tunnel.LocalAddr(),
+		die:  make(chan struct{}),
+	}, nil
+}
+
+// Accept implements the Accept method in the Listener interface, it waits for the next stream.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case <-l.die:
+		return nil, io.ErrClosedPipe
+	default:
+	}
+
+	stream, err := l.t.accept(l.die)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Close stops accepting new streams, streams already accepted are kept alive.
+func (l *Listener) Close() error {
+	var once bool
+	l.dieOnce.Do(func() {
+		once = true
+	})
+
+	Logf(INFO, "Listener::Close addr:%v once:%v", l.addr, once)
+	if !once {
+		return io.ErrClosedPipe
+	}
+
+	close(l.die)
+	l.t.stopAccept()
+	return nil
+}
+
+// Addr returns the listener's network address.
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
+
+// Dial opens a stream like Open does and returns it as a net.Conn
+func (t *UDPTransport) Dial(locals, remotes []string) (net.Conn, error) {
+	return t.DialContext(context.Background(), locals, remotes)
+}
+
+// DialContext opens a stream like OpenContext does and returns it as a net.Conn
+func (t *UDPTransport) DialContext(ctx context.Context, locals, remotes []string) (net.Conn, error) {
+	stream, err := t.OpenContext(ctx, locals, remotes)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
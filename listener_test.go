@@ -0,0 +1,96 @@
+package kcp
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestListenerHTTP(t *testing.T) {
+	client, server := newTransportPair(t, []string{"127.0.0.1:7121"}, []string{"127.0.0.1:17121"}, nil, nil)
+	defer client.Close()
+	defer server.Close()
+
+	l, err := NewListener(server, "127.0.0.1:17121")
+	checkError(t, err)
+	if l.Addr().String() != "127.0.0.1:17121" {
+		t.Fatalf("listener addr wrong. addr:%v", l.Addr())
+	}
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	})}
+	go srv.Serve(l)
+
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return client.DialContext(ctx, []string{"127.0.0.1:7121"}, []string{"127.0.0.1:17121"})
+			},
+		},
+		Timeout: time.Second * 5,
+	}
+	resp, err := httpClient.Get("http://kcp/")
+	checkError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	checkError(t, err)
+	if string(body) != "hello" {
+		t.Fatalf("http body wrong. body:%v", string(body))
+	}
+}
+
+func TestListenerClose(t *testing.T) {
+	client, server := newTransportPair(t, []string{"127.0.0.1:7131"}, []string{"127.0.0.1:17131"}, nil, nil)
+	defer client.Close()
+	defer server.Close()
+
+	l, err := NewListener(server, "127.0.0.1:17131")
+	checkError(t, err)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+
+	conn, err := client.Dial([]string{"127.0.0.1:7131"}, []string{"127.0.0.1:17131"})
+	checkError(t, err)
+	defer conn.Close()
+	sconn := <-accepted
+	if sconn == nil {
+		t.Fatal("accept failed")
+	}
+
+	checkError(t, l.Close())
+	if _, err = l.Accept(); err != io.ErrClosedPipe {
+		t.Fatal("Accept after Close misbehavior")
+	}
+	// an Accept that missed the check above does not enable passive opens again
+	if _, err = server.accept(l.die); err != io.ErrClosedPipe || atomic.LoadInt32(&server.startAccept) != 0 {
+		t.Fatal("accept after Close enabled passive opens")
+	}
+
+	// active streams survive listener close
+	go func() {
+		buf := make([]byte, 5)
+		n, _ := io.ReadFull(sconn, buf)
+		sconn.Write(buf[:n])
+	}()
+	_, err = conn.Write([]byte("hello"))
+	checkError(t, err)
+	buf := make([]byte, 5)
+	conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	_, err = io.ReadFull(conn, buf)
+	checkError(t, err)
+
+	// passive opens are disabled
+	if _, err = client.Dial([]string{"127.0.0.1:7131"}, []string{"127.0.0.1:17131"}); err == nil {
+		t.Fatal("Dial after listener Close misbehavior")
+	}
+}
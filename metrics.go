@@ -0,0 +1,311 @@
+package kcp
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	DefaultRTTBuckets  = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5} // seconds, read when a transport is created
+	DefaultDialBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}       // seconds, read when a transport is created
+)
+
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// snmpHelp describes the counters of Snmp by field name
+var snmpHelp = map[string]string{
+	"BytesSent":        "Bytes sent from upper level.",
+	"BytesReceived":    "Bytes received to upper level.",
+	"MaxConn":          "Max number of connections ever reached.",
+	"ActiveOpens":      "Accumulated active open connections.",
+	"PassiveOpens":     "Accumulated passive open connections.",
+	"CurrEstab":        "Current number of established connections.",
+	"DialTimeout":      "Dial timeout count.",
+	"InErrs":           "UDP read errors reported from net.PacketConn.",
+	"InCsumErrors":     "Checksum errors from CRC32.",
+	"KCPInErrors":      "Packet input errors reported from KCP.",
+	"InPkts":           "Incoming packets count.",
+	"OutPkts":          "Outgoing packets count.",
+	"InSegs":           "Incoming KCP segments.",
+	"OutSegs":          "Outgoing KCP segments.",
+	"InBytes":          "UDP bytes received.",
+	"OutBytes":         "UDP bytes sent.",
+	"RetransSegs":      "Accumulated retransmitted segments.",
+	"FastRetransSegs":  "Accumulated fast retransmitted segments.",
+	"EarlyRetransSegs": "Accumulated early retransmitted segments.",
+	"LostSegs":         "Number of segments inferred as lost.",
+	"RepeatSegs":       "Number of segments duplicated.",
+	"Parallels":        "Parallel count.",
+	"PacedPkts":        "Packets deferred by pacing.",
+	"FECRecovered":     "Correct packets recovered from FEC.",
+	"FECErrs":          "Incorrect packets recovered from FEC.",
+	"FECParityShards":  "FEC parity shards received.",
+	"HandshakeErrs":    "Handshakes failing authentication.",
+	"RejectedOpens":    "New streams refused for a bad cookie, the rate limit or the accept filter.",
+	"CookieOpens":      "New streams admitted with a valid retry cookie.",
+	"PathMigrations":   "Paths moved to a new remote address after validation.",
+	"DupBytes":         "Bytes sent in duplicate on further paths.",
+	"ParallelHosts":    "Remote hosts currently tracked by a parallel policy.",
+	"HostParallels":    "Remote hosts moved to more than one path by their parallel policy.",
+	"OutErrs":          "UDP write errors reported from net.PacketConn.",
+	"OutBatches":       "Sendmmsg calls.",
+	"MaxOutBatch":      "Largest number of packets sent by one sendmmsg.",
+	"DialErrs":         "Active opens failing, timeouts included.",
+}
+
+// snmpGauges are the fields of Snmp that may go down or are maximums
+var snmpGauges = map[string]bool{
+	"MaxConn":       true,
+	"CurrEstab":     true,
+	"ParallelHosts": true,
+	"MaxOutBatch":   true,
+}
+
+// tunnelFields are the fields of Snmp a tunnel counts into
+var tunnelFields = []string{"InPkts", "OutPkts", "InBytes", "OutBytes", "InErrs", "OutErrs", "InCsumErrors", "PacedPkts", "OutBatches", "MaxOutBatch"}
+
+// histogram counts durations in cumulative buckets of upper bounds in seconds
+type histogram struct {
+	bounds []float64
+	counts []uint64 // by bucket, the last one is +Inf
+	sum    uint64   // nanoseconds
+}
+
+func newHistogram(bounds []float64) *histogram {
+	bounds = append([]float64(nil), bounds...)
+	sort.Float64s(bounds)
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	if h == nil {
+		return
+	}
+	i := sort.SearchFloat64s(h.bounds, d.Seconds())
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.sum, uint64(d))
+}
+
+// MetricsHandler serves the counters of the transport, of its tunnels and of its remote hosts
+// with histograms of path rtt and dial latency, in the Prometheus text exposition format
+func (t *UDPTransport) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", metricsContentType)
+		t.WriteMetrics(w)
+	})
+}
+
+// SnmpHandler serves snmp in the Prometheus text exposition format, e.g. DefaultSnmp
+func SnmpHandler(snmp *Snmp) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", metricsContentType)
+		mw := newMetricsWriter(w)
+		mw.snmp(snmp)
+		mw.Flush()
+	})
+}
+
+// WriteMetrics writes what MetricsHandler serves to w
+func (t *UDPTransport) WriteMetrics(w io.Writer) error {
+	mw := newMetricsWriter(w)
+	mw.snmp(t.snmp)
+	t.writeTunnelMetrics(mw)
+	t.writeHostMetrics(mw)
+	mw.histogram("kcp_path_rtt_seconds", "Round trip time of paths, from probes and sampled acknowledges.", t.rttHist)
+	mw.histogram("kcp_dial_seconds", "Time to open a stream, failed opens are counted in kcp_dial_errs_total.", t.dialHist)
+	return mw.Flush()
+}
+
+func (t *UDPTransport) writeTunnelMetrics(mw *metricsWriter) {
+	t.tunnelMu.Lock()
+	locals := make(map[*UDPTunnel]string, len(t.tunnelHostM))
+	for lAddr, tunnel := range t.tunnelHostM {
+		locals[tunnel] = lAddr
+	}
+	t.tunnelMu.Unlock()
+	addrs := make([]string, 0, len(locals))
+	values := make(map[string]map[string]string, len(locals))
+	for tunnel, lAddr := range locals {
+		addrs = append(addrs, lAddr)
+		values[lAddr] = snmpValues(tunnel.snmp)
+	}
+	sort.Strings(addrs)
+
+	streams := make(map[string]int, len(addrs))
+	for _, stream := range t.streams() {
+		stream.mu.Lock()
+		if stream.state.open() {
+			seen := make(map[*UDPTunnel]bool, len(stream.tunnels))
+			for _, tunnel := range stream.tunnels {
+				if lAddr, ok := locals[tunnel]; ok && !seen[tunnel] {
+					seen[tunnel] = true
+					streams[lAddr]++
+				}
+			}
+		}
+		stream.mu.Unlock()
+	}
+
+	mw.family("kcp_tunnel_streams", "Streams with a path on the tunnel, counted like CurrEstab.", "gauge")
+	for _, lAddr := range addrs {
+		mw.sample("kcp_tunnel_streams", "local", lAddr, strconv.Itoa(streams[lAddr]))
+	}
+	for _, field := range tunnelFields {
+		name, typ := snmpMetric("kcp_tunnel_", field)
+		mw.family(name, snmpHelp[field], typ)
+		for _, lAddr := range addrs {
+			mw.sample(name, "local", lAddr, values[lAddr][field])
+		}
+	}
+}
+
+func (t *UDPTransport) writeHostMetrics(mw *metricsWriter) {
+	states := t.ParallelStates()
+	parallel := 0
+	mw.family("kcp_host_streams", "Streams to the remote host.", "gauge")
+	for _, state := range states {
+		mw.sample("kcp_host_streams", "host", state.Host, strconv.FormatInt(state.Streams, 10))
+	}
+	mw.family("kcp_host_parallel_level", "Paths the parallel policy of the remote host asks for.", "gauge")
+	for _, state := range states {
+		mw.sample("kcp_host_parallel_level", "host", state.Host, strconv.Itoa(state.Level))
+		if state.Level > 1 {
+			parallel++
+		}
+	}
+	mw.family("kcp_hosts_parallel", "Remote hosts on more than one path.", "gauge")
+	mw.sample("kcp_hosts_parallel", "", "", strconv.Itoa(parallel))
+}
+
+// snmpValues returns the counters of a copy of snmp by field name
+func snmpValues(snmp *Snmp) map[string]string {
+	copied := snmp.Copy()
+	values := copied.ToSlice()
+	fields := make(map[string]string, len(values))
+	for i, field := range copied.Header() {
+		fields[field] = values[i]
+	}
+	return fields
+}
+
+// snmpMetric returns the metric name and type of the Snmp field
+func snmpMetric(prefix, field string) (string, string) {
+	if snmpGauges[field] {
+		return prefix + snakeCase(field), "gauge"
+	}
+	return prefix + snakeCase(field) + "_total", "counter"
+}
+
+// snakeCase turns a field name like KCPInErrors into kcp_in_errors
+func snakeCase(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		isUpper := c >= 'A' && c <= 'Z'
+		if isUpper && i > 0 {
+			prevLower := s[i-1] >= 'a' && s[i-1] <= 'z'
+			nextLower := i+1 < len(s) && s[i+1] >= 'a' && s[i+1] <= 'z'
+			prevUpper := s[i-1] >= 'A' && s[i-1] <= 'Z'
+			if prevLower || (prevUpper && nextLower) {
+				b.WriteByte('_')
+			}
+		}
+		if isUpper {
+			c += 'a' - 'A'
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// metricsWriter encodes metric families in the Prometheus text exposition format
+type metricsWriter struct {
+	*bufio.Writer
+}
+
+func newMetricsWriter(w io.Writer) *metricsWriter {
+	return &metricsWriter{bufio.NewWriter(w)}
+}
+
+func (mw *metricsWriter) family(name, help, typ string) {
+	mw.WriteString("# HELP " + name + " " + escapeHelp(help) + "\n")
+	mw.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+// sample writes a value with one label, none if label is empty
+func (mw *metricsWriter) sample(name, label, labelValue, v string) {
+	mw.WriteString(name)
+	if label != "" {
+		mw.WriteString("{" + label + "=\"" + escapeLabel(labelValue) + "\"}")
+	}
+	mw.WriteString(" " + v + "\n")
+}
+
+func (mw *metricsWriter) snmp(snmp *Snmp) {
+	copied := snmp.Copy()
+	values := copied.ToSlice()
+	for i, field := range copied.Header() {
+		name, typ := snmpMetric("kcp_", field)
+		mw.family(name, snmpHelp[field], typ)
+		mw.sample(name, "", "", values[i])
+	}
+	dup := copied.DupBytesByPolicy()
+	policies := make([]string, 0, len(dup))
+	for policy := range dup {
+		policies = append(policies, policy)
+	}
+	sort.Strings(policies)
+	mw.family("kcp_policy_dup_bytes_total", "Bytes sent in duplicate on further paths by duplication policy.", "counter")
+	for _, policy := range policies {
+		mw.sample("kcp_policy_dup_bytes_total", "policy", policy, strconv.FormatUint(dup[policy], 10))
+	}
+}
+
+func (mw *metricsWriter) histogram(name, help string, h *histogram) {
+	mw.family(name, help, "histogram")
+	if h == nil {
+		return
+	}
+	count := uint64(0)
+	for i := range h.counts {
+		count += atomic.LoadUint64(&h.counts[i])
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = formatFloat(h.bounds[i])
+		}
+		mw.WriteString(name + "_bucket{le=\"" + le + "\"} " + strconv.FormatUint(count, 10) + "\n")
+	}
+	sum := time.Duration(atomic.LoadUint64(&h.sum)).Seconds()
+	mw.WriteString(name + "_sum " + formatFloat(sum) + "\n")
+	mw.WriteString(name + "_count " + strconv.FormatUint(count, 10) + "\n")
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
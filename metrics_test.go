@@ -0,0 +1,123 @@
+package kcp
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	lAddr, rAddr := "127.0.0.1:7421", "127.0.0.1:17421"
+	client, server := newTransportPair(t, []string{lAddr}, []string{rAddr}, &TransportOption{
+		DialTimeout:    time.Second * 2,
+		ParallelPolicy: func(string) ParallelPolicy { return NewLossParallelPolicy(0, 0) },
+	}, nil)
+	defer client.Close()
+	defer server.Close()
+	acceptEcho(server)
+
+	stream, err := client.Open([]string{lAddr}, []string{rAddr})
+	checkError(t, err)
+	defer stream.Close()
+	checkError(t, echoTester(stream, 1024, 4))
+	// nothing listens there
+	if _, err = client.OpenTimeout([]string{lAddr}, []string{"127.0.0.1:27421"}, time.Millisecond*100); err == nil {
+		t.Fatal("dial without a peer succeeded")
+	}
+
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		client.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+			t.Fatalf("content type. %v", ct)
+		}
+		return rec.Body.String()
+	}
+	deadline := time.Now().Add(time.Second * 2)
+	body := scrape()
+	for strings.Contains(body, "kcp_path_rtt_seconds_count 0\n") {
+		if time.Now().After(deadline) {
+			t.Fatal("no rtt observed")
+		}
+		time.Sleep(time.Millisecond * 20)
+		body = scrape()
+	}
+
+	for _, want := range []string{
+		"# TYPE kcp_bytes_sent_total counter\n",
+		"# TYPE kcp_curr_estab gauge\n",
+		"# HELP kcp_kcp_in_errors_total Packet input errors reported from KCP.\n",
+		"kcp_curr_estab 1\n",
+		"kcp_tunnel_streams{local=\"127.0.0.1:7421\"} 1\n",
+		"# TYPE kcp_tunnel_out_pkts_total counter\n",
+		"kcp_host_streams{host=\"127.0.0.1\"} 1\n",
+		"kcp_host_parallel_level{host=\"127.0.0.1\"} 1\n",
+		"kcp_hosts_parallel 0\n",
+		"# TYPE kcp_dial_seconds histogram\n",
+		"kcp_dial_seconds_bucket{le=\"+Inf\"} 1\n",
+		"kcp_dial_seconds_count 1\n",
+		"kcp_dial_errs_total 1\n",
+		"# TYPE kcp_policy_dup_bytes_total counter\n",
+		"kcp_path_rtt_seconds_bucket{le=\"2.5\"} ",
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("missing %q in:\n%v", want, body)
+		}
+	}
+	if strings.Contains(body, "kcp_tunnel_out_pkts_total{local=\"127.0.0.1:7421\"} 0\n") {
+		t.Fatal("tunnel packets not counted")
+	}
+
+	// a closing stream is counted by its tunnel as long as by CurrEstab
+	stream.mu.Lock()
+	stream.state = StateCloseWait
+	stream.mu.Unlock()
+	body = scrape()
+	stream.mu.Lock()
+	stream.state = StateEstablish
+	stream.mu.Unlock()
+	if !strings.Contains(body, "kcp_curr_estab 1\n") || !strings.Contains(body, "kcp_tunnel_streams{local=\"127.0.0.1:7421\"} 1\n") {
+		t.Fatalf("closing stream.\n%v", body)
+	}
+}
+
+func TestMetricsEncoding(t *testing.T) {
+	for field, want := range map[string]string{
+		"KCPInErrors":     "kcp_in_errors",
+		"FECParityShards": "fec_parity_shards",
+		"MaxOutBatch":     "max_out_batch",
+		"DupBytes":        "dup_bytes",
+	} {
+		if got := snakeCase(field); got != want {
+			t.Fatalf("snake case. field:%v got:%v want:%v", field, got, want)
+		}
+	}
+	for _, field := range DefaultSnmp.Header() {
+		if _, ok := snmpHelp[field]; !ok {
+			t.Fatalf("no help for %v", field)
+		}
+	}
+
+	// buckets are cumulative and the sum is in seconds
+	h := newHistogram([]float64{0.01, 0.1})
+	h.observe(time.Millisecond * 5)
+	h.observe(time.Millisecond * 50)
+	h.observe(time.Second)
+	var b strings.Builder
+	mw := newMetricsWriter(&b)
+	mw.histogram("h", "a \"quoted\"\nhelp", h)
+	mw.sample("g", "l", "a\"b\\c\n", "1")
+	checkError(t, mw.Flush())
+	want := "# HELP h a \"quoted\"\\nhelp\n" +
+		"# TYPE h histogram\n" +
+		"h_bucket{le=\"0.01\"} 1\n" +
+		"h_bucket{le=\"0.1\"} 2\n" +
+		"h_bucket{le=\"+Inf\"} 3\n" +
+		"h_sum 1.055\n" +
+		"h_count 3\n" +
+		"g{l=\"a\\\"b\\\\c\\n\"} 1\n"
+	if b.String() != want {
+		t.Fatalf("encoding.\n%v\nwant:\n%v", b.String(), want)
+	}
+}
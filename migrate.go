@@ -0,0 +1,223 @@
+package kcp
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"net"
+	"time"
+
+	gouuid "github.com/satori/go.uuid"
+	"golang.org/x/net/ipv4"
+)
+
+var (
+	DefaultPathChallengeInterval = time.Millisecond * 200 // a path is challenged at most this often, whatever the address
+)
+
+const (
+	pathTokenSize = 32 // a probe must not be shorter than the smallest packet read from a tunnel
+	pathProbeSize = gouuid.Size + 4 + 1 + pathTokenSize
+)
+
+// MigrationHook is called when a path of stream has moved from one remote address to another,
+// after the new address has answered a path challenge. It is called on the input goroutines
+// of the transport and should not block.
+type MigrationHook func(stream *UDPStream, path int, from, to net.Addr)
+
+// pathChallenge is a validation pending on a path
+type pathChallenge struct {
+	addr  *net.UDPAddr
+	token []byte
+	sent  time.Time
+}
+
+// isPathProbe tells path challenges, responses, pings and pongs, the token is sealed behind the header
+//
+// | UUID(16B) | MARKER(4B) | TYPE(1B) | TOKEN(32B) |
+func isPathProbe(data []byte) bool {
+	if !isHandshake(data) || len(data) < pathProbeSize {
+		return false
+	}
+	typ := data[gouuid.Size+4]
+	return typ == hsChallenge || typ == hsResponse || typ == hsPing || typ == hsPong
+}
+
+// pathProbe encodes a challenge or a response, leaving a gap of overhead bytes the tunnel seals over
+func pathProbe(uuid gouuid.UUID, typ byte, token []byte, overhead int) []byte {
+	buf := xmitBuf.Get().([]byte)[:pathProbeSize+overhead]
+	copy(buf, uuid[:])
+	binary.LittleEndian.PutUint32(buf[gouuid.Size:], hsMarker)
+	buf[gouuid.Size+4] = typ
+	gap := buf[gouuid.Size+5 : gouuid.Size+5+overhead]
+	for k := range gap {
+		gap[k] = 0
+	}
+	copy(buf[gouuid.Size+5+overhead:], token)
+	return buf
+}
+
+// handlePathProbe answers a challenge or a ping on a path of its stream, and hands a response
+// or a pong to the stream
+func (t *UDPTransport) handlePathProbe(tunnel *UDPTunnel, data []byte, rAddr net.Addr) {
+	var uuid gouuid.UUID
+	copy(uuid[:], data)
+	s, ok := t.streamm.Get(uuid)
+	if !ok {
+		return
+	}
+
+	stream := s.(*UDPStream)
+	token := data[gouuid.Size+5 : pathProbeSize]
+	switch data[gouuid.Size+4] {
+	case hsChallenge, hsPing:
+		// a removed path goes silent
+		if !stream.ownsTunnel(tunnel) {
+			return
+		}
+		overhead := 0
+		if t.crypt != nil {
+			overhead = t.crypt.overhead()
+		}
+		typ := byte(hsResponse)
+		if data[gouuid.Size+4] == hsPing {
+			typ = hsPong
+		}
+		buf := pathProbe(uuid, typ, token, overhead)
+		tunnel.outputRaw(buf, rAddr)
+		xmitBuf.Put(buf)
+	case hsResponse:
+		stream.validatePath(tunnel, rAddr, token)
+	case hsPong:
+		stream.recvPong(tunnel, rAddr, token)
+	}
+}
+
+// checkPath challenges rAddr if an established stream receives a packet from an address it does
+// not know on a path of tunnel, the path silent for the longest time is moved. It returns true
+// if a challenge is queued, s.mu must be held.
+func (s *UDPStream) checkPath(tunnel *UDPTunnel, rAddr net.Addr) bool {
+	if s.state < StateEstablish || s.state == StateClosed {
+		return false
+	}
+	addr, ok := rAddr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	path := -1
+	known := false
+	for i, remote := range s.remotes {
+		if sameUDPAddr(remote, addr) {
+			if s.tunnels[i] == tunnel {
+				s.pathRecv[i] = time.Now()
+			}
+			known = true
+		} else if s.tunnels[i] == tunnel && (path < 0 || s.pathRecv[i].Before(s.pathRecv[path])) {
+			path = i
+		}
+	}
+	if known || path < 0 {
+		return false
+	}
+
+	// one challenge per interval on a path whatever the address, spoofed sources rotating
+	// addresses get no more packets out of the stream
+	if c, ok := s.challenges[path]; ok && time.Since(c.sent) < DefaultPathChallengeInterval {
+		return false
+	}
+	token := make([]byte, pathTokenSize)
+	if _, err := rand.Read(token); err != nil {
+		return false
+	}
+	Logf(INFO, "UDPStream::checkPath challenge uuid:%v accepted:%v path:%v remote:%v addr:%v", s.uuid, s.accepted, path, s.remotes[path], addr)
+	s.queueProbe(path, addr, token)
+	return true
+}
+
+// queueProbe queues a challenge of addr with token on path, s.mu must be held
+func (s *UDPStream) queueProbe(path int, addr *net.UDPAddr, token []byte) {
+	if s.challenges == nil {
+		s.challenges = make(map[int]*pathChallenge)
+	}
+	c := &pathChallenge{
+		addr:  &net.UDPAddr{IP: append(net.IP(nil), addr.IP...), Port: addr.Port, Zone: addr.Zone},
+		token: token,
+		sent:  time.Now(),
+	}
+	s.challenges[path] = c
+	s.queueRaw(path, c.addr, pathProbe(s.uuid, hsChallenge, token, s.cryptOverhead))
+}
+
+// queueRaw queues buf to addr on path outside of KCP, s.mu must be held
+func (s *UDPStream) queueRaw(path int, addr *net.UDPAddr, buf []byte) {
+	for i := len(s.msgss); i <= path; i++ {
+		s.msgss = append(s.msgss, make([]ipv4.Message, 0))
+	}
+	msg := ipv4.Message{}
+	msg.Buffers = [][]byte{buf}
+	msg.Addr = addr
+	s.msgss[path] = append(s.msgss[path], msg)
+	if path < len(s.traffic) {
+		s.traffic[path].sent++
+	}
+}
+
+// ownsTunnel reports if a path of the stream sends from tunnel
+func (s *UDPStream) ownsTunnel(tunnel *UDPTunnel) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tunnels {
+		if t == tunnel {
+			return true
+		}
+	}
+	return false
+}
+
+// validatePath moves the path of tunnel to rAddr if token answers its pending challenge,
+// what was in flight to the previous address is retransmitted at once. The answer to a
+// probe of the current address only shows the path is alive.
+func (s *UDPStream) validatePath(tunnel *UDPTunnel, rAddr net.Addr, token []byte) {
+	addr, ok := rAddr.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	path := -1
+	for i, c := range s.challenges {
+		if i < len(s.tunnels) && s.tunnels[i] == tunnel && sameUDPAddr(c.addr, addr) && subtle.ConstantTimeCompare(c.token, token) == 1 {
+			path = i
+			break
+		}
+	}
+	if path < 0 || s.state == StateClosed {
+		s.mu.Unlock()
+		return
+	}
+	s.pathRecv[path] = time.Now()
+	if sameUDPAddr(s.remotes[path], addr) {
+		delete(s.challenges, path)
+		s.mu.Unlock()
+		return
+	}
+
+	from, to := s.remotes[path], s.challenges[path].addr
+	remotes := make([]*net.UDPAddr, len(s.remotes))
+	copy(remotes, s.remotes)
+	remotes[path] = to
+	s.remotes = remotes
+	delete(s.challenges, path)
+	current := currentMs()
+	for k := range s.kcp.snd_buf {
+		s.kcp.snd_buf[k].resendts = current
+	}
+	hook := s.migrationHook
+	s.mu.Unlock()
+
+	Logf(INFO, "UDPStream::validatePath migrate uuid:%v accepted:%v path:%v from:%v to:%v", s.uuid, s.accepted, path, from, to)
+	s.snmp.add(func(m *Snmp) *uint64 { return &m.PathMigrations }, 1)
+	s.notifyFlushEvent(true)
+	if hook != nil {
+		hook(s, path, from, to)
+	}
+}
@@ -0,0 +1,124 @@
+package kcp
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gouuid "github.com/satori/go.uuid"
+)
+
+func TestPathProbe(t *testing.T) {
+	uuid, _ := gouuid.NewV1()
+	token := bytes.Repeat([]byte{7}, pathTokenSize)
+	buf := pathProbe(uuid, hsChallenge, token, 0)
+	if !isHandshake(buf) || !isPathProbe(buf) || isClearHandshake(buf) || isCookie(buf) {
+		t.Fatal("path probe not detected")
+	}
+	if packetHeaderSize(buf) != gouuid.Size+5 || !bytes.Equal(buf[gouuid.Size+5:], token) {
+		t.Fatal("path probe layout")
+	}
+	xmitBuf.Put(buf)
+
+	// the token sits behind the gap the tunnel seals over
+	buf = pathProbe(uuid, hsResponse, token, 28)
+	if len(buf) != pathProbeSize+28 || !bytes.Equal(buf[gouuid.Size+5+28:], token) {
+		t.Fatal("sealed path probe layout")
+	}
+	xmitBuf.Put(buf)
+}
+
+func TestMigration(t *testing.T) {
+	for _, c := range []struct {
+		name                      string
+		lAddr, rAddr, reboundAddr string
+		copt                      *CryptOption
+	}{
+		{"plain", "127.0.0.1:7311", "127.0.0.1:17311", "127.0.0.1:27311", nil},
+		{"crypt", "127.0.0.1:7321", "127.0.0.1:17321", "127.0.0.1:27321", &CryptOption{Method: CryptAESGCM, Key: []byte("0123456789abcdef")}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			testMigration(t, c.lAddr, c.rAddr, c.reboundAddr, c.copt)
+		})
+	}
+}
+
+func testMigration(t *testing.T, lAddr, rAddr, reboundAddr string, copt *CryptOption) {
+	type migration struct {
+		path     int
+		from, to string
+	}
+	migrated := make(chan migration, 1)
+	hook := func(stream *UDPStream, path int, from, to net.Addr) {
+		migrated <- migration{path, from.String(), to.String()}
+	}
+
+	client, server := newTransportPair(t, []string{lAddr, reboundAddr}, []string{rAddr}, &TransportOption{CryptOption: copt}, &TransportOption{CryptOption: copt, MigrationHook: hook})
+	defer server.Close()
+	defer client.Close()
+	acceptEcho(server)
+	client.tunnelMu.Lock()
+	old, rebound := client.tunnelHostM[lAddr], client.tunnelHostM[reboundAddr]
+	client.tunnelMu.Unlock()
+
+	stream, err := client.Open([]string{lAddr}, []string{rAddr})
+	checkError(t, err)
+	defer stream.Close()
+	checkError(t, echoTester(stream, 1024, 4))
+
+	// the mapping of the client changes, its packets come from another address
+	migrations := atomic.LoadUint64(&DefaultSnmp.PathMigrations)
+	stream.mu.Lock()
+	stream.tunnels[0] = rebound
+	stream.locals[0] = rebound.LocalAddr()
+	stream.mu.Unlock()
+	old.Close()
+
+	checkError(t, echoTester(stream, 1024, 4))
+	select {
+	case m := <-migrated:
+		if m.path != 0 || m.from != lAddr || m.to != reboundAddr {
+			t.Fatalf("migration. path:%v from:%v to:%v", m.path, m.from, m.to)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("migration hook not called")
+	}
+	if atomic.LoadUint64(&DefaultSnmp.PathMigrations) == migrations {
+		t.Fatal("PathMigrations not counted")
+	}
+}
+
+func TestPathChallengeLimit(t *testing.T) {
+	sel := NewRoundRobinSelector()
+	tunnels := selectorTunnels(1)
+	sel.Add(tunnels[0])
+	uuid, _ := gouuid.NewV1()
+	s, err := NewUDPStream(uuid, false, []string{"127.0.0.1:9300"}, nil, sel, func(gouuid.UUID) {})
+	checkError(t, err)
+	defer s.Close()
+	s.mu.Lock()
+	s.state = StateEstablish
+	conv := s.kcp.conv
+	s.mu.Unlock()
+
+	// a packet KCP refuses does not challenge, the uuid is all a forger needs
+	forged := make([]byte, gouuid.Size+IKCP_OVERHEAD)
+	copy(forged, uuid[:])
+	ikcp_encode32u(forged[gouuid.Size:], conv+1)
+	s.input(forged, tunnels[0], &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.challenges) != 0 {
+		t.Fatal("refused packet challenged")
+	}
+
+	// rotating source addresses get one challenge per interval
+	for i := 0; i < 4; i++ {
+		addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000 + i}
+		if challenged := s.checkPath(tunnels[0], addr); challenged != (i == 0) {
+			t.Fatalf("challenge. addr:%v challenged:%v", addr, challenged)
+		}
+	}
+}
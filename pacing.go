@@ -0,0 +1,91 @@
+package kcp
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+var (
+	DefaultPacingBurst         = 16 * IKCP_MTU_DEF // bytes allowed to leave back-to-back
+	DefaultPacingGain  float64 = 1.25              // headroom over cwnd/srtt for derived rates
+)
+
+// pacer is a token bucket, tokens are bytes refilled at rate per second up to burst
+type pacer struct {
+	mu     sync.Mutex
+	rate   uint64
+	burst  int
+	tokens float64
+	last   time.Time
+	snmp   *Snmp // counts PacedPkts
+}
+
+func newPacer(rate uint64, burst int) *pacer {
+	if burst <= 0 {
+		burst = DefaultPacingBurst
+	}
+	return &pacer{
+		rate:   rate,
+		burst:  burst,
+		tokens: float64(burst),
+		last:   time.Now(),
+		snmp:   DefaultSnmp,
+	}
+}
+
+func (p *pacer) setRate(rate uint64) {
+	p.mu.Lock()
+	p.rate = rate
+	p.mu.Unlock()
+}
+
+// schedule splits msgs into groups by the time they are allowed to be sent,
+// fn is called for every group, delay 0 means the group can be sent right now
+func (p *pacer) schedule(msgs []ipv4.Message, fn func(msgs []ipv4.Message, delay time.Duration)) {
+	p.mu.Lock()
+	if p.rate == 0 {
+		p.mu.Unlock()
+		fn(msgs, 0)
+		return
+	}
+
+	now := time.Now()
+	p.tokens += now.Sub(p.last).Seconds() * float64(p.rate)
+	if p.tokens > float64(p.burst) {
+		p.tokens = float64(p.burst)
+	}
+	p.last = now
+
+	type group struct {
+		start, end int
+		delay      time.Duration
+	}
+	groups := make([]group, 0, 1)
+	for k := range msgs {
+		p.tokens -= float64(len(msgs[k].Buffers[0]))
+		var delay time.Duration
+		if p.tokens < 0 {
+			// groups are aligned to millisecond, the resolution of the timed scheduler
+			delay = time.Duration(-p.tokens/float64(p.rate)*1000) * time.Millisecond
+		}
+		if n := len(groups); n > 0 && groups[n-1].delay == delay {
+			groups[n-1].end = k + 1
+		} else {
+			groups = append(groups, group{k, k + 1, delay})
+		}
+	}
+	p.mu.Unlock()
+
+	var deferred uint64
+	for _, g := range groups {
+		if g.delay > 0 {
+			deferred += uint64(g.end - g.start)
+		}
+		fn(msgs[g.start:g.end], g.delay)
+	}
+	if deferred > 0 {
+		p.snmp.add(func(m *Snmp) *uint64 { return &m.PacedPkts }, deferred)
+	}
+}
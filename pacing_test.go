@@ -0,0 +1,95 @@
+package kcp
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+func TestPacerSchedule(t *testing.T) {
+	addr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:1")
+	msgs := make([]ipv4.Message, 10)
+	for k := range msgs {
+		msgs[k] = ipv4.Message{Buffers: [][]byte{make([]byte, 1000)}, Addr: addr}
+	}
+
+	paced := atomic.LoadUint64(&DefaultSnmp.PacedPkts)
+	p := newPacer(100*1000, 2000)
+
+	var sent int
+	var last time.Duration
+	p.schedule(msgs, func(msgs []ipv4.Message, delay time.Duration) {
+		if delay == 0 {
+			if sent != 0 {
+				t.Fatal("immediate group after deferred group")
+			}
+		} else if delay <= last {
+			t.Fatalf("delay not increasing. delay:%v last:%v", delay, last)
+		}
+		last = delay
+		sent += len(msgs)
+	})
+	if sent != len(msgs) {
+		t.Fatalf("messages lost. sent:%v", sent)
+	}
+	// 8 packets over the burst at 100 packets per second
+	if last < time.Millisecond*70 || last > time.Millisecond*90 {
+		t.Fatalf("pacing delay wrong. last:%v", last)
+	}
+	if atomic.LoadUint64(&DefaultSnmp.PacedPkts)-paced != 8 {
+		t.Fatal("PacedPkts wrong")
+	}
+
+	// rate 0 sends everything right now
+	p.setRate(0)
+	p.schedule(msgs, func(msgs []ipv4.Message, delay time.Duration) {
+		if delay != 0 || len(msgs) != 10 {
+			t.Fatal("unpaced schedule misbehavior")
+		}
+	})
+}
+
+func TestPacingEcho(t *testing.T) {
+	lAddr, rAddr := "127.0.0.1:7161", "127.0.0.1:17161"
+	topt := &TransportOption{
+		StreamOption: &StreamOption{Nodelay: 1, Interval: 10, Resend: 2, Nc: 0, Pacing: true},
+		TunnelOption: &TunnelOption{PacingRate: 1024 * 1024, PacingBurst: 4 * 1400},
+	}
+
+	clientSel, _ := NewTestSelector([]string{lAddr}, []string{rAddr})
+	client, err := NewUDPTransport(clientSel, topt)
+	checkError(t, err)
+	defer client.Close()
+	_, err = client.NewTunnel(lAddr)
+	checkError(t, err)
+
+	serverSel, _ := NewTestSelector([]string{rAddr}, []string{lAddr})
+	server, err := NewUDPTransport(serverSel, topt)
+	checkError(t, err)
+	defer server.Close()
+	_, err = server.NewTunnel(rAddr)
+	checkError(t, err)
+
+	go func() {
+		stream, err := server.Accept()
+		if err == nil {
+			handleEchoClient(stream)
+		}
+	}()
+
+	stream, err := client.Open([]string{lAddr}, []string{rAddr})
+	checkError(t, err)
+	defer stream.Close()
+	if !stream.pacing {
+		t.Fatal("stream option not applied")
+	}
+
+	paced := atomic.LoadUint64(&DefaultSnmp.PacedPkts)
+	checkError(t, echoTester(stream, 64*1024, 4))
+	if atomic.LoadUint64(&DefaultSnmp.PacedPkts) == paced {
+		t.Fatal("no packet paced")
+	}
+}
@@ -1,6 +1,8 @@
 package kcp
 
 import (
+	"math"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -9,25 +11,235 @@ import (
 var (
 	UpdateIntervalMs        = 250
 	ExtraCachePeriods int64 = 10
+
+	DefaultParallelLossGain       = 1.0 / 64 // weight of one segment in the loss estimate
+	DefaultParallelTargetLoss     = 0.01     // loss left after redundancy that LossParallelPolicy aims at
+	DefaultParallelMaxLevel       = 3
+	DefaultParallelLossHysteresis = 0.5 // share of the target a lower level must reach to be taken
 )
 
-type parallelCtrl struct {
-	periods  int64
-	rate     float64
-	duration time.Duration
-	hpm      map[string]*hostParallel
-	mu       sync.RWMutex
+// ParallelAll is the level asking the streams of a host to use all of their paths
+const ParallelAll = math.MaxInt32
+
+// ParallelObservation is what a stream reports about its remote host
+type ParallelObservation struct {
+	Streams  int64         // open streams to the host, filled in by the transport
+	Parallel bool          // the stream entered parallel because of its retransmissions, see SetParallelXmit
+	Sent     uint64        // segments sent since the last observation, retransmissions included
+	Retrans  uint64        // segments retransmitted since the last observation
+	Lost     uint64        // segments retransmitted on timeout since the last observation
+	RTT      time.Duration // smoothed rtt of the stream
+}
+
+// ParallelState is what a ParallelPolicy knows about a host, policies leave unknown fields zero
+type ParallelState struct {
+	Host    string
+	Streams int64
+	Level   int           // paths the streams of the host are asked to use, ParallelAll for all
+	Loss    float64       // estimated share of segments lost
+	RTT     time.Duration // estimated rtt
+	Events  int64         // parallel entries counted in the window of RingParallelPolicy
+	Expire  time.Time     // end of the parallel period of RingParallelPolicy
+}
+
+// ParallelPolicy decides on the redundancy of all streams to one remote host. The transport
+// creates one for every host, see TransportOption.ParallelPolicy. A stream sends on at least
+// Level of its paths, a level of 1 leaves it to the stream and its DuplicationPolicy.
+type ParallelPolicy interface {
+	Observe(obs ParallelObservation)
+	Update(now time.Time) // called every UpdateIntervalMs
+	Level() int
+	State() ParallelState
+	Reset()
+}
+
+// HostPolicy creates the ParallelPolicy of a remote host
+type HostPolicy func(host string) ParallelPolicy
+
+// RingParallelPolicy moves a host to all paths for a fixed duration when the parallel entries
+// of its streams over the last periods seconds reach rate per stream
+type RingParallelPolicy struct {
+	periods     int64
+	extra       int64 // ExtraCachePeriods when the policy was created
+	rate        float64
+	duration    time.Duration
+	ringCounter []int64
+	count       int64
+	expire      int64
+	lastDecT    int64
+}
+
+func NewRingParallelPolicy(periods int64, rate float64, duration time.Duration) *RingParallelPolicy {
+	return &RingParallelPolicy{
+		periods:     periods,
+		extra:       ExtraCachePeriods,
+		rate:        rate,
+		duration:    duration,
+		ringCounter: make([]int64, periods+ExtraCachePeriods),
+		lastDecT:    time.Now().Add(-time.Duration(periods) * time.Second).Unix(),
+	}
+}
+
+func (p *RingParallelPolicy) Reset() {
+	for i := 0; i < len(p.ringCounter); i++ {
+		atomic.StoreInt64(&p.ringCounter[i], 0)
+	}
+	atomic.StoreInt64(&p.count, 0)
+	atomic.StoreInt64(&p.expire, 0)
+	atomic.StoreInt64(&p.lastDecT, time.Now().Add(-time.Duration(p.periods)*time.Second).Unix())
+}
+
+func (p *RingParallelPolicy) Observe(obs ParallelObservation) {
+	if !obs.Parallel {
+		return
+	}
+	idx := int(time.Now().Unix() % int64(len(p.ringCounter)))
+	atomic.AddInt64(&p.ringCounter[idx], 1)
+	count := atomic.AddInt64(&p.count, 1)
+
+	if obs.Streams != 0 && float64(count)/float64(obs.Streams) >= p.rate {
+		atomic.StoreInt64(&p.expire, time.Now().Add(p.duration).UnixNano())
+	}
+}
+
+func (p *RingParallelPolicy) Update(now time.Time) {
+	nowDecT := now.Add(-time.Duration(p.periods) * time.Second).Unix()
+	lastDecT := atomic.LoadInt64(&p.lastDecT)
+	if nowDecT-lastDecT > p.extra {
+		Logf(ERROR, "RingParallelPolicy::Update dec count delay. nowDecT:%v lastDecT:%v", nowDecT, lastDecT)
+		p.Reset()
+		return
+	}
+
+	for t := lastDecT + 1; t <= nowDecT; t++ {
+		idx := t % int64(len(p.ringCounter))
+		count := atomic.LoadInt64(&p.ringCounter[idx])
+		atomic.AddInt64(&p.ringCounter[idx], -count)
+		atomic.AddInt64(&p.count, -count)
+	}
+	atomic.StoreInt64(&p.lastDecT, nowDecT)
+
+	expire := atomic.LoadInt64(&p.expire)
+	if expire != 0 && now.UnixNano() >= expire {
+		atomic.StoreInt64(&p.expire, 0)
+	}
+}
+
+func (p *RingParallelPolicy) Level() int {
+	if atomic.LoadInt64(&p.expire) != 0 {
+		return ParallelAll
+	}
+	return 1
+}
+
+func (p *RingParallelPolicy) State() ParallelState {
+	state := ParallelState{
+		Level:  p.Level(),
+		Events: atomic.LoadInt64(&p.count),
+	}
+	if expire := atomic.LoadInt64(&p.expire); expire != 0 {
+		state.Expire = time.Unix(0, expire)
+	}
+	return state
+}
+
+// LossParallelPolicy estimates the loss of a host by an exponentially weighted average of the
+// share of segments its streams retransmit on timeout, and asks for the fewest paths that bring
+// the loss left when all copies of a segment are lost down to target. Fast and early
+// retransmissions are left out, reordering between paths triggers them without any loss.
+type LossParallelPolicy struct {
+	target   float64
+	maxLevel int
+	mu       sync.Mutex
+	loss     float64
+	rtt      time.Duration
+	level    int
+}
+
+// NewLossParallelPolicy creates a LossParallelPolicy, zero values take DefaultParallelTargetLoss
+// and DefaultParallelMaxLevel
+func NewLossParallelPolicy(target float64, maxLevel int) *LossParallelPolicy {
+	if target <= 0 {
+		target = DefaultParallelTargetLoss
+	}
+	if maxLevel <= 0 {
+		maxLevel = DefaultParallelMaxLevel
+	}
+	return &LossParallelPolicy{target: target, maxLevel: maxLevel, level: 1}
+}
+
+func (p *LossParallelPolicy) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.loss, p.rtt, p.level = 0, 0, 1
+}
+
+func (p *LossParallelPolicy) Observe(obs ParallelObservation) {
+	if obs.Sent == 0 {
+		return
+	}
+	lost := obs.Lost
+	if lost > obs.Sent {
+		lost = obs.Sent
+	}
+	sample := float64(lost) / float64(obs.Sent)
+	gain := 1 - math.Pow(1-DefaultParallelLossGain, float64(obs.Sent))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.loss += gain * (sample - p.loss)
+	if obs.RTT > 0 {
+		if p.rtt == 0 {
+			p.rtt = obs.RTT
+		} else {
+			p.rtt += (obs.RTT - p.rtt) / 8
+		}
+	}
+
+	level := 1
+	for level < p.maxLevel && math.Pow(p.loss, float64(level)) > p.target {
+		level++
+	}
+	if level < p.level && math.Pow(p.loss, float64(level)) > p.target*DefaultParallelLossHysteresis {
+		level = p.level
+	}
+	p.level = level
+}
+
+func (p *LossParallelPolicy) Update(now time.Time) {}
+
+func (p *LossParallelPolicy) Level() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.level
+}
+
+func (p *LossParallelPolicy) State() ParallelState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return ParallelState{Level: p.level, Loss: p.loss, RTT: p.rtt}
 }
 
-func newParallelCtrl(periods int64, rate float64, duration time.Duration) *parallelCtrl {
-	Logf(WARN, "newParallelCtrl periods:%v rate:%v duration:%v", periods, rate, duration)
+type parallelCtrl struct {
+	newPolicy   HostPolicy
+	idleTimeout time.Duration
+	snmp        *Snmp
+	hpm         map[string]*hostParallel
+	mu          sync.RWMutex
+	die         chan struct{}
+	dieOnce     sync.Once
+}
 
-	return &parallelCtrl{
-		periods:  periods,
-		rate:     rate,
-		duration: duration,
-		hpm:      make(map[string]*hostParallel),
+func newParallelCtrl(newPolicy HostPolicy, idleTimeout time.Duration, snmp *Snmp) *parallelCtrl {
+	p := &parallelCtrl{
+		newPolicy:   newPolicy,
+		idleTimeout: idleTimeout,
+		snmp:        snmp,
+		hpm:         make(map[string]*hostParallel),
+		die:         make(chan struct{}),
 	}
+	go p.update()
+	return p
 }
 
 func (p *parallelCtrl) getHostParallel(host string) *hostParallel {
@@ -42,102 +254,199 @@ func (p *parallelCtrl) getHostParallel(host string) *hostParallel {
 	p.mu.Lock()
 	hp, ok = p.hpm[host]
 	if !ok {
-		hp = newHostParallel(host, p)
+		hp = newHostParallel(host, p.newPolicy(host), p.snmp)
 		p.hpm[host] = hp
+		p.snmp.add(func(m *Snmp) *uint64 { return &m.ParallelHosts }, 1)
 	}
 	p.mu.Unlock()
 	return hp
 }
 
+// acquire returns the entry of host with a stream more, nil after close.
+// The stream is counted under p.mu so that update does not evict the entry in between.
+func (p *parallelCtrl) acquire(host string) *hostParallel {
+	for {
+		select {
+		case <-p.die:
+			return nil
+		default:
+		}
+		hp := p.getHostParallel(host)
+		p.mu.RLock()
+		if p.hpm[host] == hp {
+			hp.inc()
+			p.mu.RUnlock()
+			return hp
+		}
+		p.mu.RUnlock()
+	}
+}
+
+// release takes a stream of hp away, the entry becomes idle with its last stream
+func (p *parallelCtrl) release(hp *hostParallel) {
+	hp.dec()
+}
+
+// update ticks the policies of all hosts every UpdateIntervalMs and evicts the hosts idle
+// for idleTimeout, it runs until close
+func (p *parallelCtrl) update() {
+	ticker := time.NewTicker(time.Duration(UpdateIntervalMs) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.die:
+			return
+		case now := <-ticker.C:
+			p.mu.RLock()
+			hps := make([]*hostParallel, 0, len(p.hpm))
+			for _, hp := range p.hpm {
+				hps = append(hps, hp)
+			}
+			p.mu.RUnlock()
+
+			var idle []*hostParallel
+			for _, hp := range hps {
+				hp.policy.Update(now)
+				hp.sync()
+				if hp.idle(now, p.idleTimeout) {
+					idle = append(idle, hp)
+				}
+			}
+			if len(idle) != 0 {
+				p.evict(idle, now)
+			}
+		}
+	}
+}
+
+func (p *parallelCtrl) evict(hps []*hostParallel, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, hp := range hps {
+		if p.hpm[hp.host] != hp || !hp.idle(now, p.idleTimeout) {
+			continue
+		}
+		Logf(INFO, "parallelCtrl::evict host:%v", hp.host)
+		delete(p.hpm, hp.host)
+		p.snmp.add(func(m *Snmp) *uint64 { return &m.ParallelHosts }, ^uint64(0))
+	}
+}
+
+// close stops update and drops all hosts
+func (p *parallelCtrl) close() {
+	p.dieOnce.Do(func() {
+		close(p.die)
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		for host := range p.hpm {
+			delete(p.hpm, host)
+			p.snmp.add(func(m *Snmp) *uint64 { return &m.ParallelHosts }, ^uint64(0))
+		}
+	})
+}
+
+// states returns the state of every host, sorted by host
+func (p *parallelCtrl) states() []ParallelState {
+	p.mu.RLock()
+	states := make([]ParallelState, 0, len(p.hpm))
+	for _, hp := range p.hpm {
+		states = append(states, hp.state())
+	}
+	p.mu.RUnlock()
+	sort.Slice(states, func(i, j int) bool { return states[i].Host < states[j].Host })
+	return states
+}
+
+// ParallelStates returns what the parallel policy of each remote host knows, sorted by host.
+// It is empty unless the transport has a ParallelPolicy or ParallelCheckPeriods.
+func (t *UDPTransport) ParallelStates() []ParallelState {
+	if t.pc == nil {
+		return nil
+	}
+	return t.pc.states()
+}
+
 type hostParallel struct {
-	host        string
-	p           *parallelCtrl
-	ringCounter []int64
-	count       int64
-	streams     int64
-	expire      int64
-	lastDecT    int64
+	host      string
+	policy    ParallelPolicy
+	streams   int64
+	level     int64 // last level of policy
+	idleSince int64 // unix nano when the last stream went away, 0 while there are streams
+	snmp      *Snmp
 }
 
-func newHostParallel(host string, p *parallelCtrl) *hostParallel {
+func newHostParallel(host string, policy ParallelPolicy, snmp *Snmp) *hostParallel {
 	Logf(WARN, "newHostParallel host:%v", host)
 
-	h := &hostParallel{
-		host:        host,
-		p:           p,
-		ringCounter: make([]int64, p.periods+ExtraCachePeriods),
-		lastDecT:    time.Now().Add(-time.Duration(p.periods) * time.Second).Unix(),
+	return &hostParallel{
+		host:      host,
+		policy:    policy,
+		snmp:      snmp,
+		level:     1,
+		idleSince: time.Now().UnixNano(),
 	}
-	go h.update()
-	return h
 }
 
 func (h *hostParallel) reset() {
-	Logf(WARN, "hostParallel::reset. host:%v stream:%v", h.host, h.streams)
+	Logf(WARN, "hostParallel::reset. host:%v stream:%v", h.host, atomic.LoadInt64(&h.streams))
+	h.policy.Reset()
+	h.sync()
+}
 
-	for i := 0; i < len(h.ringCounter); i++ {
-		atomic.StoreInt64(&h.ringCounter[i], 0)
+// sync takes the level of the policy
+func (h *hostParallel) sync() {
+	level := int64(h.policy.Level())
+	if old := atomic.SwapInt64(&h.level, level); old != level {
+		Logf(WARN, "hostParallel::sync level changed. host:%v stream:%v level:%v->%v", h.host, atomic.LoadInt64(&h.streams), old, level)
+		if old <= 1 && level > 1 {
+			h.snmp.add(func(m *Snmp) *uint64 { return &m.HostParallels }, 1)
+		}
 	}
-	atomic.StoreInt64(&h.count, 0)
-	atomic.StoreInt64(&h.expire, 0)
-	h.lastDecT = time.Now().Add(-time.Duration(h.p.periods) * time.Second).Unix()
 }
 
-func (h *hostParallel) setParallel() {
-	Logf(WARN, "hostParallel::setParallel. host:%v stream:%v count:%v", h.host, h.streams, atomic.LoadInt64(&h.count))
-	atomic.StoreInt64(&h.expire, time.Now().Add(h.p.duration).UnixNano())
+func (h *hostParallel) levelPaths() int {
+	return int(atomic.LoadInt64(&h.level))
 }
 
-func (h *hostParallel) unsetParallel() {
-	Logf(WARN, "hostParallel::unsetParallel. host:%v stream:%v count:%v", h.host, h.streams, atomic.LoadInt64(&h.count))
-	atomic.StoreInt64(&h.expire, 0)
+func (h *hostParallel) isParallel() bool {
+	return h.levelPaths() > 1
 }
 
-func (h *hostParallel) isParallel() bool {
-	return atomic.LoadInt64(&h.expire) != 0
+func (h *hostParallel) observe(obs ParallelObservation) {
+	obs.Streams = atomic.LoadInt64(&h.streams)
+	h.policy.Observe(obs)
+	h.sync()
 }
 
 func (h *hostParallel) incParallel() {
-	idx := int(time.Now().Unix() % int64(h.p.periods+ExtraCachePeriods))
-	atomic.AddInt64(&h.ringCounter[idx], 1)
-	count := atomic.AddInt64(&h.count, 1)
-
-	streams := atomic.LoadInt64(&h.streams)
-	if streams != 0 && float64(count)/float64(streams) >= h.p.rate {
-		h.setParallel()
-	}
+	h.observe(ParallelObservation{Parallel: true})
 }
 
 func (h *hostParallel) inc() {
-	atomic.AddInt64(&h.streams, 1)
+	if atomic.AddInt64(&h.streams, 1) == 1 {
+		atomic.StoreInt64(&h.idleSince, 0)
+	}
 }
 
 func (h *hostParallel) dec() {
-	atomic.AddInt64(&h.streams, -1)
+	if atomic.AddInt64(&h.streams, -1) == 0 {
+		atomic.StoreInt64(&h.idleSince, time.Now().UnixNano())
+	}
 }
 
-func (h *hostParallel) update() {
-	for {
-		nowDecT := time.Now().Add(-time.Duration(h.p.periods) * time.Second).Unix()
-		if nowDecT-h.lastDecT > ExtraCachePeriods {
-			Logf(ERROR, "hostParallel::update dec count delay. host:%v nowDecT:%v lastDecT:%v", h.host, nowDecT, h.lastDecT)
-			h.reset()
-			continue
-		}
-
-		for t := h.lastDecT + 1; t <= nowDecT; t++ {
-			idx := t % int64(h.p.periods+ExtraCachePeriods)
-			count := atomic.LoadInt64(&h.ringCounter[idx])
-			atomic.AddInt64(&h.ringCounter[idx], -count)
-			atomic.AddInt64(&h.count, -count)
-		}
-		h.lastDecT = nowDecT
-
-		expire := atomic.LoadInt64(&h.expire)
-		if expire != 0 && time.Now().UnixNano() >= expire {
-			h.unsetParallel()
-		}
-
-		time.Sleep(time.Duration(UpdateIntervalMs) * time.Millisecond)
+// idle reports if h has had no streams for timeout
+func (h *hostParallel) idle(now time.Time, timeout time.Duration) bool {
+	if atomic.LoadInt64(&h.streams) > 0 {
+		return false
 	}
+	since := atomic.LoadInt64(&h.idleSince)
+	return since != 0 && now.UnixNano()-since >= int64(timeout)
+}
+
+func (h *hostParallel) state() ParallelState {
+	state := h.policy.State()
+	state.Host = h.host
+	state.Streams = atomic.LoadInt64(&h.streams)
+	return state
 }
@@ -24,10 +24,13 @@ func incParallel(hp *hostParallel, count int) {
 }
 
 func TestHostParallel(t *testing.T) {
+	defer func(extra int64) { ExtraCachePeriods = extra }(ExtraCachePeriods)
 	ExtraCachePeriods = 2
 
-	pc := newParallelCtrl(2, 0.2, time.Second)
+	pc := newParallelCtrl(func(string) ParallelPolicy { return NewRingParallelPolicy(2, 0.2, time.Second) }, time.Minute, DefaultSnmp)
+	defer pc.close()
 	hp := pc.getHostParallel("host1")
+	rp := hp.policy.(*RingParallelPolicy)
 
 	hp.reset()
 
@@ -46,7 +49,7 @@ func TestHostParallel(t *testing.T) {
 	time.Sleep(time.Second)
 	incParallel(hp, 5)
 
-	count := atomic.LoadInt64(&hp.count)
+	count := atomic.LoadInt64(&rp.count)
 	if count > 15 {
 		t.Fatal("parallel count")
 	}
@@ -73,9 +76,139 @@ func TestHostParallel(t *testing.T) {
 		incParallel(hp, 5)
 		time.Sleep(time.Second)
 
-		count := atomic.LoadInt64(&hp.count)
+		count := atomic.LoadInt64(&rp.count)
 		if count > 20 {
 			t.Fatal("parallel count")
 		}
 	}
 }
+
+func TestLossParallelPolicy(t *testing.T) {
+	p := NewLossParallelPolicy(0.01, 3)
+	if p.Level() != 1 {
+		t.Fatalf("initial level. level:%v", p.Level())
+	}
+
+	// a clean host keeps one path
+	for i := 0; i < 100; i++ {
+		p.Observe(ParallelObservation{Sent: 10, RTT: time.Millisecond * 20})
+	}
+	if state := p.State(); state.Level != 1 || state.Loss != 0 || state.RTT != time.Millisecond*20 {
+		t.Fatalf("clean host. state:%+v", state)
+	}
+
+	// fast retransmissions alone are no loss
+	for i := 0; i < 100; i++ {
+		p.Observe(ParallelObservation{Sent: 10, Retrans: 3})
+	}
+	if state := p.State(); state.Level != 1 || state.Loss != 0 {
+		t.Fatalf("fast retransmissions. state:%+v", state)
+	}
+
+	// 5% of timeouts ask for a second path, 20% for a third
+	for i := 0; i < 100; i++ {
+		p.Observe(ParallelObservation{Sent: 20, Retrans: 1, Lost: 1})
+	}
+	if level := p.Level(); level != 2 {
+		t.Fatalf("level at 5%% loss. level:%v loss:%v", level, p.State().Loss)
+	}
+	for i := 0; i < 100; i++ {
+		p.Observe(ParallelObservation{Sent: 10, Retrans: 2, Lost: 2})
+	}
+	if level := p.Level(); level != 3 {
+		t.Fatalf("level at 20%% loss. level:%v loss:%v", level, p.State().Loss)
+	}
+
+	// the level comes down once the loss is gone
+	for i := 0; i < 100; i++ {
+		p.Observe(ParallelObservation{Sent: 10})
+	}
+	if level := p.Level(); level != 1 {
+		t.Fatalf("level after loss. level:%v loss:%v", level, p.State().Loss)
+	}
+
+	p.Observe(ParallelObservation{Sent: 1, Retrans: 1, Lost: 1})
+	p.Reset()
+	if state := p.State(); state.Level != 1 || state.Loss != 0 {
+		t.Fatalf("reset. state:%+v", state)
+	}
+}
+
+func TestParallelStates(t *testing.T) {
+	pc := newParallelCtrl(func(string) ParallelPolicy { return NewLossParallelPolicy(0, 0) }, time.Minute, DefaultSnmp)
+	defer pc.close()
+	hp := pc.getHostParallel("10.0.0.2")
+	pc.getHostParallel("10.0.0.1")
+	inc(hp, 2)
+	for i := 0; i < 100; i++ {
+		hp.observe(ParallelObservation{Sent: 10, Retrans: 3, Lost: 3})
+	}
+	if !hp.isParallel() || hp.levelPaths() != DefaultParallelMaxLevel {
+		t.Fatalf("host level. level:%v", hp.levelPaths())
+	}
+
+	states := pc.states()
+	if len(states) != 2 || states[0].Host != "10.0.0.1" || states[0].Level != 1 {
+		t.Fatalf("states. %+v", states)
+	}
+	if states[1].Host != "10.0.0.2" || states[1].Streams != 2 || states[1].Level != DefaultParallelMaxLevel || states[1].Loss < 0.2 {
+		t.Fatalf("lossy host state. %+v", states[1])
+	}
+
+	// first transmissions of data follow the host level
+	info := PacketInfo{Kind: PacketData, XmitMax: 1, Paths: 4, Level: hp.levelPaths()}
+	if paths := (SelectiveDuplication{}).Paths(info); paths != DefaultParallelMaxLevel {
+		t.Fatalf("selective paths. paths:%v", paths)
+	}
+}
+
+func TestHostParallelEviction(t *testing.T) {
+	hosts := atomic.LoadUint64(&DefaultSnmp.ParallelHosts)
+	activations := atomic.LoadUint64(&DefaultSnmp.HostParallels)
+	pc := newParallelCtrl(func(string) ParallelPolicy { return NewLossParallelPolicy(0, 0) }, time.Millisecond*300, DefaultSnmp)
+
+	busy := pc.acquire("10.0.0.1")
+	idle := pc.acquire("10.0.0.2")
+	if got := atomic.LoadUint64(&DefaultSnmp.ParallelHosts) - hosts; got != 2 {
+		t.Fatalf("live hosts. hosts:%v", got)
+	}
+	for i := 0; i < 100; i++ {
+		busy.observe(ParallelObservation{Sent: 10, Retrans: 3, Lost: 3})
+	}
+	if atomic.LoadUint64(&DefaultSnmp.HostParallels) == activations {
+		t.Fatal("host activation not counted")
+	}
+
+	// the host without streams goes after the idle time
+	pc.release(idle)
+	deadline := time.Now().Add(time.Second * 2)
+	for {
+		states := pc.states()
+		if len(states) == 1 {
+			if states[0].Host != "10.0.0.1" || states[0].Streams != 1 {
+				t.Fatalf("busy host evicted. states:%+v", states)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("idle host kept. states:%+v", states)
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	if got := atomic.LoadUint64(&DefaultSnmp.ParallelHosts) - hosts; got != 1 {
+		t.Fatalf("live hosts after eviction. hosts:%v", got)
+	}
+
+	// a new stream of an evicted host starts over
+	if hp := pc.acquire("10.0.0.2"); hp == idle || hp.streams != 1 {
+		t.Fatal("evicted host reused")
+	}
+
+	pc.close()
+	if got := atomic.LoadUint64(&DefaultSnmp.ParallelHosts); got != hosts {
+		t.Fatalf("live hosts after close. hosts:%v want:%v", got, hosts)
+	}
+	if pc.acquire("10.0.0.3") != nil {
+		t.Fatal("acquire after close")
+	}
+}
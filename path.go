@@ -0,0 +1,369 @@
+package kcp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+var (
+	errPathParam       = errors.New("err path param")
+	errPathState       = errors.New("err path state")
+	errPathUnsupported = errors.New("err path unsupported")
+)
+
+var (
+	DefaultPathTimeout = time.Duration(0) // silent paths are removed after this long, 0 keeps them
+)
+
+// operations of PATH
+const (
+	pathAdd    = 1 // the sender adds a path, the receiver sends to the endpoint in tlvLocal
+	pathRemove = 2
+)
+
+// pendingPath is a path added locally, it carries packets once the peer has acknowledged PATH
+type pendingPath struct {
+	id     uint32
+	sn     uint32 // of PATH
+	tunnel *UDPTunnel
+	remote *net.UDPAddr
+}
+
+// AddPath adds a path to an established stream, sending from the tunnel the selector picks
+// for remote to remote. local is the endpoint the peer sends to on this path. The path
+// carries packets once the peer has acknowledged it.
+func (s *UDPStream) AddPath(local, remote string) error {
+	Logf(INFO, "UDPStream::AddPath uuid:%v accepted:%v local:%v remote:%v", s.uuid, s.accepted, local, remote)
+
+	remoteAddr, err := net.ResolveUDPAddr("udp", remote)
+	if err != nil {
+		return err
+	}
+	tunnels := s.sel.Pick([]string{remote})
+	if len(tunnels) != 1 {
+		return errTunnelPick
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.pathUpdatable(); err != nil {
+		return err
+	}
+	for i := range s.tunnels {
+		if s.tunnels[i] == tunnels[0] && sameUDPAddr(s.remotes[i], remoteAddr) {
+			return errPathParam
+		}
+	}
+	for _, p := range s.pendingPaths {
+		if p.tunnel == tunnels[0] && sameUDPAddr(p.remote, remoteAddr) {
+			return errPathParam
+		}
+	}
+
+	id := s.nextPathID
+	if id%2 != s.pathParity() {
+		id++
+	}
+	s.nextPathID = id + 1
+	sn := s.sendControl(PATH, controlFrame(tlv{tlvPath, pathOp(pathAdd, id)}, tlv{tlvLocal, []byte(local)}))
+	s.pendingPaths = append(s.pendingPaths, &pendingPath{id: id, sn: sn, tunnel: tunnels[0], remote: remoteAddr})
+	s.notifyFlushEvent(true)
+	return nil
+}
+
+// RemovePath removes the path of an established stream whose tunnel is bound to local and
+// which sends to remote, the last path cannot be removed
+func (s *UDPStream) RemovePath(local, remote string) error {
+	Logf(INFO, "UDPStream::RemovePath uuid:%v accepted:%v local:%v remote:%v", s.uuid, s.accepted, local, remote)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.pathUpdatable(); err != nil {
+		return err
+	}
+	for i := range s.tunnels {
+		if s.locals[i].String() == local && s.remotes[i].String() == remote {
+			if len(s.tunnels) == 1 {
+				return errPathParam
+			}
+			s.dropPath(i)
+			s.notifyFlushEvent(true)
+			return nil
+		}
+	}
+	return errPathParam
+}
+
+// SetPathTimeout removes a path once nothing has been received on it for timeout, the path
+// is probed when it has been idle for a quarter of timeout. 0 disables removal.
+func (s *UDPStream) SetPathTimeout(timeout time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pathTimeout = timeout
+	s.pathCheckGen++
+	if timeout > 0 {
+		gen := s.pathCheckGen
+		SystemTimedSched.Put(func() { s.checkPaths(gen) }, time.Now().Add(timeout/4))
+	}
+}
+
+func (s *UDPStream) pathUpdatable() error {
+	if s.state != StateEstablish && s.state != StateCloseWait {
+		return errPathState
+	} else if s.peerCaps&CapPathUpdate == 0 {
+		return errPathUnsupported
+	}
+	return nil
+}
+
+// pathParity keeps the path ids of both ends apart, the dialer allocates even ids
+func (s *UDPStream) pathParity() uint32 {
+	if s.accepted {
+		return 1
+	}
+	return 0
+}
+
+func pathOp(op byte, id uint32) []byte {
+	var buf [5]byte
+	buf[0] = op
+	binary.LittleEndian.PutUint32(buf[1:], id)
+	return buf[:]
+}
+
+func sameUDPAddr(a, b *net.UDPAddr) bool {
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
+
+// resetPaths numbers the paths in SYN order, both ends agree on them
+func (s *UDPStream) resetPaths() {
+	now := time.Now()
+	s.pathIDs = make([]uint32, len(s.tunnels))
+	s.pathRecv = make([]time.Time, len(s.tunnels))
+	s.health = make([]*pathHealth, len(s.tunnels))
+	s.traffic = make([]*pathTraffic, len(s.tunnels))
+	for i := range s.pathIDs {
+		s.pathIDs[i] = uint32(i)
+		s.pathRecv[i] = now
+		s.health[i] = &pathHealth{}
+		s.traffic[i] = &pathTraffic{}
+	}
+	s.nextPathID = uint32(len(s.tunnels))
+}
+
+// sendControl queues a control frame fitting in one segment and returns its sn, s.mu must be held
+func (s *UDPStream) sendControl(flag byte, body []byte) uint32 {
+	sn := s.kcp.snd_nxt + uint32(len(s.kcp.snd_queue))
+	s.sendbuf[0] = flag
+	copy(s.sendbuf[1:], body)
+	s.kcp.Send(s.sendbuf[:1+len(body)])
+	return sn
+}
+
+// appendPath starts sending on a path. The path slices may be shared with the selector
+// or a running flush, they are never modified in place. s.mu must be held.
+func (s *UDPStream) appendPath(id uint32, tunnel *UDPTunnel, remote *net.UDPAddr) {
+	Logf(INFO, "UDPStream::appendPath uuid:%v accepted:%v id:%v local:%v remote:%v", s.uuid, s.accepted, id, tunnel.LocalAddr(), remote)
+
+	n := len(s.tunnels)
+	tunnels := make([]*UDPTunnel, n, n+1)
+	locals := make([]*net.UDPAddr, n, n+1)
+	remotes := make([]*net.UDPAddr, n, n+1)
+	ids := make([]uint32, n, n+1)
+	recv := make([]time.Time, n, n+1)
+	health := make([]*pathHealth, n, n+1)
+	traffic := make([]*pathTraffic, n, n+1)
+	copy(tunnels, s.tunnels)
+	copy(locals, s.locals)
+	copy(remotes, s.remotes)
+	copy(ids, s.pathIDs)
+	copy(recv, s.pathRecv)
+	copy(health, s.health)
+	copy(traffic, s.traffic)
+	s.tunnels = append(tunnels, tunnel)
+	s.locals = append(locals, tunnel.LocalAddr())
+	s.remotes = append(remotes, remote)
+	s.pathIDs = append(ids, id)
+	s.pathRecv = append(recv, time.Now())
+	s.health = append(health, &pathHealth{})
+	s.traffic = append(traffic, &pathTraffic{})
+}
+
+// removePath stops sending on path i, packets queued to it are dropped. s.mu must be held.
+func (s *UDPStream) removePath(i int) {
+	Logf(INFO, "UDPStream::removePath uuid:%v accepted:%v id:%v local:%v remote:%v", s.uuid, s.accepted, s.pathIDs[i], s.locals[i], s.remotes[i])
+
+	n := len(s.tunnels) - 1
+	tunnels := make([]*UDPTunnel, 0, n)
+	locals := make([]*net.UDPAddr, 0, n)
+	remotes := make([]*net.UDPAddr, 0, n)
+	ids := make([]uint32, 0, n)
+	recv := make([]time.Time, 0, n)
+	health := make([]*pathHealth, 0, n)
+	traffic := make([]*pathTraffic, 0, n)
+	s.tunnels = append(append(tunnels, s.tunnels[:i]...), s.tunnels[i+1:]...)
+	s.locals = append(append(locals, s.locals[:i]...), s.locals[i+1:]...)
+	s.remotes = append(append(remotes, s.remotes[:i]...), s.remotes[i+1:]...)
+	s.pathIDs = append(append(ids, s.pathIDs[:i]...), s.pathIDs[i+1:]...)
+	s.pathRecv = append(append(recv, s.pathRecv[:i]...), s.pathRecv[i+1:]...)
+	s.health = append(append(health, s.health[:i]...), s.health[i+1:]...)
+	s.traffic = append(append(traffic, s.traffic[:i]...), s.traffic[i+1:]...)
+
+	if i < len(s.msgss) {
+		for _, msg := range s.msgss[i] {
+			xmitBuf.Put(msg.Buffers[0])
+		}
+		s.msgss = append(s.msgss[:i], s.msgss[i+1:]...)
+	}
+	if i < len(s.pacers) {
+		pacers := make([]*pacer, 0, len(s.pacers)-1)
+		s.pacers = append(append(pacers, s.pacers[:i]...), s.pacers[i+1:]...)
+	}
+	s.removeStripePath(i)
+	if len(s.challenges) > 0 {
+		challenges := make(map[int]*pathChallenge)
+		for path, c := range s.challenges {
+			if path > i {
+				challenges[path-1] = c
+			} else if path < i {
+				challenges[path] = c
+			}
+		}
+		s.challenges = challenges
+	}
+}
+
+// dropPath removes path i and tells the peer, s.mu must be held
+func (s *UDPStream) dropPath(i int) {
+	id := s.pathIDs[i]
+	s.removePath(i)
+	if s.state == StateEstablish || s.state == StateCloseWait {
+		s.sendControl(PATH, controlFrame(tlv{tlvPath, pathOp(pathRemove, id)}))
+	}
+}
+
+// activatePaths starts sending on the added paths the peer has acknowledged, s.mu must be held
+func (s *UDPStream) activatePaths() {
+	pending := s.pendingPaths[:0]
+	for _, p := range s.pendingPaths {
+		if _itimediff(s.kcp.snd_una, p.sn) > 0 {
+			s.appendPath(p.id, p.tunnel, p.remote)
+		} else {
+			pending = append(pending, p)
+		}
+	}
+	s.pendingPaths = pending
+}
+
+// inputControl consumes PATH delivered in order by the last input, paths change even if the
+// application does not Read. PATH delivered by Recv is handled by cmdRead. s.mu must be held.
+func (s *UDPStream) inputControl(delivered int) {
+	q := s.kcp.rcv_queue
+	for k := delivered; k < len(q); {
+		seg := &q[k]
+		// a message of one segment
+		if seg.frg == 0 && (k == 0 || q[k-1].frg == 0) && len(seg.data) > 0 && seg.data[0] == PATH {
+			s.recvPath(seg.data[1:])
+			s.kcp.delSegment(seg)
+			q = append(q[:k], q[k+1:]...)
+			continue
+		}
+		k++
+	}
+	s.kcp.rcv_queue = q
+}
+
+func (s *UDPStream) recvPath(data []byte) (n int, err error) {
+	tlvs, err := decodeControl(data)
+	if err != nil {
+		Logf(WARN, "UDPStream::recvPath uuid:%v accepted:%v err:%v", s.uuid, s.accepted, err)
+		return len(data), err
+	}
+
+	var op []byte
+	var local string
+	for _, t := range tlvs {
+		switch t.typ {
+		case tlvPath:
+			op = t.value
+		case tlvLocal:
+			local = string(t.value)
+		}
+	}
+	if len(op) != 5 {
+		return len(data), errControlFrame
+	}
+	id := binary.LittleEndian.Uint32(op[1:])
+	Logf(INFO, "UDPStream::recvPath uuid:%v accepted:%v op:%v id:%v local:%v", s.uuid, s.accepted, op[0], id, local)
+
+	switch op[0] {
+	case pathAdd:
+		for _, pid := range s.pathIDs {
+			if pid == id {
+				return len(data), nil
+			}
+		}
+		remoteAddr, err := net.ResolveUDPAddr("udp", local)
+		if err != nil {
+			return len(data), nil
+		}
+		tunnels := s.sel.Pick([]string{local})
+		if len(tunnels) != 1 {
+			return len(data), nil
+		}
+		s.appendPath(id, tunnels[0], remoteAddr)
+	case pathRemove:
+		for i, pid := range s.pathIDs {
+			if pid == id && len(s.tunnels) > 1 {
+				s.removePath(i)
+				break
+			}
+		}
+	}
+	return len(data), nil
+}
+
+// checkPaths removes the paths silent for the path timeout and probes the idle ones,
+// it runs on SystemTimedSched until the stream is closed or the timeout changed
+func (s *UDPStream) checkPaths(gen uint32) {
+	select {
+	case <-s.chClose:
+		return
+	case <-s.chRst:
+		return
+	default:
+	}
+
+	s.mu.Lock()
+	timeout := s.pathTimeout
+	if gen != s.pathCheckGen {
+		s.mu.Unlock()
+		return
+	}
+	probed := false
+	if s.state >= StateEstablish && s.state != StateClosed {
+		now := time.Now()
+		for i := len(s.tunnels) - 1; i >= 0; i-- {
+			idle := now.Sub(s.pathRecv[i])
+			if idle > timeout && len(s.tunnels) > 1 {
+				Logf(WARN, "UDPStream::checkPaths silent path removed. uuid:%v accepted:%v local:%v remote:%v idle:%v", s.uuid, s.accepted, s.locals[i], s.remotes[i], idle)
+				s.dropPath(i)
+			} else if idle > timeout/4 {
+				token := make([]byte, pathTokenSize)
+				if _, err := rand.Read(token); err == nil {
+					s.queueProbe(i, s.remotes[i], token)
+					probed = true
+				}
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	if probed {
+		s.notifyFlushEvent(true)
+	}
+	SystemTimedSched.Put(func() { s.checkPaths(gen) }, time.Now().Add(timeout/4))
+}
@@ -0,0 +1,76 @@
+package kcp
+
+import (
+	"testing"
+	"time"
+)
+
+func waitPaths(t *testing.T, stream *UDPStream, want int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 2)
+	for len(stream.RemoteAddrs()) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("paths not reached. uuid:%v accepted:%v remotes:%v want:%v", stream.GetUUID(), stream.accepted, stream.RemoteAddrs(), want)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestAddRemovePath(t *testing.T) {
+	lAddrs := []string{"127.0.0.1:7331", "127.0.0.1:27331"}
+	rAddrs := []string{"127.0.0.1:17331", "127.0.0.1:37331"}
+	client, server := newTransportPair(t, lAddrs, rAddrs, nil, nil)
+	dialer, acceptor := openPair(t, client, server, lAddrs, rAddrs, 1, true)
+	defer client.Close()
+	defer server.Close()
+	defer dialer.Close()
+
+	if err := dialer.RemovePath(lAddrs[0], rAddrs[0]); err != errPathParam {
+		t.Fatalf("last path removed. err:%v", err)
+	}
+	if err := dialer.AddPath(lAddrs[0], rAddrs[0]); err != errPathParam {
+		t.Fatalf("duplicate path added. err:%v", err)
+	}
+
+	checkError(t, dialer.AddPath(lAddrs[1], rAddrs[1]))
+	waitPaths(t, dialer, 2)
+	waitPaths(t, acceptor, 2)
+	if remotes := acceptor.RemoteAddrs(); remotes[1].String() != lAddrs[1] {
+		t.Fatalf("acceptor path. remotes:%v", remotes)
+	}
+	if locals := acceptor.LocalAddrs(); locals[1].String() != rAddrs[1] {
+		t.Fatalf("acceptor path. locals:%v", locals)
+	}
+
+	// the first path goes away, the stream carries on over the added one
+	checkError(t, dialer.RemovePath(lAddrs[0], rAddrs[0]))
+	waitPaths(t, dialer, 1)
+	waitPaths(t, acceptor, 1)
+	if remotes := acceptor.RemoteAddrs(); remotes[0].String() != lAddrs[1] {
+		t.Fatalf("acceptor path removed. remotes:%v", remotes)
+	}
+	checkError(t, echoTester(dialer, 1024, 4))
+}
+
+func TestSilentPath(t *testing.T) {
+	lAddrs := []string{"127.0.0.1:7341", "127.0.0.1:27341"}
+	rAddrs := []string{"127.0.0.1:17341", "127.0.0.1:37341"}
+	timeout := time.Millisecond * 400
+	client, server := newTransportPair(t, lAddrs, rAddrs, nil, &TransportOption{StreamOption: &StreamOption{PathTimeout: timeout}})
+	dialer, acceptor := openPair(t, client, server, lAddrs, rAddrs, 2, true)
+	defer client.Close()
+	defer server.Close()
+	defer dialer.Close()
+
+	// an idle path is kept alive by probes
+	time.Sleep(timeout * 2)
+	if remotes := acceptor.RemoteAddrs(); len(remotes) != 2 {
+		t.Fatalf("idle path removed. remotes:%v", remotes)
+	}
+
+	// the second path of the dialer goes down, the acceptor removes it and tells the dialer
+	client.sel.Pick(rAddrs[1:])[0].Close()
+	waitPaths(t, acceptor, 1)
+	waitPaths(t, dialer, 1)
+	checkError(t, echoTester(dialer, 1024, 4))
+}
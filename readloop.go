@@ -1,8 +1,6 @@
 package kcp
 
 import (
-	"sync/atomic"
-
 	gouuid "github.com/satori/go.uuid"
 )
 
@@ -20,7 +18,7 @@ func (t *UDPTunnel) defaultReadLoop() {
 				t.input(buf[:n], from)
 				buf = xmitBuf.Get().([]byte)[:mtuLimit]
 			} else {
-				atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+				t.snmp.add(func(m *Snmp) *uint64 { return &m.InErrs }, 1)
 			}
 		} else {
 			t.notifyReadError(err)
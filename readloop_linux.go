@@ -5,7 +5,6 @@ package kcp
 import (
 	"net"
 	"os"
-	"sync/atomic"
 
 	gouuid "github.com/satori/go.uuid"
 	"golang.org/x/net/ipv4"
@@ -39,7 +38,7 @@ func (t *UDPTunnel) readLoop() {
 					t.input(msg.Buffers[0][:msg.N], msg.Addr)
 					msg.Buffers[0] = xmitBuf.Get().([]byte)[:mtuLimit]
 				} else {
-					atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+					t.snmp.add(func(m *Snmp) *uint64 { return &m.InErrs }, 1)
 				}
 			}
 		} else {
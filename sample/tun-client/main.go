@@ -159,31 +159,6 @@ func (poll *TunnelPoll) Pick() (tunnel *kcp.UDPTunnel) {
 	return poll.tunnels[idx]
 }
 
-type TestSelector struct {
-	remoteAddrs []net.Addr
-	tunnels     []*kcp.UDPTunnel
-	idx         uint32
-}
-
-func NewTestSelector() (*TestSelector, error) {
-	return &TestSelector{
-		tunnels: make([]*kcp.UDPTunnel, 0),
-	}, nil
-}
-
-func (sel *TestSelector) Add(tunnel *kcp.UDPTunnel) {
-	sel.tunnels = append(sel.tunnels, tunnel)
-}
-
-func (sel *TestSelector) Pick(remotes []string) (tunnels []*kcp.UDPTunnel) {
-	for i := 0; i < len(remotes); i++ {
-		idx := sel.idx % uint32(len(sel.tunnels))
-		atomic.AddUint32(&sel.idx, 1)
-		tunnels = append(tunnels, sel.tunnels[idx])
-	}
-	return tunnels
-}
-
 // handleClient aggregates connection p1 on mux with 'writeLock'
 func handleClient(s *kcp.UDPStream, conn *net.TCPConn) {
 	kcp.Logf(kcp.INFO, "handleClient start stream:%v remote:%v", s.GetUUID(), conn.RemoteAddr())
@@ -468,9 +443,7 @@ func main() {
 			TunnelProcessor: tunnelProcessorCount,
 		}
 
-		sel, err := NewTestSelector()
-		checkError(err)
-		transport, err := kcp.NewUDPTransport(sel, opt)
+		transport, err := kcp.NewUDPTransport(kcp.NewRoundRobinSelector(), opt)
 		checkError(err)
 		for portS := localPortS; portS <= localPortE; portS++ {
 			tunnel, err := transport.NewTunnel(localIp + ":" + strconv.Itoa(portS))
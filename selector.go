@@ -0,0 +1,316 @@
+package kcp
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	DefaultHashReplicas   = 64 // points of each tunnel on the ring of HashSelector
+	DefaultSelectorWeight = 1  // weight of a tunnel WeightedSelector has no weight for
+)
+
+// tunnelSet is the tunnels of a selector. Pick takes a snapshot, Add and Remove replace it.
+type tunnelSet struct {
+	mu      sync.RWMutex
+	tunnels []*UDPTunnel
+}
+
+func (ts *tunnelSet) add(tunnel *UDPTunnel) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for _, t := range ts.tunnels {
+		if t == tunnel {
+			return false
+		}
+	}
+	tunnels := make([]*UDPTunnel, len(ts.tunnels), len(ts.tunnels)+1)
+	copy(tunnels, ts.tunnels)
+	ts.tunnels = append(tunnels, tunnel)
+	return true
+}
+
+func (ts *tunnelSet) remove(tunnel *UDPTunnel) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for i, t := range ts.tunnels {
+		if t == tunnel {
+			tunnels := make([]*UDPTunnel, 0, len(ts.tunnels)-1)
+			ts.tunnels = append(append(tunnels, ts.tunnels[:i]...), ts.tunnels[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (ts *tunnelSet) snapshot() []*UDPTunnel {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return ts.tunnels
+}
+
+// pickFrom returns a tunnel for each remote, walking tunnels from start so that
+// the paths of a stream use distinct tunnels while there are enough of them
+func pickFrom(tunnels []*UDPTunnel, start int, count int) []*UDPTunnel {
+	if len(tunnels) == 0 {
+		return nil
+	}
+	picked := make([]*UDPTunnel, count)
+	for i := range picked {
+		picked[i] = tunnels[(start+i)%len(tunnels)]
+	}
+	return picked
+}
+
+// RoundRobinSelector picks tunnels in turn
+type RoundRobinSelector struct {
+	set  tunnelSet
+	next uint32
+}
+
+func NewRoundRobinSelector() *RoundRobinSelector {
+	return &RoundRobinSelector{}
+}
+
+func (sel *RoundRobinSelector) Add(tunnel *UDPTunnel)    { sel.set.add(tunnel) }
+func (sel *RoundRobinSelector) Remove(tunnel *UDPTunnel) { sel.set.remove(tunnel) }
+
+func (sel *RoundRobinSelector) Pick(remotes []string) (tunnels []*UDPTunnel) {
+	all := sel.set.snapshot()
+	if len(all) == 0 {
+		return nil
+	}
+	next := atomic.AddUint32(&sel.next, uint32(len(remotes))) - uint32(len(remotes))
+	return pickFrom(all, int(next%uint32(len(all))), len(remotes))
+}
+
+// RandomSelector picks tunnels at random, distinct for the paths of a stream while there are enough of them
+type RandomSelector struct {
+	set tunnelSet
+}
+
+func NewRandomSelector() *RandomSelector {
+	return &RandomSelector{}
+}
+
+func (sel *RandomSelector) Add(tunnel *UDPTunnel)    { sel.set.add(tunnel) }
+func (sel *RandomSelector) Remove(tunnel *UDPTunnel) { sel.set.remove(tunnel) }
+
+func (sel *RandomSelector) Pick(remotes []string) (tunnels []*UDPTunnel) {
+	all := sel.set.snapshot()
+	if len(all) == 0 {
+		return nil
+	}
+	perm := rand.Perm(len(all))
+	tunnels = make([]*UDPTunnel, len(remotes))
+	for i := range tunnels {
+		tunnels[i] = all[perm[i%len(perm)]]
+	}
+	return tunnels
+}
+
+// HashSelector picks the tunnel of a remote address on a consistent hash ring, a remote
+// keeps its tunnel as long as it exists and only the remotes of a removed tunnel move
+type HashSelector struct {
+	mu       sync.RWMutex
+	replicas int
+	tunnels  []*UDPTunnel
+	ring     []hashPoint // sorted by hash
+}
+
+type hashPoint struct {
+	hash   uint32
+	tunnel *UDPTunnel
+}
+
+// NewHashSelector creates a ring with replicas points per tunnel, 0 means DefaultHashReplicas
+func NewHashSelector(replicas int) *HashSelector {
+	if replicas <= 0 {
+		replicas = DefaultHashReplicas
+	}
+	return &HashSelector{replicas: replicas}
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+func (sel *HashSelector) Add(tunnel *UDPTunnel) {
+	sel.mu.Lock()
+	defer sel.mu.Unlock()
+	for _, t := range sel.tunnels {
+		if t == tunnel {
+			return
+		}
+	}
+	sel.tunnels = append(sel.tunnels, tunnel)
+	sel.build()
+}
+
+func (sel *HashSelector) Remove(tunnel *UDPTunnel) {
+	sel.mu.Lock()
+	defer sel.mu.Unlock()
+	for i, t := range sel.tunnels {
+		if t == tunnel {
+			sel.tunnels = append(sel.tunnels[:i], sel.tunnels[i+1:]...)
+			sel.build()
+			return
+		}
+	}
+}
+
+// build places every tunnel on a new ring by its local address, sel.mu must be held
+func (sel *HashSelector) build() {
+	ring := make([]hashPoint, 0, len(sel.tunnels)*sel.replicas)
+	for _, t := range sel.tunnels {
+		local := t.LocalAddr().String()
+		for i := 0; i < sel.replicas; i++ {
+			ring = append(ring, hashPoint{hashKey(strconv.Itoa(i) + "#" + local), t})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	sel.ring = ring
+}
+
+func (sel *HashSelector) Pick(remotes []string) (tunnels []*UDPTunnel) {
+	sel.mu.RLock()
+	defer sel.mu.RUnlock()
+	if len(sel.ring) == 0 {
+		return nil
+	}
+	tunnels = make([]*UDPTunnel, len(remotes))
+	for i, remote := range remotes {
+		h := hashKey(remote)
+		k := sort.Search(len(sel.ring), func(k int) bool { return sel.ring[k].hash >= h })
+		if k == len(sel.ring) {
+			k = 0
+		}
+		tunnels[i] = sel.ring[k].tunnel
+	}
+	return tunnels
+}
+
+// WeightedSelector picks tunnels in proportion to their weights, spreading the picks of
+// a heavy tunnel evenly as the smooth weighted round robin of nginx does
+type WeightedSelector struct {
+	mu      sync.Mutex
+	weights map[string]int // by local address
+	tunnels []*weightedTunnel
+}
+
+type weightedTunnel struct {
+	tunnel  *UDPTunnel
+	weight  int
+	current int
+}
+
+// NewWeightedSelector creates a selector with the weights of tunnels by local address,
+// a tunnel missing from weights has DefaultSelectorWeight
+func NewWeightedSelector(weights map[string]int) *WeightedSelector {
+	sel := &WeightedSelector{weights: make(map[string]int)}
+	for local, weight := range weights {
+		sel.weights[local] = weight
+	}
+	return sel
+}
+
+func (sel *WeightedSelector) Add(tunnel *UDPTunnel) {
+	sel.mu.Lock()
+	defer sel.mu.Unlock()
+	for _, wt := range sel.tunnels {
+		if wt.tunnel == tunnel {
+			return
+		}
+	}
+	weight, ok := sel.weights[tunnel.LocalAddr().String()]
+	if !ok {
+		weight = DefaultSelectorWeight
+	}
+	sel.tunnels = append(sel.tunnels, &weightedTunnel{tunnel: tunnel, weight: weight})
+}
+
+func (sel *WeightedSelector) Remove(tunnel *UDPTunnel) {
+	sel.mu.Lock()
+	defer sel.mu.Unlock()
+	for i, wt := range sel.tunnels {
+		if wt.tunnel == tunnel {
+			sel.tunnels = append(sel.tunnels[:i], sel.tunnels[i+1:]...)
+			return
+		}
+	}
+}
+
+// SetWeight changes the weight of the tunnel bound to local, 0 stops picking it
+func (sel *WeightedSelector) SetWeight(local string, weight int) {
+	sel.mu.Lock()
+	defer sel.mu.Unlock()
+	sel.weights[local] = weight
+	for _, wt := range sel.tunnels {
+		if wt.tunnel.LocalAddr().String() == local {
+			wt.weight = weight
+			wt.current = 0
+		}
+	}
+}
+
+func (sel *WeightedSelector) Pick(remotes []string) (tunnels []*UDPTunnel) {
+	sel.mu.Lock()
+	defer sel.mu.Unlock()
+	for range remotes {
+		var best *weightedTunnel
+		total := 0
+		for _, wt := range sel.tunnels {
+			if wt.weight <= 0 {
+				continue
+			}
+			wt.current += wt.weight
+			total += wt.weight
+			if best == nil || wt.current > best.current {
+				best = wt
+			}
+		}
+		if best == nil {
+			return nil
+		}
+		best.current -= total
+		tunnels = append(tunnels, best.tunnel)
+	}
+	return tunnels
+}
+
+// LeastLoadedSelector picks the tunnels with the fewest packets queued for sending
+type LeastLoadedSelector struct {
+	set tunnelSet
+}
+
+func NewLeastLoadedSelector() *LeastLoadedSelector {
+	return &LeastLoadedSelector{}
+}
+
+func (sel *LeastLoadedSelector) Add(tunnel *UDPTunnel)    { sel.set.add(tunnel) }
+func (sel *LeastLoadedSelector) Remove(tunnel *UDPTunnel) { sel.set.remove(tunnel) }
+
+func (sel *LeastLoadedSelector) Pick(remotes []string) (tunnels []*UDPTunnel) {
+	all := sel.set.snapshot()
+	if len(all) == 0 {
+		return nil
+	}
+	loads := make([]int, len(all))
+	order := make([]int, len(all))
+	for i, t := range all {
+		loads[i] = t.queued()
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return loads[order[i]] < loads[order[j]] })
+	tunnels = make([]*UDPTunnel, len(remotes))
+	for i := range tunnels {
+		tunnels[i] = all[order[i%len(order)]]
+	}
+	return tunnels
+}
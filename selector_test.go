@@ -0,0 +1,182 @@
+package kcp
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+func TestRoundRobinSelector(t *testing.T) {
+	sel := NewRoundRobinSelector()
+	if sel.Pick([]string{"a"}) != nil {
+		t.Fatal("pick without tunnels")
+	}
+	tunnels := selectorTunnels(3)
+	for _, tunnel := range tunnels {
+		sel.Add(tunnel)
+	}
+	sel.Add(tunnels[0])
+
+	// the paths of a stream get distinct tunnels
+	picked := sel.Pick([]string{"a", "b", "c"})
+	if picked[0] == picked[1] || picked[1] == picked[2] || picked[0] == picked[2] {
+		t.Fatalf("paths share a tunnel. picked:%v", picked)
+	}
+
+	counts := make(map[*UDPTunnel]int)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 300; i++ {
+				tunnel := sel.Pick([]string{"a"})[0]
+				mu.Lock()
+				counts[tunnel]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	for _, tunnel := range tunnels {
+		if counts[tunnel] != 400 {
+			t.Fatalf("uneven picks. tunnel:%v count:%v", tunnel.LocalAddr(), counts[tunnel])
+		}
+	}
+
+	sel.Remove(tunnels[1])
+	for i := 0; i < 10; i++ {
+		if sel.Pick([]string{"a"})[0] == tunnels[1] {
+			t.Fatal("removed tunnel picked")
+		}
+	}
+}
+
+func TestRandomSelector(t *testing.T) {
+	sel := NewRandomSelector()
+	tunnels := selectorTunnels(2)
+	for _, tunnel := range tunnels {
+		sel.Add(tunnel)
+	}
+	for i := 0; i < 20; i++ {
+		picked := sel.Pick([]string{"a", "b", "c"})
+		if len(picked) != 3 || picked[0] == picked[1] || picked[2] != picked[0] {
+			t.Fatalf("random pick. picked:%v", picked)
+		}
+	}
+	sel.Remove(tunnels[0])
+	if picked := sel.Pick([]string{"a"}); picked[0] != tunnels[1] {
+		t.Fatal("removed tunnel picked")
+	}
+}
+
+func TestHashSelector(t *testing.T) {
+	sel := NewHashSelector(0)
+	tunnels := selectorTunnels(4)
+	for _, tunnel := range tunnels {
+		sel.Add(tunnel)
+	}
+
+	remotes := make([]string, 200)
+	for i := range remotes {
+		remotes[i] = "10.0.0." + strconv.Itoa(i) + ":7000"
+	}
+	before := sel.Pick(remotes)
+	again := sel.Pick(remotes)
+	used := make(map[*UDPTunnel]bool)
+	for i := range remotes {
+		if before[i] != again[i] {
+			t.Fatalf("remote moved. remote:%v", remotes[i])
+		}
+		used[before[i]] = true
+	}
+	if len(used) != len(tunnels) {
+		t.Fatalf("tunnels unused. used:%v", len(used))
+	}
+
+	// only the remotes of the removed tunnel move
+	sel.Remove(tunnels[2])
+	after := sel.Pick(remotes)
+	for i := range remotes {
+		if after[i] == tunnels[2] || (before[i] != tunnels[2] && after[i] != before[i]) {
+			t.Fatalf("remote moved. remote:%v", remotes[i])
+		}
+	}
+}
+
+func TestWeightedSelector(t *testing.T) {
+	tunnels := selectorTunnels(3)
+	sel := NewWeightedSelector(map[string]int{tunnels[0].LocalAddr().String(): 3})
+	for _, tunnel := range tunnels {
+		sel.Add(tunnel)
+	}
+	counts := make(map[*UDPTunnel]int)
+	for _, tunnel := range sel.Pick(make([]string, 50)) {
+		counts[tunnel]++
+	}
+	if counts[tunnels[0]] != 30 || counts[tunnels[1]] != 10 || counts[tunnels[2]] != 10 {
+		t.Fatalf("weighted picks. counts:%v %v %v", counts[tunnels[0]], counts[tunnels[1]], counts[tunnels[2]])
+	}
+
+	sel.SetWeight(tunnels[0].LocalAddr().String(), 0)
+	sel.Remove(tunnels[1])
+	for _, tunnel := range sel.Pick(make([]string, 5)) {
+		if tunnel != tunnels[2] {
+			t.Fatalf("weighted pick. tunnel:%v", tunnel.LocalAddr())
+		}
+	}
+}
+
+func TestLeastLoadedSelector(t *testing.T) {
+	sel := NewLeastLoadedSelector()
+	tunnels := selectorTunnels(3)
+	for _, tunnel := range tunnels {
+		sel.Add(tunnel)
+	}
+	for i, depth := range []int{5, 1, 3} {
+		msgq := &MsgQueue{}
+		msgq.msgss[msgq.wIdx] = make([]ipv4.Message, depth)
+		tunnels[i].msgsm["127.0.0.1:7000"] = msgq
+	}
+	picked := sel.Pick([]string{"a", "b", "c", "d"})
+	if picked[0] != tunnels[1] || picked[1] != tunnels[2] || picked[2] != tunnels[0] || picked[3] != tunnels[1] {
+		t.Fatalf("least loaded picks. picked:%v", picked)
+	}
+}
+
+func TestSelectorRemoveClosed(t *testing.T) {
+	lAddrs := []string{"127.0.0.1:7361", "127.0.0.1:27361"}
+	sel := NewRoundRobinSelector()
+	transport, err := NewUDPTransport(sel, nil)
+	checkError(t, err)
+	defer transport.Close()
+	closed, err := transport.NewTunnel(lAddrs[0])
+	checkError(t, err)
+	_, err = transport.NewTunnel(lAddrs[1])
+	checkError(t, err)
+
+	closed.Close()
+	deadline := time.Now().Add(time.Second)
+	for len(sel.set.snapshot()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("closed tunnel not removed")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	for i := 0; i < 4; i++ {
+		if sel.Pick([]string{"a"})[0] == closed {
+			t.Fatal("closed tunnel picked")
+		}
+	}
+
+	// the address can be bound again
+	_, err = transport.NewTunnel(lAddrs[0])
+	checkError(t, err)
+	if len(sel.set.snapshot()) != 2 {
+		t.Fatal("tunnel not added again")
+	}
+}
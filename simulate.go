@@ -9,14 +9,32 @@ import (
 	"golang.org/x/net/ipv4"
 )
 
-var lossRand *rand.Rand
+var lossRand *lockedRand
 var timerSender *TimedSender
 
 func init() {
-	lossRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	lossRand = &lockedRand{r: rand.New(rand.NewSource(time.Now().UnixNano()))}
 	timerSender = NewTimedSender()
 }
 
+// lockedRand is a rand.Rand shared by the tunnels simulating loss
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func (l *lockedRand) Intn(n int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Intn(n)
+}
+
+func (l *lockedRand) Read(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Read(p)
+}
+
 type entry struct {
 	ts     time.Time
 	msg    ipv4.Message
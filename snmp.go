@@ -2,6 +2,7 @@ package kcp
 
 import (
 	"fmt"
+	"sync"
 	"sync/atomic"
 )
 
@@ -29,12 +30,106 @@ type Snmp struct {
 	LostSegs         uint64 // number of segs infered as lost
 	RepeatSegs       uint64 // number of segs duplicated
 	Parallels        uint64 // parallel count
+	PacedPkts        uint64 // packets deferred by pacing
+	FECRecovered     uint64 // correct packets recovered from FEC
+	FECErrs          uint64 // incorrect packets recovered from FEC
+	FECParityShards  uint64 // FEC parity shards received
+	HandshakeErrs    uint64 // handshakes failing authentication
+	RejectedOpens    uint64 // new streams refused for a bad cookie, the rate limit or the accept filter
+	CookieOpens      uint64 // new streams admitted with a valid retry cookie
+	PathMigrations   uint64 // paths moved to a new remote address after validation
+	DupBytes         uint64 // bytes sent in duplicate on further paths
+	ParallelHosts    uint64 // remote hosts currently tracked by a parallel policy
+	HostParallels    uint64 // remote hosts moved to more than one path by their parallel policy
+	OutErrs          uint64 // UDP write errors reported from net.PacketConn
+	OutBatches       uint64 // sendmmsg calls, OutPkts/OutBatches is the mean batch size
+	MaxOutBatch      uint64 // largest number of packets sent by one sendmmsg
+	DialErrs         uint64 // active opens failing, timeouts included
+
+	dupBytes sync.Map // DupBytes by duplication policy name, *uint64
+	parent   *Snmp    // counts in this one go to parent as well
 }
 
 func newSnmp() *Snmp {
 	return new(Snmp)
 }
 
+// SnmpAggregate makes the counters of every transport and tunnel add up in DefaultSnmp as well,
+// it is read when they are created
+var SnmpAggregate = true
+
+// rootSnmp is the parent of the counters of transports and of tunnels without a transport
+func rootSnmp() *Snmp {
+	if SnmpAggregate {
+		return DefaultSnmp
+	}
+	return nil
+}
+
+// aggregateSnmp returns s, or new counters if nil, adding up in parent as well
+func aggregateSnmp(s, parent *Snmp) *Snmp {
+	if s == nil {
+		s = newSnmp()
+	}
+	if s != parent {
+		s.parent = parent
+	}
+	return s
+}
+
+// add adds n to the counter picked by field, in s and in every parent of it
+func (s *Snmp) add(field func(m *Snmp) *uint64, n uint64) {
+	for ; s != nil; s = s.parent {
+		atomic.AddUint64(field(s), n)
+	}
+}
+
+// addDup counts n bytes duplicated by the policy named name, in s and in every parent of it
+func (s *Snmp) addDup(name string, n uint64) {
+	for ; s != nil; s = s.parent {
+		v, ok := s.dupBytes.Load(name)
+		if !ok {
+			v, _ = s.dupBytes.LoadOrStore(name, new(uint64))
+		}
+		atomic.AddUint64(v.(*uint64), n)
+		atomic.AddUint64(&s.DupBytes, n)
+	}
+}
+
+// DupBytesByPolicy returns DupBytes split by the name of the DuplicationPolicy
+func (s *Snmp) DupBytesByPolicy() map[string]uint64 {
+	counts := make(map[string]uint64)
+	s.dupBytes.Range(func(k, v interface{}) bool {
+		counts[k.(string)] = atomic.LoadUint64(v.(*uint64))
+		return true
+	})
+	return counts
+}
+
+// max raises the counter picked by field to n, in s and in every parent of it
+func (s *Snmp) max(field func(m *Snmp) *uint64, n uint64) {
+	for ; s != nil; s = s.parent {
+		p := field(s)
+		for {
+			old := atomic.LoadUint64(p)
+			if n <= old || atomic.CompareAndSwapUint64(p, old, n) {
+				break
+			}
+		}
+	}
+}
+
+// addEstab moves CurrEstab by delta, 1 or ^uint64(0), and keeps MaxConn
+func (s *Snmp) addEstab(delta uint64) {
+	for ; s != nil; s = s.parent {
+		currestab := atomic.AddUint64(&s.CurrEstab, delta)
+		maxconn := atomic.LoadUint64(&s.MaxConn)
+		if currestab > maxconn {
+			atomic.CompareAndSwapUint64(&s.MaxConn, maxconn, currestab)
+		}
+	}
+}
+
 // Header returns all field names
 func (s *Snmp) Header() []string {
 	return []string{
@@ -60,6 +155,21 @@ func (s *Snmp) Header() []string {
 		"LostSegs",
 		"RepeatSegs",
 		"Parallels",
+		"PacedPkts",
+		"FECRecovered",
+		"FECErrs",
+		"FECParityShards",
+		"HandshakeErrs",
+		"RejectedOpens",
+		"CookieOpens",
+		"PathMigrations",
+		"DupBytes",
+		"ParallelHosts",
+		"HostParallels",
+		"OutErrs",
+		"OutBatches",
+		"MaxOutBatch",
+		"DialErrs",
 	}
 }
 
@@ -89,6 +199,21 @@ func (s *Snmp) ToSlice() []string {
 		fmt.Sprint(snmp.LostSegs),
 		fmt.Sprint(snmp.RepeatSegs),
 		fmt.Sprint(snmp.Parallels),
+		fmt.Sprint(snmp.PacedPkts),
+		fmt.Sprint(snmp.FECRecovered),
+		fmt.Sprint(snmp.FECErrs),
+		fmt.Sprint(snmp.FECParityShards),
+		fmt.Sprint(snmp.HandshakeErrs),
+		fmt.Sprint(snmp.RejectedOpens),
+		fmt.Sprint(snmp.CookieOpens),
+		fmt.Sprint(snmp.PathMigrations),
+		fmt.Sprint(snmp.DupBytes),
+		fmt.Sprint(snmp.ParallelHosts),
+		fmt.Sprint(snmp.HostParallels),
+		fmt.Sprint(snmp.OutErrs),
+		fmt.Sprint(snmp.OutBatches),
+		fmt.Sprint(snmp.MaxOutBatch),
+		fmt.Sprint(snmp.DialErrs),
 	}
 }
 
@@ -117,6 +242,25 @@ func (s *Snmp) Copy() *Snmp {
 	d.LostSegs = atomic.LoadUint64(&s.LostSegs)
 	d.RepeatSegs = atomic.LoadUint64(&s.RepeatSegs)
 	d.Parallels = atomic.LoadUint64(&s.Parallels)
+	d.PacedPkts = atomic.LoadUint64(&s.PacedPkts)
+	d.FECRecovered = atomic.LoadUint64(&s.FECRecovered)
+	d.FECErrs = atomic.LoadUint64(&s.FECErrs)
+	d.FECParityShards = atomic.LoadUint64(&s.FECParityShards)
+	d.HandshakeErrs = atomic.LoadUint64(&s.HandshakeErrs)
+	d.RejectedOpens = atomic.LoadUint64(&s.RejectedOpens)
+	d.CookieOpens = atomic.LoadUint64(&s.CookieOpens)
+	d.PathMigrations = atomic.LoadUint64(&s.PathMigrations)
+	d.DupBytes = atomic.LoadUint64(&s.DupBytes)
+	d.ParallelHosts = atomic.LoadUint64(&s.ParallelHosts)
+	d.HostParallels = atomic.LoadUint64(&s.HostParallels)
+	d.OutErrs = atomic.LoadUint64(&s.OutErrs)
+	d.OutBatches = atomic.LoadUint64(&s.OutBatches)
+	d.MaxOutBatch = atomic.LoadUint64(&s.MaxOutBatch)
+	d.DialErrs = atomic.LoadUint64(&s.DialErrs)
+	for name, n := range s.DupBytesByPolicy() {
+		v := n
+		d.dupBytes.Store(name, &v)
+	}
 	return d
 }
 
@@ -144,11 +288,52 @@ func (s *Snmp) Reset() {
 	atomic.StoreUint64(&s.LostSegs, 0)
 	atomic.StoreUint64(&s.RepeatSegs, 0)
 	atomic.StoreUint64(&s.Parallels, 0)
+	atomic.StoreUint64(&s.PacedPkts, 0)
+	atomic.StoreUint64(&s.FECRecovered, 0)
+	atomic.StoreUint64(&s.FECErrs, 0)
+	atomic.StoreUint64(&s.FECParityShards, 0)
+	atomic.StoreUint64(&s.HandshakeErrs, 0)
+	atomic.StoreUint64(&s.RejectedOpens, 0)
+	atomic.StoreUint64(&s.CookieOpens, 0)
+	atomic.StoreUint64(&s.PathMigrations, 0)
+	atomic.StoreUint64(&s.DupBytes, 0)
+	atomic.StoreUint64(&s.ParallelHosts, 0)
+	atomic.StoreUint64(&s.HostParallels, 0)
+	atomic.StoreUint64(&s.OutErrs, 0)
+	atomic.StoreUint64(&s.OutBatches, 0)
+	atomic.StoreUint64(&s.MaxOutBatch, 0)
+	atomic.StoreUint64(&s.DialErrs, 0)
+	s.dupBytes.Range(func(k, v interface{}) bool {
+		atomic.StoreUint64(v.(*uint64), 0)
+		return true
+	})
 }
 
-// DefaultSnmp is the global KCP connection statistics collector
+// DefaultSnmp is the global KCP connection statistics collector, it adds up all transports and
+// tunnels unless SnmpAggregate is turned off
 var DefaultSnmp *Snmp
 
 func init() {
 	DefaultSnmp = newSnmp()
 }
+
+// Snmp returns the counters of the transport, they include those of its tunnels
+func (t *UDPTransport) Snmp() *Snmp {
+	return t.snmp
+}
+
+// TunnelSnmp returns the counters of every tunnel of the transport by local address
+func (t *UDPTransport) TunnelSnmp() map[string]*Snmp {
+	t.tunnelMu.Lock()
+	defer t.tunnelMu.Unlock()
+	snmps := make(map[string]*Snmp, len(t.tunnelHostM))
+	for lAddr, tunnel := range t.tunnelHostM {
+		snmps[lAddr] = tunnel.snmp
+	}
+	return snmps
+}
+
+// Snmp returns the packets, bytes, errors and batches counted by the tunnel
+func (t *UDPTunnel) Snmp() *Snmp {
+	return t.snmp
+}
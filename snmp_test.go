@@ -0,0 +1,62 @@
+package kcp
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestTransportSnmp(t *testing.T) {
+	lAddr, rAddr := "127.0.0.1:7411", "127.0.0.1:17411"
+	client, server := newTransportPair(t, []string{lAddr}, []string{rAddr}, nil, nil)
+	defer client.Close()
+	defer server.Close()
+	acceptEcho(server)
+
+	outPkts := atomic.LoadUint64(&DefaultSnmp.OutPkts)
+	stream, err := client.Open([]string{lAddr}, []string{rAddr})
+	checkError(t, err)
+	defer stream.Close()
+	checkError(t, echoTester(stream, 1024, 4))
+
+	// each side counts its own streams
+	cs, ss := client.Snmp().Copy(), server.Snmp().Copy()
+	if cs.CurrEstab != 1 || ss.CurrEstab != 1 || cs.InSegs == 0 || ss.InSegs == 0 {
+		t.Fatalf("streams. client:%+v server:%+v", cs, ss)
+	}
+
+	// the packets of a tunnel add up in its transport and in DefaultSnmp
+	tunnels := client.TunnelSnmp()
+	ts, ok := tunnels[lAddr]
+	if !ok || len(tunnels) != 1 {
+		t.Fatalf("tunnel snmp. %v", tunnels)
+	}
+	if ts.OutPkts == 0 || ts.OutPkts != cs.OutPkts || ts.InBytes != cs.InBytes || ts.OutSegs != 0 {
+		t.Fatalf("tunnel counters. tunnel:%+v transport:%+v", ts.Copy(), cs)
+	}
+	if atomic.LoadUint64(&DefaultSnmp.OutPkts)-outPkts < cs.OutPkts+ss.OutPkts {
+		t.Fatal("DefaultSnmp does not aggregate")
+	}
+}
+
+func TestSnmpAggregate(t *testing.T) {
+	root := newSnmp()
+	transport := aggregateSnmp(nil, root)
+	tunnel := aggregateSnmp(nil, transport)
+	tunnel.add(func(m *Snmp) *uint64 { return &m.OutPkts }, 3)
+	tunnel.max(func(m *Snmp) *uint64 { return &m.MaxOutBatch }, 3)
+	transport.max(func(m *Snmp) *uint64 { return &m.MaxOutBatch }, 2)
+	transport.addEstab(1)
+	transport.addEstab(^uint64(0))
+	if tunnel.OutPkts != 3 || transport.OutPkts != 3 || root.OutPkts != 3 {
+		t.Fatalf("OutPkts. %v %v %v", tunnel.OutPkts, transport.OutPkts, root.OutPkts)
+	}
+	if root.MaxOutBatch != 3 || transport.MaxOutBatch != 3 {
+		t.Fatal("MaxOutBatch lowered")
+	}
+	if root.CurrEstab != 0 || root.MaxConn != 1 || tunnel.MaxConn != 0 {
+		t.Fatal("CurrEstab and MaxConn")
+	}
+	if own := aggregateSnmp(root, root); own.parent != nil {
+		t.Fatal("snmp is its own parent")
+	}
+}
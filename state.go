@@ -0,0 +1,96 @@
+package kcp
+
+// StreamState is the state of a stream, see UDPStream.State
+//
+// The dialer goes SYN_SENT -> ESTABLISHED once SYN-ACK arrives, the acceptor goes
+// SYN_RCVD -> ESTABLISHED once its SYN-ACK is acknowledged. Sending FIN moves to FIN_WAIT,
+// receiving it to CLOSE_WAIT, both of them to TIME_WAIT. Close or RST moves to CLOSED.
+type StreamState int
+
+const (
+	StateNone      StreamState = iota // created, SYN neither sent nor accepted
+	StateSynSent                      // SYN sent, waiting for SYN-ACK
+	StateSynRcvd                      // SYN accepted and SYN-ACK sent, waiting for its ack
+	StateEstablish                    // ESTABLISHED
+	StateFinWait                      // FIN sent, waiting for the FIN of the peer
+	StateCloseWait                    // FIN received, this end may still send
+	StateTimeWait                     // FIN sent and received, Close does not send RST
+	StateClosed                       // closed or reset
+)
+
+func (st StreamState) String() string {
+	switch st {
+	case StateNone:
+		return "NONE"
+	case StateSynSent:
+		return "SYN_SENT"
+	case StateSynRcvd:
+		return "SYN_RCVD"
+	case StateEstablish:
+		return "ESTABLISHED"
+	case StateFinWait:
+		return "FIN_WAIT"
+	case StateCloseWait:
+		return "CLOSE_WAIT"
+	case StateTimeWait:
+		return "TIME_WAIT"
+	case StateClosed:
+		return "CLOSED"
+	}
+	return "UNKNOWN"
+}
+
+// open reports if the stream has been handed to the application and is not closed yet,
+// such streams are counted in CurrEstab
+func (st StreamState) open() bool {
+	return st >= StateSynRcvd && st < StateClosed
+}
+
+// State returns the current state of the stream
+func (s *UDPStream) State() StreamState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// setState moves the stream to state and keeps the counters of open streams, s.mu must be held
+func (s *UDPStream) setState(state StreamState) {
+	if s.state == state {
+		return
+	}
+	Logf(INFO, "UDPStream::setState uuid:%v accepted:%v state:%v->%v", s.uuid, s.accepted, s.state, state)
+
+	if !s.state.open() && state.open() {
+		s.snmp.addEstab(1)
+		if s.pc != nil {
+			s.hp = s.pc.acquire(s.remotes[0].IP.String())
+		}
+	} else if s.state.open() && !state.open() {
+		s.snmp.addEstab(^uint64(0))
+		if s.hp != nil {
+			s.pc.release(s.hp)
+			s.hp = nil
+		}
+	}
+	s.state = state
+}
+
+// sentFin moves the stream on after FIN has been sent, s.mu must be held
+func (s *UDPStream) sentFin() {
+	switch s.state {
+	case StateSynRcvd, StateEstablish:
+		s.setState(StateFinWait)
+	case StateCloseWait:
+		s.setState(StateTimeWait)
+	}
+}
+
+// recvdFin moves the stream on after FIN has been received, s.mu must be held
+func (s *UDPStream) recvdFin() {
+	switch s.state {
+	case StateSynRcvd, StateEstablish:
+		s.setState(StateCloseWait)
+	case StateFinWait:
+		s.setState(StateTimeWait)
+	}
+}
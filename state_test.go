@@ -0,0 +1,120 @@
+package kcp
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func waitState(t *testing.T, stream *UDPStream, want StreamState) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 2)
+	for stream.State() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("state not reached. uuid:%v state:%v want:%v", stream.GetUUID(), stream.State(), want)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestStreamState(t *testing.T) {
+	if s := StateSynRcvd.String(); s != "SYN_RCVD" {
+		t.Fatalf("state name. name:%v", s)
+	}
+
+	lAddrs, rAddrs := []string{"127.0.0.1:7281"}, []string{"127.0.0.1:17281"}
+	client, server := newTransportPair(t, lAddrs, rAddrs, nil, nil)
+	dialer, acceptor := openPair(t, client, server, lAddrs, rAddrs, 1, false)
+	defer client.Close()
+	defer server.Close()
+
+	if st := dialer.State(); st != StateEstablish {
+		t.Fatalf("dialer not established. state:%v", st)
+	}
+	// the acceptor is established once the dialer acknowledges SYN-ACK
+	waitState(t, acceptor, StateEstablish)
+
+	checkError(t, dialer.CloseWrite())
+	if st := dialer.State(); st != StateFinWait {
+		t.Fatalf("dialer after FIN. state:%v", st)
+	}
+	buf := make([]byte, 16)
+	if _, err := acceptor.Read(buf); err != io.EOF {
+		t.Fatalf("acceptor read. err:%v", err)
+	}
+	if st := acceptor.State(); st != StateCloseWait {
+		t.Fatalf("acceptor after FIN. state:%v", st)
+	}
+
+	// the half-closed acceptor can still send
+	_, err := acceptor.Write([]byte("bye"))
+	checkError(t, err)
+	n, err := dialer.Read(buf)
+	if err != nil || string(buf[:n]) != "bye" {
+		t.Fatalf("half-closed write. n:%v err:%v", n, err)
+	}
+
+	checkError(t, acceptor.CloseWrite())
+	if st := acceptor.State(); st != StateTimeWait {
+		t.Fatalf("acceptor after both FIN. state:%v", st)
+	}
+	if _, err = dialer.Read(buf); err != io.EOF {
+		t.Fatalf("dialer read. err:%v", err)
+	}
+	if st := dialer.State(); st != StateTimeWait {
+		t.Fatalf("dialer after both FIN. state:%v", st)
+	}
+
+	dialer.Close()
+	acceptor.Close()
+	if dialer.State() != StateClosed || acceptor.State() != StateClosed {
+		t.Fatalf("closed. dialer:%v acceptor:%v", dialer.State(), acceptor.State())
+	}
+}
+
+func TestSimultaneousClose(t *testing.T) {
+	lAddrs, rAddrs := []string{"127.0.0.1:7291"}, []string{"127.0.0.1:17291"}
+	client, server := newTransportPair(t, lAddrs, rAddrs, nil, nil)
+	dialer, acceptor := openPair(t, client, server, lAddrs, rAddrs, 1, false)
+	defer client.Close()
+	defer server.Close()
+	waitState(t, acceptor, StateEstablish)
+
+	// both ends send FIN before seeing the other one
+	checkError(t, dialer.CloseWrite())
+	checkError(t, acceptor.CloseWrite())
+	buf := make([]byte, 16)
+	for _, stream := range []*UDPStream{dialer, acceptor} {
+		if _, err := stream.Read(buf); err != io.EOF {
+			t.Fatalf("read. uuid:%v err:%v", stream.GetUUID(), err)
+		}
+		if st := stream.State(); st != StateTimeWait {
+			t.Fatalf("after both FIN. state:%v", st)
+		}
+	}
+
+	// Close in TIME_WAIT sends no RST, the peer is not reset
+	dialer.Close()
+	time.Sleep(time.Millisecond * 200)
+	if st := acceptor.State(); st != StateTimeWait {
+		t.Fatalf("acceptor reset by close. state:%v", st)
+	}
+	acceptor.Close()
+}
+
+func TestResetState(t *testing.T) {
+	lAddrs, rAddrs := []string{"127.0.0.1:7301"}, []string{"127.0.0.1:17301"}
+	client, server := newTransportPair(t, lAddrs, rAddrs, nil, nil)
+	dialer, acceptor := openPair(t, client, server, lAddrs, rAddrs, 1, false)
+	defer client.Close()
+	defer server.Close()
+	waitState(t, acceptor, StateEstablish)
+
+	dialer.Close()
+	if _, err := acceptor.Read(make([]byte, 16)); err != io.ErrUnexpectedEOF {
+		t.Fatalf("read after RST. err:%v", err)
+	}
+	if st := acceptor.State(); st != StateClosed {
+		t.Fatalf("acceptor after RST. state:%v", st)
+	}
+}
@@ -0,0 +1,115 @@
+package kcp
+
+import (
+	"net"
+	"time"
+)
+
+// StreamStats is a snapshot of the counters and the state of one stream
+type StreamStats struct {
+	BytesSent        uint64 // data bytes written by the upper level
+	BytesReceived    uint64 // data bytes read by the upper level
+	SegsSent         uint64 // KCP segments sent, acknowledges included
+	SegsReceived     uint64 // KCP segments received
+	RetransSegs      uint64 // sum of the retransmissions below
+	FastRetransSegs  uint64
+	EarlyRetransSegs uint64
+	LostSegs         uint64 // retransmitted on timeout
+
+	SRTT   time.Duration
+	RTTVar time.Duration
+	RTO    time.Duration
+
+	Cwnd     uint32
+	Ssthresh uint32
+	SndWnd   uint32
+	RmtWnd   uint32
+
+	SndQueue int // segments waiting for the send window
+	SndBuf   int // segments sent and not acknowledged yet
+	RcvQueue int // segments waiting to be read
+	RcvBuf   int // segments received out of order
+
+	Parallels    uint64        // parallel periods entered, see SetParallelXmit
+	ParallelTime time.Duration // spent in parallel periods, the current one included
+
+	Paths []PathTraffic
+}
+
+// PathTraffic counts the packets of one path of a stream
+type PathTraffic struct {
+	Local        net.Addr
+	Remote       net.Addr
+	PktsSent     uint64 // packets queued to the path, copies and probes included
+	PktsReceived uint64
+}
+
+type pathTraffic struct {
+	sent   uint64
+	recvd  uint64
+	ackRTT time.Time // last ack rtt observed, see observeAckRTT
+}
+
+// Stats returns a consistent snapshot of the stream, taken under its lock
+func (s *UDPStream) Stats() StreamStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kcp := s.kcp
+	st := StreamStats{
+		BytesSent:        s.bytesSent,
+		BytesReceived:    s.bytesReceived,
+		SegsSent:         kcp.stats.outSegs,
+		SegsReceived:     kcp.stats.inSegs,
+		RetransSegs:      kcp.stats.retransSegs(),
+		FastRetransSegs:  kcp.stats.fastRetransSegs,
+		EarlyRetransSegs: kcp.stats.earlyRetransSegs,
+		LostSegs:         kcp.stats.lostSegs,
+		SRTT:             time.Duration(kcp.rx_srtt) * time.Millisecond,
+		RTTVar:           time.Duration(kcp.rx_rttvar) * time.Millisecond,
+		RTO:              time.Duration(kcp.rx_rto) * time.Millisecond,
+		Cwnd:             kcp.cwnd,
+		Ssthresh:         kcp.ssthresh,
+		SndWnd:           kcp.snd_wnd,
+		RmtWnd:           kcp.rmt_wnd,
+		SndQueue:         len(kcp.snd_queue),
+		SndBuf:           len(kcp.snd_buf),
+		RcvQueue:         len(kcp.rcv_queue),
+		RcvBuf:           len(kcp.rcv_buf),
+		Parallels:        s.parallels,
+		ParallelTime:     s.parallelDur,
+		Paths:            make([]PathTraffic, len(s.tunnels)),
+	}
+	if !s.parallelExpire.IsZero() {
+		end := time.Now()
+		if end.After(s.parallelExpire) {
+			end = s.parallelExpire
+		}
+		st.ParallelTime += end.Sub(s.parallelStart)
+	}
+	for i := range st.Paths {
+		st.Paths[i] = PathTraffic{
+			Local:        s.locals[i],
+			Remote:       s.remotes[i],
+			PktsSent:     s.traffic[i].sent,
+			PktsReceived: s.traffic[i].recvd,
+		}
+	}
+	return st
+}
+
+// countRecv counts a packet received by tunnel from rAddr on its path and returns the path,
+// -1 if unknown. s.mu must be held.
+func (s *UDPStream) countRecv(tunnel *UDPTunnel, rAddr net.Addr) int {
+	addr, ok := rAddr.(*net.UDPAddr)
+	if !ok || tunnel == nil {
+		return -1
+	}
+	for i, remote := range s.remotes {
+		if s.tunnels[i] == tunnel && sameUDPAddr(remote, addr) {
+			s.traffic[i].recvd++
+			return i
+		}
+	}
+	return -1
+}
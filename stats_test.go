@@ -0,0 +1,53 @@
+package kcp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStreamStats(t *testing.T) {
+	lAddrs := []string{"127.0.0.1:7401", "127.0.0.1:27401"}
+	rAddrs := []string{"127.0.0.1:17401", "127.0.0.1:37401"}
+	client, server := newTransportPair(t, lAddrs, rAddrs, nil, nil)
+	dialer, acceptor := openPair(t, client, server, lAddrs, rAddrs, 2, true)
+	defer client.Close()
+	defer server.Close()
+	defer dialer.Close()
+
+	before := dialer.Stats()
+	checkError(t, echoTester(dialer, 1024, 4))
+	st := dialer.Stats()
+	if st.BytesSent-before.BytesSent != 4096 || st.BytesReceived-before.BytesReceived != 4096 {
+		t.Fatalf("bytes. sent:%v received:%v", st.BytesSent-before.BytesSent, st.BytesReceived-before.BytesReceived)
+	}
+	if st.SegsSent == 0 || st.SegsReceived == 0 || st.RTO == 0 || st.SndWnd == 0 || st.RmtWnd == 0 {
+		t.Fatalf("kcp state. %+v", st)
+	}
+	if st.RetransSegs != st.FastRetransSegs+st.EarlyRetransSegs+st.LostSegs {
+		t.Fatalf("retransmissions. %+v", st)
+	}
+	if st.SndBuf != 0 || st.SndQueue != 0 || st.RcvQueue != 0 {
+		t.Fatalf("queues after echo. %+v", st)
+	}
+
+	// SYN goes on both paths, data on the first one
+	if len(st.Paths) != 2 || st.Paths[0].Local.String() != lAddrs[0] || st.Paths[1].Remote.String() != rAddrs[1] {
+		t.Fatalf("paths. %+v", st.Paths)
+	}
+	if st.Paths[0].PktsSent <= st.Paths[1].PktsSent || st.Paths[1].PktsSent == 0 || st.Paths[0].PktsReceived == 0 {
+		t.Fatalf("path packets. %+v", st.Paths)
+	}
+	if ast := acceptor.Stats(); ast.Paths[1].PktsSent == 0 || ast.Paths[0].PktsReceived == 0 || ast.SegsReceived == 0 {
+		t.Fatalf("acceptor path packets. %+v", ast.Paths)
+	}
+
+	// the current parallel period counts until now
+	dialer.mu.Lock()
+	dialer.parallels++
+	dialer.parallelStart = time.Now().Add(-time.Millisecond * 100)
+	dialer.parallelExpire = dialer.parallelStart.Add(time.Second)
+	dialer.mu.Unlock()
+	if st = dialer.Stats(); st.Parallels != 1 || st.ParallelTime < time.Millisecond*100 || st.ParallelTime > time.Second {
+		t.Fatalf("parallel time. parallels:%v time:%v", st.Parallels, st.ParallelTime)
+	}
+}
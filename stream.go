@@ -1,12 +1,12 @@
 package kcp
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
 	"io"
 	"net"
-	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	gouuid "github.com/satori/go.uuid"
@@ -14,26 +14,23 @@ import (
 )
 
 var (
-	errTimeout      = errors.New("err timeout")
-	errTunnelPick   = errors.New("err tunnel pick")
-	errStreamFlag   = errors.New("err stream flag")
-	errSynInfo      = errors.New("err syn info")
-	errDialParam    = errors.New("err dial param")
-	errRemoteStream = errors.New("err remote stream")
+	errTimeout       = errors.New("err timeout")
+	errTunnelPick    = errors.New("err tunnel pick")
+	errStreamFlag    = errors.New("err stream flag")
+	errSynInfo       = errors.New("err syn info")
+	errDialParam     = errors.New("err dial param")
+	errRemoteStream  = errors.New("err remote stream")
+	errAcceptBacklog = errors.New("err accept backlog")
 )
 
 const (
-	StateNone = iota // 0
-	StateEstablish
-	StateClosed
-)
-
-const (
-	PSH = '1'
-	SYN = '2'
-	FIN = '3'
-	HRT = '4'
-	RST = '5'
+	PSH    = '1'
+	SYN    = '2'
+	FIN    = '3'
+	HRT    = '4'
+	RST    = '5'
+	SYNACK = '6'
+	PATH   = '7'
 )
 
 const (
@@ -53,7 +50,7 @@ type (
 	// UDPStream defines a KCP session
 	UDPStream struct {
 		uuid     gouuid.UUID
-		state    int
+		state    StreamState
 		sel      TunnelSelector
 		kcp      *KCP // KCP ARQ protocol
 		tunnels  []*UDPTunnel
@@ -99,12 +96,61 @@ type (
 		parallelXmit   uint32
 		parallelTime   time.Duration
 		parallelExpire time.Time
+		parallelStart  time.Time     // entry of the current parallel period
+		parallelDur    time.Duration // spent in the finished parallel periods
+		parallels      uint64        // parallel periods entered
 
-		pc *parallelCtrl
-		hp *hostParallel
+		pc       *parallelCtrl
+		hp       *hostParallel
+		observed kcpStats // kcp totals already reported to hp
 
 		ackNoDelayRatio float32
 		ackNoDelayCount uint32
+
+		pacing     bool     // pace packets handed to tunnels
+		pacingRate uint64   // bytes per second, 0 derives the rate from cwnd/rtt
+		pacers     []*pacer // one token bucket per path
+
+		// forward error correction, the acceptor follows the dialer's parameters in SYN
+		dataShards   int
+		parityShards int
+		fecEncoder   *fecEncoder
+		fecDecoder   *fecDecoder
+
+		cryptOverhead int // bytes reserved for the tunnel to seal packets
+
+		cookies map[string][]byte // retry cookies of the acceptor by remote address, dropped once established
+
+		metadata Metadata // sent by the dialer in SYN
+
+		peerCaps Capabilities // sent by the peer in SYN or SYN-ACK
+		dialErr  error        // why the acceptor refused the stream
+
+		challenges    map[int]*pathChallenge // pending validations of new remote addresses by path
+		migrationHook MigrationHook
+
+		// paths are numbered in SYN order, later ones are added by PATH
+		pathIDs      []uint32
+		pathRecv     []time.Time // last packet received on each path
+		nextPathID   uint32
+		pendingPaths []*pendingPath // added, waiting for the peer to acknowledge
+		pathTimeout  time.Duration  // silent paths are removed after this long, 0 keeps them
+		pathCheckGen uint32         // bumped to stop the scheduled checkPaths
+
+		health        []*pathHealth // measured by pings on each path
+		probeInterval time.Duration // paths are pinged this often, 0 disables probing
+		probeGen      uint32        // bumped to stop the scheduled probePaths
+
+		multipathMode MultipathMode
+		dupPolicy     DuplicationPolicy // what is copied to other paths
+		stripeCredits []float64         // smooth weighted round robin of striped paths
+		stripeBuf     []float64         // weights of the paths, reused by stripeWeights
+
+		bytesSent     uint64         // written by the upper level
+		bytesReceived uint64         // read by the upper level
+		traffic       []*pathTraffic // packets on each path
+		snmp          *Snmp          // counters of the transport, DefaultSnmp without one
+		rttHist       *histogram     // rtt of pongs and sampled acks, nil without a transport
 	}
 )
 
@@ -143,12 +189,16 @@ func NewUDPStream(uuid gouuid.UUID, accepted bool, remotes []string, pc *paralle
 	stream.uuid = uuid
 	stream.sel = sel
 	stream.cleancb = cleancb
-	stream.headerSize = gouuid.Size
+	if crypt := tunnels[0].crypt; crypt != nil {
+		stream.cryptOverhead = crypt.overhead()
+	}
+	stream.headerSize = gouuid.Size + stream.cryptOverhead
 	stream.msgss = make([][]ipv4.Message, 0)
 	stream.accepted = accepted
 	stream.tunnels = tunnels
 	stream.locals = locals
 	stream.remotes = remoteAddrs
+	stream.resetPaths()
 	stream.hrtTicker = time.NewTicker(HeartbeatInterval)
 	stream.cleanTimer = time.NewTimer(CleanTimeout)
 	stream.parallelXmit = uint32(DefaultParallelXmit)
@@ -156,6 +206,14 @@ func NewUDPStream(uuid gouuid.UUID, accepted bool, remotes []string, pc *paralle
 	stream.pc = pc
 	stream.ackNoDelayRatio = DefaultAckNoDelayRatio
 	stream.ackNoDelayCount = DefaultAckNoDelayCount
+	stream.dupPolicy = ParallelDuplication{}
+	stream.snmp = DefaultSnmp
+	if DefaultPathTimeout > 0 {
+		stream.SetPathTimeout(DefaultPathTimeout)
+	}
+	if DefaultPathProbeInterval > 0 {
+		stream.SetPathProbeInterval(DefaultPathProbeInterval)
+	}
 
 	stream.kcp = NewKCP(1, func(buf []byte, size int, xmitMax uint32) {
 		if size >= IKCP_OVERHEAD+stream.headerSize {
@@ -164,7 +222,6 @@ func NewUDPStream(uuid gouuid.UUID, accepted bool, remotes []string, pc *paralle
 	})
 	stream.kcp.ReserveBytes(stream.headerSize)
 	stream.kcp.dead_link = DefaultDeadLink
-	stream.kcp.cwnd = 1
 
 	stream.cleanTimer.Stop()
 	go stream.update()
@@ -277,6 +334,86 @@ func (s *UDPStream) SetNoDelay(nodelay, interval, resend, nc int) {
 	s.kcp.NoDelay(nodelay, interval, resend, nc)
 }
 
+// SetPacing spreads the packets of a flush over time instead of bursting them to tunnels.
+// rate is in bytes per second, 0 derives the rate from cwnd/rtt.
+func (s *UDPStream) SetPacing(pacing bool, rate uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pacing = pacing
+	s.pacingRate = rate
+}
+
+// SetFEC enables Reed-Solomon forward error correction, every dataShards packets are followed
+// by parityShards parity packets. 0 disables FEC.
+//
+// It must be called before the stream is opened, the parameters are sent to the acceptor in SYN.
+// Return false if the stream is established or the parameters are invalid.
+func (s *UDPStream) SetFEC(dataShards, parityShards int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.setFEC(dataShards, parityShards)
+}
+
+func (s *UDPStream) setFEC(dataShards, parityShards int) bool {
+	if s.state != StateNone {
+		return false
+	}
+
+	var enc *fecEncoder
+	var dec *fecDecoder
+	headerSize := gouuid.Size + s.cryptOverhead
+	if dataShards > 0 && parityShards > 0 {
+		enc = newFECEncoder(dataShards, parityShards, headerSize)
+		dec = newFECDecoder(dataShards, parityShards)
+		if enc == nil || dec == nil {
+			return false
+		}
+		dec.snmp = s.snmp
+		headerSize += fecHeaderSizePlus2
+	} else {
+		dataShards, parityShards = 0, 0
+	}
+	if !s.kcp.ReserveBytes(headerSize) {
+		return false
+	}
+
+	s.headerSize = headerSize
+	s.dataShards = dataShards
+	s.parityShards = parityShards
+	s.fecEncoder = enc
+	s.fecDecoder = dec
+	return true
+}
+
+// SetOption applies all settings in opt
+func (s *UDPStream) SetOption(opt *StreamOption) {
+	s.SetNoDelay(opt.Nodelay, opt.Interval, opt.Resend, opt.Nc)
+	s.SetPacing(opt.Pacing, opt.PacingRate)
+	if !s.SetFEC(opt.DataShards, opt.ParityShards) {
+		Logf(WARN, "UDPStream::SetOption invalid fec. uuid:%v dataShards:%v parityShards:%v", s.uuid, opt.DataShards, opt.ParityShards)
+	}
+	if opt.PathTimeout > 0 {
+		s.SetPathTimeout(opt.PathTimeout)
+	}
+	if opt.PathProbeInterval > 0 {
+		s.SetPathProbeInterval(opt.PathProbeInterval)
+	}
+	if opt.MultipathMode != MultipathRedundant {
+		s.SetMultipathMode(opt.MultipathMode)
+	}
+	if opt.DuplicationPolicy != nil {
+		s.SetDuplicationPolicy(opt.DuplicationPolicy)
+	}
+}
+
+// SetCongestionController changes the congestion control algorithm, nil restores the default one.
+// The controller is owned by the stream and must not be shared.
+func (s *UDPStream) SetCongestionController(cc CongestionController) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kcp.SetCongestionController(cc)
+}
+
 func (s *UDPStream) SetDeadLink(deadLink int) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -308,6 +445,36 @@ func (s *UDPStream) SetAckNoDelayThreshold(ackNoDelayRatio float32, ackNoDelayCo
 	s.ackNoDelayCount = ackNoDelayCount
 }
 
+// localCaps returns the capabilities sent to the peer
+func (s *UDPStream) localCaps() Capabilities {
+	caps := Capabilities(supportedCaps)
+	if s.cryptOverhead > 0 {
+		caps |= CapEncryption
+	}
+	return caps
+}
+
+// Capabilities returns the capabilities both ends have, valid once the stream is established
+func (s *UDPStream) Capabilities() Capabilities {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.localCaps() & s.peerCaps
+}
+
+// PeerCapabilities returns the capabilities the peer sent in SYN or SYN-ACK
+func (s *UDPStream) PeerCapabilities() Capabilities {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peerCaps
+}
+
+// Metadata returns the blob the dialer sent in SYN, nil if none
+func (s *UDPStream) Metadata() Metadata {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.metadata
+}
+
 // GetConv gets conversation id of a session
 func (s *UDPStream) GetConv() uint32      { return s.kcp.conv }
 func (s *UDPStream) GetUUID() gouuid.UUID { return s.uuid }
@@ -331,7 +498,8 @@ func (s *UDPStream) Read(b []byte) (n int, err error) {
 				copyn := copy(b[n:], s.bufptr)
 				s.bufptr = s.bufptr[copyn:]
 				n += copyn
-				atomic.AddUint64(&DefaultSnmp.BytesReceived, uint64(copyn))
+				s.bytesReceived += uint64(copyn)
+				s.snmp.add(func(m *Snmp) *uint64 { return &m.BytesReceived }, uint64(copyn))
 				if n == len(b) {
 					s.notifyFlushEvent(s.kcp.probe_ask_tell())
 					s.mu.Unlock()
@@ -353,8 +521,9 @@ func (s *UDPStream) Read(b []byte) (n int, err error) {
 				s.bufptr = s.recvbuf[copyn+1:]
 				if flag == PSH {
 					n += copyn
+					s.bytesReceived += uint64(copyn)
 				}
-				atomic.AddUint64(&DefaultSnmp.BytesReceived, uint64(copyn))
+				s.snmp.add(func(m *Snmp) *uint64 { return &m.BytesReceived }, uint64(copyn))
 				if n == len(b) || err != nil {
 					s.notifyFlushEvent(s.kcp.probe_ask_tell())
 					s.mu.Unlock()
@@ -447,12 +616,15 @@ func (s *UDPStream) WriteBuffer(flag byte, b []byte, heartbeat bool) (n int, err
 				}
 			}
 
+			if flag == PSH {
+				s.bytesSent += uint64(n)
+			}
 			waitsnd = s.kcp.WaitSnd()
 			immediately := waitsnd >= int(s.kcp.snd_wnd) || waitsnd >= int(s.kcp.rmt_wnd) || !s.writeDelay
 			s.mu.Unlock()
 			s.notifyFlushEvent(immediately)
 
-			atomic.AddUint64(&DefaultSnmp.BytesSent, uint64(n))
+			s.snmp.add(func(m *Snmp) *uint64 { return &m.BytesSent }, uint64(n))
 
 			// cost := time.Since(start)
 			// Logf(DEBUG, "UDPStream::Write finish uuid:%v accepted:%v randId:%v waitsnd:%v snd_wnd:%v rmt_wnd:%v snd_buf:%v snd_queue:%v cost:%v len:%v", s.uuid, s.accepted, randId, waitsnd, s.kcp.snd_wnd, s.kcp.rmt_wnd, len(s.kcp.snd_buf), len(s.kcp.snd_queue), cost, n)
@@ -495,6 +667,11 @@ func (s *UDPStream) WriteBuffer(flag byte, b []byte, heartbeat bool) (n int, err
 
 // Close closes the connection.
 func (s *UDPStream) Close() error {
+	return s.closeWith(reasonNone)
+}
+
+// closeWith closes the connection sending reason in RST
+func (s *UDPStream) closeWith(reason byte) error {
 	var once bool
 	s.closeOnce.Do(func() {
 		once = true
@@ -505,21 +682,20 @@ func (s *UDPStream) Close() error {
 		return io.ErrClosedPipe
 	}
 
-	s.WriteFlag(RST, nil)
+	// nothing to tell a peer that has reset, or that has sent FIN and received ours
+	s.mu.Lock()
+	rst := s.state != StateTimeWait && s.state != StateClosed
+	s.mu.Unlock()
+	if rst {
+		s.WriteFlag(RST, rstFrame(reason))
+	}
 	close(s.chClose)
 	s.hrtTicker.Stop()
 	s.cleanTimer.Reset(CleanTimeout)
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if s.state != StateEstablish {
-		return nil
-	}
-	s.state = StateClosed
-	atomic.AddUint64(&DefaultSnmp.CurrEstab, ^uint64(0))
-	if s.hp != nil {
-		s.hp.dec()
-	}
+	s.setState(StateClosed)
 	return nil
 }
 
@@ -533,13 +709,17 @@ func (s *UDPStream) CloseWrite() error {
 		return nil
 	}
 
-	s.WriteFlag(FIN, nil)
+	s.WriteFlag(FIN, controlFrame())
 	close(s.chSendFinEvent)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sentFin()
 	return nil
 }
 
-func (s *UDPStream) dial(locals []string, timeout time.Duration) error {
-	Logf(INFO, "UDPStream::dial uuid:%v accepted:%v locals:%v timeout:%v", s.uuid, s.accepted, locals, timeout)
+func (s *UDPStream) dial(ctx context.Context, locals []string) error {
+	Logf(INFO, "UDPStream::dial uuid:%v accepted:%v locals:%v", s.uuid, s.accepted, locals)
 
 	if s.accepted {
 		return nil
@@ -547,28 +727,49 @@ func (s *UDPStream) dial(locals []string, timeout time.Duration) error {
 		return errDialParam
 	}
 
-	s.WriteFlag(SYN, []byte(strings.Join(locals, " ")))
-
-	dialTimer := time.NewTimer(timeout)
-	defer dialTimer.Stop()
+	s.mu.Lock()
+	syn, err := (&synInfo{caps: s.localCaps(), locals: locals, dataShards: s.dataShards, parityShards: s.parityShards, metadata: s.metadata}).encode()
+	// the acceptor reads SYN out of the first packet
+	if err == nil && 1+len(syn) > int(s.kcp.mss) {
+		err = errMetadataSize
+	}
+	if err == nil {
+		s.setState(StateSynSent)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	s.WriteFlag(SYN, syn)
 
 	select {
 	case <-s.chClose:
 		return io.ErrClosedPipe
 	case <-s.chRst:
+		if err := s.getDialErr(); err != nil {
+			return err
+		}
 		return io.ErrUnexpectedEOF
 	case <-s.chRecvFinEvent:
 		return io.EOF
 	case <-s.chDialEvent:
+		if err := s.getDialErr(); err != nil {
+			return err
+		}
 		s.establish()
 		return nil
-	case <-dialTimer.C:
-		atomic.AddUint64(&DefaultSnmp.DialTimeout, 1)
-		return errTimeout
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			s.snmp.add(func(m *Snmp) *uint64 { return &m.DialTimeout }, 1)
+			return errTimeout
+		}
+		return ctx.Err()
 	}
 }
 
-func (s *UDPStream) accept() (err error) {
+// accept reads SYN of an incoming stream and establishes it if filter agrees and reserve gets
+// a slot of the accept backlog, both may be nil
+func (s *UDPStream) accept(filter func() AcceptDecision, reserve func() bool) (err error) {
 	Logf(INFO, "UDPStream::accept uuid:%v accepted:%v", s.uuid, s.accepted)
 
 	select {
@@ -603,28 +804,85 @@ func (s *UDPStream) accept() (err error) {
 	}
 	s.mu.Unlock()
 
+	if filter != nil {
+		switch filter() {
+		case DropStream:
+			return errStreamDropped
+		case RejectStream:
+			return errStreamRejected
+		}
+	}
+	if reserve != nil && !reserve() {
+		return errAcceptBacklog
+	}
+
+	// SYN-ACK confirms the endpoints of the acceptor, one for each path of the dialer
+	s.mu.Lock()
+	locals := make([]string, len(s.locals))
+	for i, local := range s.locals {
+		locals[i] = local.String()
+	}
+	synAck, err := (&synInfo{caps: s.localCaps(), locals: locals}).encode()
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.setState(StateSynRcvd)
+	s.mu.Unlock()
+
+	s.WriteFlag(SYNACK, synAck)
 	s.flush()
-	s.establish()
-	return err
+	return nil
 }
 
 func (s *UDPStream) establish() {
 	Logf(INFO, "UDPStream::establish uuid:%v accepted:%v", s.uuid, s.accepted)
 
-	currestab := atomic.AddUint64(&DefaultSnmp.CurrEstab, 1)
-	maxconn := atomic.LoadUint64(&DefaultSnmp.MaxConn)
-	if currestab > maxconn {
-		atomic.CompareAndSwapUint64(&DefaultSnmp.MaxConn, maxconn, currestab)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state == StateSynSent {
+		s.setState(StateEstablish)
 	}
+	s.cookies = nil
+}
+
+// retry keeps the cookie the acceptor returned on the path to remote and retransmits SYN at once,
+// packets to remote carry the cookie until the stream is established
+func (s *UDPStream) retry(remote net.Addr, cookie []byte) {
+	Logf(INFO, "UDPStream::retry uuid:%v accepted:%v remote:%v", s.uuid, s.accepted, remote)
 
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	if s.accepted || s.state != StateSynSent {
+		s.mu.Unlock()
+		return
+	}
+	if s.cookies == nil {
+		s.cookies = make(map[string][]byte)
+	}
+	s.cookies[remote.String()] = cookie
+	current := currentMs()
+	for k := range s.kcp.snd_buf {
+		s.kcp.snd_buf[k].resendts = current
+	}
+	s.mu.Unlock()
+	s.notifyFlushEvent(true)
+}
+
+// discard forgets a stream that was never established. With rst the peer is
+// sent RST, otherwise nothing is sent and SYN stays unacknowledged.
+func (s *UDPStream) discard(rst bool) {
+	Logf(INFO, "UDPStream::discard uuid:%v accepted:%v rst:%v", s.uuid, s.accepted, rst)
 
-	if s.pc != nil {
-		s.hp = s.pc.getHostParallel(s.remotes[0].IP.String())
-		s.hp.inc()
+	if rst {
+		s.Close()
+		s.flush()
+	} else {
+		s.closeOnce.Do(func() {
+			close(s.chClose)
+			s.hrtTicker.Stop()
+		})
 	}
-	s.state = StateEstablish
+	s.cleanTimer.Reset(0)
 }
 
 func (s *UDPStream) reset() {
@@ -640,6 +898,7 @@ func (s *UDPStream) reset() {
 
 	close(s.chRst)
 	s.kcp.ReleaseTX()
+	s.setState(StateClosed)
 }
 
 // sess update to trigger protocol
@@ -661,11 +920,14 @@ func (s *UDPStream) update() {
 			return
 		case <-s.hrtTicker.C:
 			Logf(DEBUG, "UDPStream::heartbeat uuid:%v accepted:%v", s.uuid, s.accepted)
-			s.WriteFlag(HRT, nil)
+			s.WriteFlag(HRT, controlFrame())
 		case immediately := <-s.chFlushEvent:
 			if !immediately {
 				if flushTimer == nil {
-					flushTimer = time.NewTimer(time.Duration(s.kcp.interval) * time.Millisecond)
+					s.mu.Lock()
+					interval := s.kcp.interval
+					s.mu.Unlock()
+					flushTimer = time.NewTimer(time.Duration(interval) * time.Millisecond)
 					flushTimerCh = flushTimer.C
 				}
 				break
@@ -702,6 +964,17 @@ func (s *UDPStream) flush() (interval uint32) {
 			s.reset()
 		}
 	}
+	if st := &s.kcp.stats; st.xmitSegs != s.observed.xmitSegs {
+		if s.hp != nil {
+			s.hp.observe(ParallelObservation{
+				Sent:    st.xmitSegs - s.observed.xmitSegs,
+				Retrans: st.retransSegs() - s.observed.retransSegs(),
+				Lost:    st.lostSegs - s.observed.lostSegs,
+				RTT:     time.Duration(s.kcp.rx_srtt) * time.Millisecond,
+			})
+		}
+		s.observed = *st
+	}
 
 	waitsnd := s.kcp.WaitSnd()
 	notifyWrite := waitsnd < int(s.kcp.snd_wnd) && waitsnd < int(s.kcp.rmt_wnd)
@@ -716,6 +989,10 @@ func (s *UDPStream) flush() (interval uint32) {
 	msgss := s.msgss
 	tunnels := s.tunnels[:len(msgss)]
 	s.msgss = make([][]ipv4.Message, 0)
+	var pacers []*pacer
+	if s.pacing {
+		pacers = s.streamPacers(len(msgss))
+	}
 	s.mu.Unlock()
 
 	if notifyWrite {
@@ -726,67 +1003,224 @@ func (s *UDPStream) flush() (interval uint32) {
 
 	//if tunnel output failure, can change tunnel or else ?
 	for i, msgs := range msgss {
-		if len(msgs) > 0 {
+		if len(msgs) == 0 {
+			continue
+		}
+		if pacers == nil {
 			tunnels[i].output(msgs)
+			continue
 		}
+		tunnel := tunnels[i]
+		pacers[i].schedule(msgs, func(msgs []ipv4.Message, delay time.Duration) {
+			if delay == 0 {
+				tunnel.output(msgs)
+				return
+			}
+			SystemTimedSched.Put(func() {
+				if tunnel.output(msgs) != nil {
+					tunnel.releaseMsgss([][]ipv4.Message{msgs})
+				}
+			}, time.Now().Add(delay))
+		})
 	}
 	return
 }
 
-func (s *UDPStream) parallelTun(xmitMax uint32) (parallel int) {
-	if s.parallelXmit == 0 || s.state == StateNone {
-		return len(s.tunnels)
-	} else if s.hp != nil && s.hp.isParallel() {
-		return len(s.tunnels)
+// setSnmp makes the stream count into snmp, before it is used
+func (s *UDPStream) setSnmp(snmp *Snmp) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snmp = snmp
+	s.kcp.snmp = snmp
+	if s.fecDecoder != nil {
+		s.fecDecoder.snmp = snmp
+	}
+}
+
+// streamPacers returns a pacer for each of the first n paths with the current pacing rate
+func (s *UDPStream) streamPacers(n int) []*pacer {
+	rate := s.pacingRate
+	if rate == 0 {
+		rate = uint64(float64(s.kcp.PacingRate()) * DefaultPacingGain)
+	}
+	for len(s.pacers) < n {
+		p := newPacer(rate, 0)
+		p.snmp = s.snmp
+		s.pacers = append(s.pacers, p)
+	}
+	for _, p := range s.pacers[:n] {
+		p.setRate(rate)
+	}
+	return s.pacers[:n]
+}
+
+// parallelTun returns the number of paths buf is sent on, as the duplication policy decides
+func (s *UDPStream) parallelTun(buf []byte, xmitMax uint32) (parallel int) {
+	info := PacketInfo{
+		Kind:    packetKind(buf[s.headerSize:]),
+		Size:    len(buf),
+		XmitMax: xmitMax,
+		Paths:   len(s.tunnels),
+		Level:   1,
+	}
+	if s.hp != nil {
+		info.Level = s.hp.levelPaths()
+		if info.Level > info.Paths {
+			info.Level = info.Paths
+		}
+	}
+	if s.parallelXmit == 0 || s.state < StateEstablish {
+		info.Parallel = true
 	} else if xmitMax >= s.parallelXmit && s.parallelExpire.IsZero() {
 		Logf(INFO, "UDPStream::parallelTun enter uuid:%v accepted:%v parallelXmit:%v xmitMax:%v", s.uuid, s.accepted, s.parallelXmit, xmitMax)
-		s.parallelExpire = time.Now().Add(s.parallelTime)
-		atomic.AddUint64(&DefaultSnmp.Parallels, 1)
+		s.parallelStart = time.Now()
+		s.parallelExpire = s.parallelStart.Add(s.parallelTime)
+		s.parallels++
+		s.snmp.add(func(m *Snmp) *uint64 { return &m.Parallels }, 1)
 		if s.hp != nil {
 			s.hp.incParallel()
 		}
-		return len(s.tunnels)
+		info.Parallel = true
 	} else if s.parallelExpire.IsZero() {
-		return 1
+		info.Parallel = false
 	} else if s.parallelExpire.After(time.Now()) {
-		return len(s.tunnels)
+		info.Parallel = true
 	} else {
 		Logf(INFO, "UDPStream::parallelTun leave uuid:%v accepted:%v parallelXmit:%v", s.uuid, s.accepted, s.parallelXmit)
+		s.parallelDur += s.parallelExpire.Sub(s.parallelStart)
 		s.parallelExpire = time.Time{}
-		return 1
 	}
+
+	parallel = s.dupPolicy.Paths(info)
+	if parallel < 1 {
+		parallel = 1
+	} else if parallel > len(s.tunnels) {
+		parallel = len(s.tunnels)
+	}
+	return parallel
 }
 
 func (s *UDPStream) output(buf []byte, xmitMax uint32) {
-	appendCount := s.parallelTun(xmitMax)
+	// striping spreads data, acknowledges and control frames are copied as the policy decides
+	appendCount := 1
+	if s.kcp.stripe == nil || packetKind(buf[s.headerSize:])&(PacketAck|PacketControl) != 0 {
+		appendCount = s.parallelTun(buf, xmitMax)
+	}
 	for i := len(s.msgss); i < appendCount; i++ {
 		s.msgss = append(s.msgss, make([]ipv4.Message, 0))
 	}
 
 	// Logf(DEBUG, "UDPStream::output uuid:%v accepted:%v len:%v xmitMax:%v appendCount:%v", s.uuid, s.accepted, len(buf), xmitMax, appendCount)
 
-	msg := ipv4.Message{}
 	copy(buf, s.uuid[:])
-	msg.Buffers = [][]byte{buf}
-	msg.Addr = s.remotes[0]
-	s.msgss[0] = append(s.msgss[0], msg)
+	// the tunnel tells handshake packets by the bytes following the uuid, clear the space it seals over
+	gap := buf[gouuid.Size : gouuid.Size+s.cryptOverhead]
+	for k := range gap {
+		gap[k] = 0
+	}
+	var ecc [][]byte
+	if s.fecEncoder != nil {
+		ecc = s.fecEncoder.encode(buf)
+	}
+	if s.kcp.stripe != nil {
+		s.outputStriped(buf, s.kcp.outPath, appendCount)
+	} else {
+		s.outputMsg(buf, appendCount)
+	}
+
+	// parity shards are sent as regular packets, the cache is rewritten by the next encode
+	size := len(buf)
+	for k := range ecc {
+		bts := xmitBuf.Get().([]byte)[:len(ecc[k])]
+		copy(bts, ecc[k])
+		copy(bts, s.uuid[:])
+		size += len(bts)
+		if s.kcp.stripe != nil {
+			s.outputPath(bts, s.kcp.outPath)
+		} else {
+			s.outputMsg(bts, appendCount)
+		}
+	}
 
-	for i := 1; i < appendCount; i++ {
+	if appendCount > 1 {
+		dup := uint64((appendCount - 1) * size)
+		s.snmp.addDup(s.dupPolicy.Name(), dup)
+	}
+}
+
+// outputMsg queues buf to the first appendCount paths, buf itself goes to the first path
+// and is queued last since a cookie header is inserted in place
+func (s *UDPStream) outputMsg(buf []byte, appendCount int) {
+	for i := appendCount - 1; i >= 0; i-- {
+		bts := buf
+		if i > 0 {
+			bts = xmitBuf.Get().([]byte)[:len(buf)]
+			copy(bts, buf)
+		}
+		if cookie, ok := s.cookies[s.remotes[i].String()]; ok && len(bts)+cookieHdrSize <= cap(bts) {
+			bts = wrapCookie(bts, cookie)
+		}
 		msg := ipv4.Message{}
-		bts := xmitBuf.Get().([]byte)[:len(buf)]
-		copy(bts, buf)
 		msg.Buffers = [][]byte{bts}
 		msg.Addr = s.remotes[i]
 		s.msgss[i] = append(s.msgss[i], msg)
+		s.traffic[i].sent++
 	}
 }
 
-func (s *UDPStream) input(data []byte) {
-	var kcpInErrors uint64
+// input feeds a packet received by tunnel from rAddr, tunnel is nil while the stream is opened
+func (s *UDPStream) input(data []byte, tunnel *UDPTunnel, rAddr net.Addr) {
+	var kcpInErrors, fecErrs, fecRecovered, fecParityShards uint64
+	accepted := false // KCP took the segments of the packet itself
 
 	s.mu.Lock()
-	if ret := s.kcp.Input(data[gouuid.Size:], true, false); ret != 0 {
-		kcpInErrors++
+	path := s.countRecv(tunnel, rAddr)
+	delivered := len(s.kcp.rcv_queue)
+	if pkt := fecPacket(data[gouuid.Size:]); !pkt.isFEC() {
+		if ret := s.kcp.Input(pkt, true, false); ret != 0 {
+			kcpInErrors++
+		} else {
+			accepted = true
+		}
+	} else {
+		if pkt.flag() == typeData {
+			if ret := s.kcp.Input(pkt[fecHeaderSizePlus2:], true, false); ret != 0 {
+				kcpInErrors++
+			} else {
+				accepted = true
+			}
+		} else {
+			fecParityShards++
+		}
+
+		// parity shards arriving before SYN negotiated FEC are dropped
+		if s.fecDecoder != nil {
+			for _, r := range s.fecDecoder.decode(pkt) {
+				if len(r) >= 2 { // must be larger than 2bytes
+					sz := binary.LittleEndian.Uint16(r)
+					if int(sz) <= len(r) && sz >= 2 {
+						if ret := s.kcp.Input(r[2:sz], false, false); ret == 0 {
+							fecRecovered++
+						} else {
+							kcpInErrors++
+						}
+					} else {
+						fecErrs++
+					}
+				} else {
+					fecErrs++
+				}
+				xmitBuf.Put(r)
+			}
+		}
+	}
+
+	if accepted && path >= 0 && s.kcp.ackRTT >= 0 {
+		s.observeAckRTT(path, time.Duration(s.kcp.ackRTT)*time.Millisecond)
+	}
+	s.inputControl(delivered)
+	if len(s.pendingPaths) > 0 {
+		s.activatePaths()
 	}
 
 	if n := s.kcp.PeekSize(); n > 0 {
@@ -798,24 +1232,83 @@ func (s *UDPStream) input(data []byte) {
 		s.notifyWriteEvent()
 	}
 
-	if !s.accepted && s.kcp.snd_una == 1 {
-		s.notifyDialEvent()
+	if !s.accepted && s.state < StateEstablish {
+		s.dialInput()
+	} else if s.accepted && s.state == StateSynRcvd && s.kcp.snd_una > 0 {
+		// SYN-ACK is the first segment of the acceptor
+		s.setState(StateEstablish)
 	}
 
+	// an incoming stream is acknowledged once accepted, see accept
+	pending := s.accepted && s.state == StateNone
 	acklen := len(s.kcp.acklist)
 	immediately := (s.ackNoDelay && acklen > 0) || uint32(acklen) > s.ackNoDelayCount || (float32(acklen)/float32(s.kcp.snd_wnd) > s.ackNoDelayRatio)
+	// without crypt the uuid travels in clear, only a packet KCP accepted may move a path
+	if tunnel != nil && (accepted || s.cryptOverhead > 0) && s.checkPath(tunnel, rAddr) {
+		immediately = true
+	}
 	s.mu.Unlock()
-	s.notifyFlushEvent(immediately)
+	if !pending {
+		s.notifyFlushEvent(immediately)
+	}
 
 	// Logf(DEBUG, "UDPStream::input uuid:%v accepted:%v len:%v rmtWnd:%v mmediately:%v", s.uuid, s.accepted, len(data), s.kcp.rmt_wnd, immediately)
 
-	atomic.AddUint64(&DefaultSnmp.InPkts, 1)
-	atomic.AddUint64(&DefaultSnmp.InBytes, uint64(len(data)))
 	if kcpInErrors > 0 {
-		atomic.AddUint64(&DefaultSnmp.KCPInErrors, kcpInErrors)
+		s.snmp.add(func(m *Snmp) *uint64 { return &m.KCPInErrors }, kcpInErrors)
+	}
+	if fecParityShards > 0 {
+		s.snmp.add(func(m *Snmp) *uint64 { return &m.FECParityShards }, fecParityShards)
+	}
+	if fecErrs > 0 {
+		s.snmp.add(func(m *Snmp) *uint64 { return &m.FECErrs }, fecErrs)
+	}
+	if fecRecovered > 0 {
+		s.snmp.add(func(m *Snmp) *uint64 { return &m.FECRecovered }, fecRecovered)
+	}
+}
+
+// dialInput reads the answer of the acceptor while dialing, SYN-ACK completes the dial
+// and RST refuses the stream
+func (s *UDPStream) dialInput() {
+	if len(s.kcp.rcv_queue) == 0 || len(s.kcp.rcv_queue[0].data) == 0 || s.dialErr != nil {
+		return
+	}
+	switch s.kcp.rcv_queue[0].data[0] {
+	case RST:
+		// RST stays queued for Read
+		if size := s.kcp.PeekSize(); size > 0 && rstReason(s.kcp.rcv_queue[0].data[1:size]) == reasonVersion {
+			s.dialErr = errProtoVersion
+		}
+		s.reset()
+	case SYNACK:
+		size := s.kcp.PeekSize()
+		if size <= 0 {
+			return
+		}
+		buf := make([]byte, size)
+		s.kcp.Recv(buf)
+		synAck, err := decodeSyn(buf[1:])
+		if err == nil && len(synAck.locals) != len(s.remotes) {
+			err = errSynInfo
+		}
+		if err != nil {
+			Logf(WARN, "UDPStream::dialInput bad SYN-ACK. uuid:%v err:%v", s.uuid, err)
+			s.dialErr = err
+		} else {
+			Logf(INFO, "UDPStream::dialInput uuid:%v remotes:%v peerLocals:%v caps:%v", s.uuid, s.remotes, synAck.locals, synAck.caps)
+			s.peerCaps = synAck.caps
+		}
+		s.notifyDialEvent()
 	}
 }
 
+func (s *UDPStream) getDialErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dialErr
+}
+
 func (s *UDPStream) notifyDialEvent() {
 	select {
 	case s.chDialEvent <- struct{}{}:
@@ -850,12 +1343,18 @@ func (s *UDPStream) cmdRead(flag byte, data []byte, b []byte) (n int, err error)
 		return s.recvPsh(data, b)
 	case SYN:
 		return s.recvSyn(data)
+	case SYNACK:
+		// read by dialInput, a retransmission is ignored
+		return len(data), nil
 	case FIN:
 		return s.recvFin(data)
 	case HRT:
 		return s.recvHrt(data)
 	case RST:
 		return s.recvRst(data)
+	case PATH:
+		// moved to the receive queue by Recv, after inputControl ran
+		return s.recvPath(data)
 	default:
 		return 0, errStreamFlag
 	}
@@ -876,8 +1375,11 @@ func (s *UDPStream) recvSyn(data []byte) (n int, err error) {
 		return len(data), nil
 	}
 
-	endpointInfo := string(data)
-	remotes := strings.Split(endpointInfo, " ")
+	syn, err := decodeSyn(data)
+	if err != nil {
+		return len(data), err
+	}
+	remotes := syn.locals
 	if len(remotes) == 0 {
 		return len(data), errSynInfo
 	}
@@ -899,26 +1401,38 @@ func (s *UDPStream) recvSyn(data []byte) (n int, err error) {
 		locals[i] = tunnel.LocalAddr()
 	}
 
+	if !s.setFEC(syn.dataShards, syn.parityShards) {
+		return len(data), errSynInfo
+	}
+
 	s.tunnels = tunnels
 	s.locals = locals
 	s.remotes = remoteAddrs
+	s.resetPaths()
+	s.metadata = syn.metadata
+	s.peerCaps = syn.caps
 
-	Logf(INFO, "UDPStream::recvSyn uuid:%v accepted:%v locals:%v remotes:%v", s.uuid, s.accepted, locals, remotes)
+	Logf(INFO, "UDPStream::recvSyn uuid:%v accepted:%v locals:%v remotes:%v dataShards:%v parityShards:%v metadata:%v caps:%v", s.uuid, s.accepted, locals, remotes, syn.dataShards, syn.parityShards, len(syn.metadata), syn.caps)
 	return len(data), nil
 }
 
 func (s *UDPStream) recvFin(data []byte) (n int, err error) {
 	Logf(INFO, "UDPStream::recvFin uuid:%v accepted:%v", s.uuid, s.accepted)
+	if _, err = decodeControl(data); err != nil {
+		return len(data), err
+	}
 
 	s.recvFinOnce.Do(func() {
 		close(s.chRecvFinEvent)
+		s.recvdFin()
 	})
 	return len(data), io.EOF
 }
 
 func (s *UDPStream) recvHrt(data []byte) (n int, err error) {
 	Logf(DEBUG, "UDPStream::recvHrt uuid:%v accepted:%v", s.uuid, s.accepted)
-	return len(data), nil
+	_, err = decodeControl(data)
+	return len(data), err
 }
 
 func (s *UDPStream) recvRst(data []byte) (n int, err error) {
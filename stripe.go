@@ -0,0 +1,141 @@
+package kcp
+
+import (
+	"time"
+)
+
+// MultipathMode is how a stream with several paths schedules its packets
+type MultipathMode int
+
+const (
+	// MultipathRedundant sends on the first path and copies every packet to every path
+	// while retransmissions pile up, see SetParallelXmit
+	MultipathRedundant MultipathMode = iota
+	// MultipathStriped spreads new segments over the paths in proportion to their weights,
+	// a retransmission goes on another path than the one that lost it. Packets carrying
+	// acknowledges or control frames are copied as the DuplicationPolicy decides.
+	MultipathStriped
+)
+
+func (m MultipathMode) String() string {
+	switch m {
+	case MultipathRedundant:
+		return "redundant"
+	case MultipathStriped:
+		return "striped"
+	}
+	return "unknown"
+}
+
+// SetMultipathMode selects how packets are scheduled on the paths of the stream.
+// A striped path is weighted by the inverse of its rtt and by the share of pings it
+// delivers, paths not measured yet are weighted by the rtt of the stream.
+func (s *UDPStream) SetMultipathMode(mode MultipathMode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	Logf(INFO, "UDPStream::SetMultipathMode uuid:%v accepted:%v mode:%v", s.uuid, s.accepted, mode)
+
+	s.multipathMode = mode
+	if mode == MultipathStriped {
+		s.kcp.stripe = s.stripe
+	} else {
+		s.kcp.stripe = nil
+	}
+}
+
+// stripeWeights returns the weight of each path in a buffer reused by the next call,
+// s.mu must be held
+func (s *UDPStream) stripeWeights() []float64 {
+	if cap(s.stripeBuf) < len(s.tunnels) {
+		s.stripeBuf = make([]float64, len(s.tunnels))
+	}
+	weights := s.stripeBuf[:len(s.tunnels)]
+	for i := range weights {
+		rtt := time.Duration(s.kcp.rx_srtt) * time.Millisecond
+		loss := 0.0
+		if i < len(s.health) && s.health[i].recvd > 0 {
+			rtt, loss = s.health[i].srtt, s.health[i].loss
+		}
+		if rtt < time.Millisecond {
+			rtt = time.Millisecond
+		}
+		weights[i] = float64(time.Second) / float64(rtt) * (1 - loss)
+	}
+	return weights
+}
+
+// stripe picks the path of a segment about to be sent, a retransmission goes on the best
+// path except its last one and a new segment on the next path of a smooth weighted round robin.
+// s.mu must be held.
+func (s *UDPStream) stripe(seg *segment) int {
+	n := len(s.tunnels)
+	if n == 1 {
+		return 0
+	}
+	weights := s.stripeWeights()
+
+	if seg.xmit > 1 && seg.path >= 0 && int(seg.path) < n {
+		best := -1
+		for i, w := range weights {
+			if i != int(seg.path) && (best < 0 || w > weights[best]) {
+				best = i
+			}
+		}
+		return best
+	}
+
+	if len(s.stripeCredits) != n {
+		s.stripeCredits = make([]float64, n)
+	}
+	best, total := 0, 0.0
+	for i, w := range weights {
+		s.stripeCredits[i] += w
+		total += w
+		if s.stripeCredits[i] > s.stripeCredits[best] {
+			best = i
+		}
+	}
+	s.stripeCredits[best] -= total
+	return best
+}
+
+// removeStripePath forgets path i in the segments waiting for an ack, the paths after it
+// move down by one. s.mu must be held.
+func (s *UDPStream) removeStripePath(i int) {
+	for k := range s.kcp.snd_buf {
+		seg := &s.kcp.snd_buf[k]
+		if int(seg.path) == i {
+			seg.path = -1
+		} else if int(seg.path) > i {
+			seg.path--
+		}
+	}
+	if i < len(s.stripeCredits) {
+		s.stripeCredits = append(s.stripeCredits[:i], s.stripeCredits[i+1:]...)
+	}
+}
+
+// outputStriped queues buf to path and copies it to the next appendCount-1 paths
+func (s *UDPStream) outputStriped(buf []byte, path, appendCount int) {
+	n := len(s.tunnels)
+	if path < 0 || path >= n {
+		path = 0
+	}
+	for i := 1; i < appendCount && i < n; i++ {
+		bts := xmitBuf.Get().([]byte)[:len(buf)]
+		copy(bts, buf)
+		s.outputPath(bts, (path+i)%n)
+	}
+	s.outputPath(buf, path)
+}
+
+// outputPath queues buf to path, what is sent to any path goes on the first one
+func (s *UDPStream) outputPath(buf []byte, path int) {
+	if path < 0 || path >= len(s.tunnels) {
+		path = 0
+	}
+	if cookie, ok := s.cookies[s.remotes[path].String()]; ok && len(buf)+cookieHdrSize <= cap(buf) {
+		buf = wrapCookie(buf, cookie)
+	}
+	s.queueRaw(path, s.remotes[path], buf)
+}
@@ -0,0 +1,122 @@
+package kcp
+
+import (
+	"testing"
+	"time"
+
+	gouuid "github.com/satori/go.uuid"
+)
+
+func TestStripe(t *testing.T) {
+	sel := NewRoundRobinSelector()
+	for _, tunnel := range selectorTunnels(2) {
+		sel.Add(tunnel)
+	}
+	uuid, _ := gouuid.NewV1()
+	s, err := NewUDPStream(uuid, false, []string{"127.0.0.1:9100", "127.0.0.1:9101"}, nil, sel, func(gouuid.UUID) {})
+	checkError(t, err)
+	defer s.Close()
+	s.SetMultipathMode(MultipathStriped)
+	if s.kcp.stripe == nil {
+		t.Fatal("striping not enabled")
+	}
+
+	// the faster path takes a share of new segments in proportion to its rtt
+	s.mu.Lock()
+	s.health[0].ack(time.Millisecond * 10)
+	s.health[1].ack(time.Millisecond * 30)
+	counts := make([]int, 2)
+	for i := 0; i < 400; i++ {
+		seg := segment{xmit: 1}
+		counts[s.stripe(&seg)]++
+	}
+	if counts[0] != 300 || counts[1] != 100 {
+		t.Fatalf("striped segments. counts:%v", counts)
+	}
+
+	// a retransmission moves to the other path
+	for path := 0; path < 2; path++ {
+		seg := segment{xmit: 2, path: int8(path)}
+		if p := s.stripe(&seg); p == path {
+			t.Fatalf("retransmitted on the same path. path:%v", p)
+		}
+	}
+	s.mu.Unlock()
+
+	// acknowledges and control frames follow the duplication policy, data stays striped
+	s.SetDuplicationPolicy(SelectiveDuplication{})
+	s.mu.Lock()
+	s.state = StateEstablish
+	for _, c := range []struct {
+		buf   []byte
+		paths int
+	}{
+		{testPacket(s, IKCP_CMD_ACK, nil), 2},
+		{testPacket(s, IKCP_CMD_PUSH, []byte{FIN, protoVersion}), 2},
+		{testPacket(s, IKCP_CMD_PUSH, []byte{PSH, 'x'}), 1},
+	} {
+		s.msgss = nil
+		s.output(c.buf, 1)
+		paths := 0
+		for _, msgs := range s.msgss {
+			if len(msgs) > 0 {
+				paths++
+			}
+		}
+		if paths != c.paths {
+			t.Fatalf("striped copies. kind:%v paths:%v want:%v", packetKind(c.buf[s.headerSize:]), paths, c.paths)
+		}
+	}
+	s.msgss = nil
+
+	// queued segments forget a removed path and follow the paths moving down
+	s.kcp.snd_buf = []segment{{xmit: 2, path: 0}, {xmit: 2, path: 1}}
+	s.removeStripePath(0)
+	if s.kcp.snd_buf[0].path != -1 || s.kcp.snd_buf[1].path != 0 || len(s.stripeCredits) != 1 {
+		t.Fatalf("removed path. segments:%v credits:%v", s.kcp.snd_buf, s.stripeCredits)
+	}
+	s.kcp.snd_buf = nil
+	s.mu.Unlock()
+
+	s.SetMultipathMode(MultipathRedundant)
+	if s.kcp.stripe != nil {
+		t.Fatal("striping not disabled")
+	}
+}
+
+func TestStripedTransfer(t *testing.T) {
+	lAddrs := []string{"127.0.0.1:7381", "127.0.0.1:27381"}
+	rAddrs := []string{"127.0.0.1:17381", "127.0.0.1:37381"}
+	client, server := newTransportPair(t, lAddrs, rAddrs, nil, nil)
+	dialer, acceptor := openPair(t, client, server, lAddrs, rAddrs, 2, true)
+	defer client.Close()
+	defer server.Close()
+	defer dialer.Close()
+	dialer.SetNoDelay(1, 10, 2, 1)
+	dialer.SetMultipathMode(MultipathStriped)
+
+	// new segments use the second path as well
+	acceptor.mu.Lock()
+	last := acceptor.pathRecv[1]
+	acceptor.mu.Unlock()
+	checkError(t, echoTester(dialer, 32*1024, 4))
+	acceptor.mu.Lock()
+	used := acceptor.pathRecv[1].After(last)
+	acceptor.mu.Unlock()
+	if !used {
+		t.Fatal("second path not used")
+	}
+
+	// segments lost on a dead path are retransmitted on the other one
+	server.sel.Pick(lAddrs[1:])[0].Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- echoTester(dialer, 32*1024, 4)
+	}()
+	select {
+	case err := <-done:
+		checkError(t, err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("striped transfer stalled on a dead path")
+	}
+}
@@ -0,0 +1,88 @@
+package kcp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errMetadataSize = errors.New("err metadata size")
+
+// Metadata is an opaque key/value blob sent by the dialer in SYN, it is available
+// to the AcceptFilter and on both ends of the stream. It must be treated as read-only.
+type Metadata map[string][]byte
+
+// synInfo is the payload of SYN and SYN-ACK, a control frame with the tlvs
+// tlvCaps, tlvLocal for every endpoint, tlvFEC if enabled and tlvMetadata for every pair
+type synInfo struct {
+	caps         Capabilities
+	locals       []string // endpoints of the sender
+	dataShards   int
+	parityShards int
+	metadata     Metadata
+}
+
+func (syn *synInfo) encode() ([]byte, error) {
+	var caps [4]byte
+	binary.LittleEndian.PutUint32(caps[:], uint32(syn.caps))
+	tlvs := []tlv{{tlvCaps, caps[:]}}
+	for _, local := range syn.locals {
+		tlvs = append(tlvs, tlv{tlvLocal, []byte(local)})
+	}
+	if syn.dataShards > 0 && syn.parityShards > 0 {
+		if syn.dataShards > 0xff || syn.parityShards > 0xff {
+			return nil, errSynInfo
+		}
+		tlvs = append(tlvs, tlv{tlvFEC, []byte{byte(syn.dataShards), byte(syn.parityShards)}})
+	}
+	for k, v := range syn.metadata {
+		if len(k) > 0xffff {
+			return nil, errMetadataSize
+		}
+		pair := appendUint16(make([]byte, 0, 2+len(k)+len(v)), uint16(len(k)))
+		pair = append(pair, k...)
+		pair = append(pair, v...)
+		tlvs = append(tlvs, tlv{tlvMetadata, pair})
+	}
+
+	buf, err := encodeControl(tlvs...)
+	if err == errControlFrame {
+		err = errMetadataSize
+	}
+	return buf, err
+}
+
+// decodeSyn copies everything out of data, it points into the receive buffer
+func decodeSyn(data []byte) (*synInfo, error) {
+	tlvs, err := decodeControl(data)
+	if err != nil {
+		return nil, err
+	}
+
+	syn := new(synInfo)
+	for _, t := range tlvs {
+		switch t.typ {
+		case tlvCaps:
+			if len(t.value) != 4 {
+				return nil, errSynInfo
+			}
+			syn.caps = Capabilities(binary.LittleEndian.Uint32(t.value))
+		case tlvLocal:
+			syn.locals = append(syn.locals, string(t.value))
+		case tlvFEC:
+			if len(t.value) != 2 {
+				return nil, errSynInfo
+			}
+			syn.dataShards, syn.parityShards = int(t.value[0]), int(t.value[1])
+		case tlvMetadata:
+			if len(t.value) < 2 || len(t.value) < 2+int(binary.LittleEndian.Uint16(t.value)) {
+				return nil, errSynInfo
+			}
+			kl := 2 + int(binary.LittleEndian.Uint16(t.value))
+			if syn.metadata == nil {
+				syn.metadata = make(Metadata)
+			}
+			syn.metadata[string(t.value[2:kl])] = append([]byte(nil), t.value[kl:]...)
+		}
+	}
+	return syn, nil
+}
@@ -0,0 +1,102 @@
+package kcp
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestSynCodec(t *testing.T) {
+	syn := &synInfo{
+		caps:         CapFEC | CapEncryption,
+		locals:       []string{"127.0.0.1:7001", "[::1]:7002"},
+		dataShards:   10,
+		parityShards: 3,
+		metadata:     Metadata{"service": []byte("echo"), "tenant": {0, 1, 2}, "empty": nil},
+	}
+	data, err := syn.encode()
+	checkError(t, err)
+	decoded, err := decodeSyn(data)
+	checkError(t, err)
+	if decoded.caps != syn.caps || len(decoded.locals) != 2 || decoded.locals[1] != syn.locals[1] || decoded.dataShards != 10 || decoded.parityShards != 3 {
+		t.Fatalf("syn decoded wrong. syn:%+v", decoded)
+	}
+	if len(decoded.metadata) != 3 || !bytes.Equal(decoded.metadata["tenant"], []byte{0, 1, 2}) || len(decoded.metadata["empty"]) != 0 {
+		t.Fatalf("metadata decoded wrong. metadata:%v", decoded.metadata)
+	}
+
+	// decoded metadata must not alias the receive buffer
+	for k := range data {
+		data[k] = 0
+	}
+	if string(decoded.metadata["service"]) != "echo" {
+		t.Fatal("metadata aliases the packet")
+	}
+
+	data, err = (&synInfo{locals: []string{"127.0.0.1:7001"}}).encode()
+	checkError(t, err)
+	decoded, err = decodeSyn(data)
+	checkError(t, err)
+	if len(decoded.locals) != 1 || decoded.dataShards != 0 || decoded.metadata != nil {
+		t.Fatalf("plain syn decoded wrong. syn:%+v", decoded)
+	}
+	if _, err = decodeSyn(data[:len(data)-1]); err != errControlFrame {
+		t.Fatal("truncated syn accepted")
+	}
+
+	if _, err = (&synInfo{locals: []string{"127.0.0.1:7001"}, metadata: Metadata{"big": make([]byte, 0x10000)}}).encode(); err != errMetadataSize {
+		t.Fatal("oversized metadata encoded")
+	}
+}
+
+func TestOpenWithMetadata(t *testing.T) {
+	lAddr, rAddr := "127.0.0.1:7251", "127.0.0.1:17251"
+	md := Metadata{"service": []byte("echo"), "target": []byte("10.0.0.1:80")}
+
+	filtered := make(chan Metadata, 1)
+	serverSel, _ := NewTestSelector([]string{rAddr}, []string{lAddr})
+	server, err := NewUDPTransport(serverSel, &TransportOption{AcceptFilter: func(info *AcceptInfo) AcceptDecision {
+		filtered <- info.Metadata
+		return AcceptStream
+	}})
+	checkError(t, err)
+	defer server.Close()
+	_, err = server.NewTunnel(rAddr)
+	checkError(t, err)
+	accepted := make(chan *UDPStream, 1)
+	go func() {
+		stream, err := server.Accept()
+		if err == nil {
+			accepted <- stream
+			handleEchoClient(stream)
+		}
+	}()
+
+	clientSel, _ := NewTestSelector([]string{lAddr}, []string{rAddr})
+	client, err := NewUDPTransport(clientSel, nil)
+	checkError(t, err)
+	defer client.Close()
+	_, err = client.NewTunnel(lAddr)
+	checkError(t, err)
+
+	// SYN larger than a packet
+	if _, err = client.OpenWithMetadata([]string{lAddr}, []string{rAddr}, Metadata{"big": make([]byte, 2048)}); err != errMetadataSize {
+		t.Fatalf("oversized metadata. err:%v", err)
+	}
+
+	stream, err := client.OpenContextWithMetadata(context.Background(), []string{lAddr}, []string{rAddr}, md)
+	checkError(t, err)
+	defer stream.Close()
+	checkError(t, echoTester(stream, 1024, 4))
+
+	if got := <-filtered; string(got["target"]) != "10.0.0.1:80" {
+		t.Fatalf("filter metadata:%v", got)
+	}
+	s := <-accepted
+	if got := s.Metadata(); len(got) != 2 || string(got["service"]) != "echo" {
+		t.Fatalf("accepted metadata:%v", got)
+	}
+	if got := stream.Metadata(); string(got["service"]) != "echo" {
+		t.Fatalf("dialer metadata:%v", got)
+	}
+}
@@ -1,6 +1,7 @@
 package kcp
 
 import (
+	"context"
 	"io"
 	"net"
 	"sync"
@@ -16,6 +17,8 @@ var (
 	DefaultInputQueue      = 128
 	DefaultTunnelProcessor = 5
 	DefaultInputTime       = 3
+	DefaultDrainInterval   = time.Millisecond * 50
+	DefaultParallelIdle    = time.Minute * 5
 )
 
 type LogLevel int
@@ -46,8 +49,11 @@ func (l LogLevel) String() string {
 	panic("invalid LogLevel")
 }
 
+// TunnelSelector picks a tunnel for each remote of a stream. Pick is called concurrently,
+// a closed tunnel is removed by the transport. See RoundRobinSelector and the others.
 type TunnelSelector interface {
 	Add(tunnel *UDPTunnel)
+	Remove(tunnel *UDPTunnel)
 	Pick(remotes []string) (tunnels []*UDPTunnel)
 }
 
@@ -60,6 +66,25 @@ type TransportOption struct {
 	ParallelCheckPeriods int
 	ParallelStreamRate   float64
 	ParallelDuration     time.Duration
+	ParallelIdle         time.Duration // a remote host without streams for so long is forgotten by its policy
+	ParallelPolicy       HostPolicy    // creates the policy of each remote host, overrides ParallelCheckPeriods if set
+	StreamOption         *StreamOption // applied to every new stream if set
+	TunnelOption         *TunnelOption // applied to every new tunnel if set
+	CryptOption          *CryptOption  // encrypt all packets if set
+	AcceptFilter         AcceptFilter  // decides about every incoming stream if set
+	SynCookie            bool          // allocate a passive stream only after the dialer repeats a retry cookie, forced for a handshake without PSK
+	OpenRate             float64       // new streams per second accepted from one source ip, 0 disables the limit
+	OpenBurst            int           // new streams accepted at once from one source ip, 0 means OpenRate
+	MigrationHook        MigrationHook // called when a stream moves a path to a new remote address
+	Snmp                 *Snmp         // counters of the transport and its streams, created if nil
+}
+
+// handshake returns the handshake option of CryptOption, nil if none
+func (opt *TransportOption) handshake() *HandshakeOption {
+	if opt.CryptOption == nil {
+		return nil
+	}
+	return opt.CryptOption.Handshake
 }
 
 func (opt *TransportOption) SetDefault() *TransportOption {
@@ -78,19 +103,34 @@ func (opt *TransportOption) SetDefault() *TransportOption {
 	if opt.InputTime == 0 {
 		opt.InputTime = DefaultInputTime
 	}
+	if opt.ParallelIdle == 0 {
+		opt.ParallelIdle = DefaultParallelIdle
+	}
 	return opt
 }
 
 type StreamOption struct {
-	Nodelay  int
-	Interval int
-	Resend   int
-	Nc       int
+	Nodelay    int
+	Interval   int
+	Resend     int
+	Nc         int
+	Pacing     bool   // pace packets of the stream
+	PacingRate uint64 // bytes per second, 0 derives the rate from cwnd/srtt
+
+	DataShards   int // FEC data shards, 0 disables FEC
+	ParityShards int // FEC parity shards, 0 disables FEC
+
+	PathTimeout       time.Duration     // silent paths are removed after this long, 0 means DefaultPathTimeout
+	PathProbeInterval time.Duration     // paths are pinged this often if the peer has CapPathProbe, 0 means DefaultPathProbeInterval
+	MultipathMode     MultipathMode     // how packets are scheduled on the paths
+	DuplicationPolicy DuplicationPolicy // what is copied to other paths, nil means ParallelDuplication
 }
 
 type TunnelOption struct {
 	ReadBuffer  int
 	WriteBuffer int
+	PacingRate  uint64 // bytes per second of the tunnel token bucket, 0 disables pacing
+	PacingBurst int    // token bucket size in bytes, 0 means DefaultPacingBurst
 }
 
 var FastStreamOption = &StreamOption{
@@ -106,8 +146,9 @@ var DefaultTunOption = &TunnelOption{
 }
 
 type inputMsg struct {
-	data []byte
-	addr net.Addr
+	tunnel *UDPTunnel
+	data   []byte
+	addr   net.Addr
 }
 
 type inputTest struct {
@@ -119,13 +160,24 @@ type UDPTransport struct {
 	*TransportOption
 	streamm       ConcurrentMap
 	startAccept   int32
+	acceptMu      sync.Mutex // orders enabling passive opens with stopAccept
+	closing       int32      // stop passive opens once shutdown has started
 	preAcceptChan chan chan *UDPStream
 	tunnelHostM   map[string]*UDPTunnel
+	tunnelMu      sync.Mutex
 	sel           TunnelSelector
-	die           chan struct{} // notify the listener has closed
+	die           chan struct{} // notify the transport has closed
 	dieOnce       sync.Once
 	inputQueues   []chan *inputMsg
 	pc            *parallelCtrl
+	crypt         *packetCrypt
+	hs            *handshaker
+	cookies       *cookieJar    // nil unless SynCookie
+	limiter       *openLimiter  // nil unless OpenRate
+	verdicts      *verdictCache // streams refused by AcceptFilter, nil unless AcceptFilter
+	snmp          *Snmp
+	rttHist       *histogram // rtt of path probes and sampled acks, see MetricsHandler
+	dialHist      *histogram // time to open a stream, successful opens only
 }
 
 func NewUDPTransport(sel TunnelSelector, opt *TransportOption) (t *UDPTransport, err error) {
@@ -133,6 +185,9 @@ func NewUDPTransport(sel TunnelSelector, opt *TransportOption) (t *UDPTransport,
 		opt = &TransportOption{}
 	}
 	opt.SetDefault()
+	if sel == nil {
+		sel = NewRoundRobinSelector()
+	}
 	t = &UDPTransport{
 		TransportOption: opt,
 		streamm:         NewConcurrentMap(),
@@ -142,8 +197,46 @@ func NewUDPTransport(sel TunnelSelector, opt *TransportOption) (t *UDPTransport,
 		die:             make(chan struct{}),
 		inputQueues:     make([]chan *inputMsg, 0),
 	}
-	if opt.ParallelCheckPeriods != 0 && opt.ParallelDuration != 0 {
-		t.pc = newParallelCtrl(int64(opt.ParallelCheckPeriods), opt.ParallelStreamRate, opt.ParallelDuration)
+	t.snmp = aggregateSnmp(opt.Snmp, rootSnmp())
+	t.rttHist = newHistogram(DefaultRTTBuckets)
+	t.dialHist = newHistogram(DefaultDialBuckets)
+	if opt.ParallelPolicy != nil {
+		t.pc = newParallelCtrl(opt.ParallelPolicy, opt.ParallelIdle, t.snmp)
+	} else if opt.ParallelCheckPeriods != 0 && opt.ParallelDuration != 0 {
+		Logf(WARN, "NewUDPTransport ring parallel policy. periods:%v rate:%v duration:%v", opt.ParallelCheckPeriods, opt.ParallelStreamRate, opt.ParallelDuration)
+		t.pc = newParallelCtrl(func(string) ParallelPolicy {
+			return NewRingParallelPolicy(int64(opt.ParallelCheckPeriods), opt.ParallelStreamRate, opt.ParallelDuration)
+		}, opt.ParallelIdle, t.snmp)
+	}
+	if hs := opt.handshake(); hs != nil && len(hs.PSK) == 0 && !opt.SynCookie {
+		// anyone may compute a hello for a listed static key, a forged source must not take
+		// a handshake slot
+		Logf(INFO, "NewUDPTransport handshake without psk, syn cookie enabled")
+		opt.SynCookie = true
+	}
+	if opt.SynCookie {
+		if t.cookies, err = newCookieJar(); err != nil {
+			Logf(ERROR, "NewUDPTransport cookie failed. err:%v", err)
+			return nil, err
+		}
+	}
+	if opt.OpenRate > 0 {
+		t.limiter = newOpenLimiter(opt.OpenRate, opt.OpenBurst)
+	}
+	if opt.AcceptFilter != nil {
+		t.verdicts = newVerdictCache(DefaultFilterVerdictTTL, DefaultFilterVerdicts)
+	}
+	if opt.CryptOption != nil {
+		if t.crypt, err = newPacketCrypt(opt.CryptOption); err != nil {
+			Logf(ERROR, "NewUDPTransport crypt failed. method:%v err:%v", opt.CryptOption.Method, err)
+			return nil, err
+		}
+		if opt.CryptOption.Handshake != nil {
+			if t.hs, err = newHandshaker(opt.CryptOption.Handshake, opt.AcceptBacklog); err != nil {
+				Logf(ERROR, "NewUDPTransport handshake failed. err:%v", err)
+				return nil, err
+			}
+		}
 	}
 	return t, nil
 }
@@ -151,6 +244,15 @@ func NewUDPTransport(sel TunnelSelector, opt *TransportOption) (t *UDPTransport,
 func (t *UDPTransport) NewTunnel(lAddr string) (tunnel *UDPTunnel, err error) {
 	Logf(INFO, "UDPTransport::NewTunnel lAddr:%v", lAddr)
 
+	select {
+	case <-t.die:
+		return nil, io.ErrClosedPipe
+	default:
+	}
+
+	t.tunnelMu.Lock()
+	defer t.tunnelMu.Unlock()
+
 	tunnel, ok := t.tunnelHostM[lAddr]
 	if ok {
 		return tunnel, nil
@@ -158,23 +260,29 @@ func (t *UDPTransport) NewTunnel(lAddr string) (tunnel *UDPTunnel, err error) {
 
 	tunnelIdx := len(t.inputQueues)
 	for i := 0; i < t.TunnelProcessor; i++ {
-		t.inputQueues = append(t.inputQueues, make(chan *inputMsg, t.InputQueue))
-		go t.processInput(tunnelIdx + i)
+		queue := make(chan *inputMsg, t.InputQueue)
+		t.inputQueues = append(t.inputQueues, queue)
+		go t.processInput(queue)
 	}
+	queues := t.inputQueues[tunnelIdx:]
 
 	inputPoll := 0
-	tunnel, err = NewUDPTunnel(lAddr, func(tun *UDPTunnel, data []byte, addr net.Addr) {
-		msg := &inputMsg{data: data, addr: addr}
+	tunnel, err = newUDPTunnel(lAddr, t.crypt, t.snmp, func(tun *UDPTunnel, data []byte, addr net.Addr) {
+		msg := &inputMsg{tunnel: tun, data: data, addr: addr}
 		for i := 0; i < t.InputTime-1; i++ {
-			idx := inputPoll%t.TunnelProcessor + tunnelIdx
+			idx := inputPoll % t.TunnelProcessor
 			inputPoll++
 			select {
-			case t.inputQueues[idx] <- msg:
+			case queues[idx] <- msg:
 				return
 			default:
 			}
 		}
-		t.inputQueues[inputPoll%t.TunnelProcessor+tunnelIdx] <- msg
+		select {
+		case queues[inputPoll%t.TunnelProcessor] <- msg:
+		case <-t.die:
+			xmitBuf.Put(data)
+		}
 	})
 
 	if err != nil {
@@ -182,11 +290,37 @@ func (t *UDPTransport) NewTunnel(lAddr string) (tunnel *UDPTunnel, err error) {
 		return nil, err
 	}
 
+	if t.TransportOption.TunnelOption != nil {
+		if err = tunnel.SetOption(t.TransportOption.TunnelOption); err != nil {
+			Logf(ERROR, "UDPTransport::NewTunnel SetOption failed. lAddr:%v err:%v", lAddr, err)
+			tunnel.Close()
+			return nil, err
+		}
+	}
+
 	t.sel.Add(tunnel)
 	t.tunnelHostM[lAddr] = tunnel
+	go t.watchTunnel(lAddr, tunnel)
 	return tunnel, nil
 }
 
+// watchTunnel stops picking tunnel once it is closed
+func (t *UDPTransport) watchTunnel(lAddr string, tunnel *UDPTunnel) {
+	select {
+	case <-tunnel.die:
+	case <-t.die:
+		return
+	}
+	Logf(INFO, "UDPTransport::watchTunnel closed lAddr:%v", lAddr)
+
+	t.tunnelMu.Lock()
+	if t.tunnelHostM[lAddr] == tunnel {
+		delete(t.tunnelHostM, lAddr)
+	}
+	t.tunnelMu.Unlock()
+	t.sel.Remove(tunnel)
+}
+
 func (t *UDPTransport) NewStream(uuid gouuid.UUID, accepted bool, remotes []string) (stream *UDPStream, err error) {
 	Logf(INFO, "UDPTransport::NewStream uuid:%v accepted:%v remotes:%v", uuid, accepted, remotes)
 
@@ -197,6 +331,12 @@ func (t *UDPTransport) NewStream(uuid gouuid.UUID, accepted bool, remotes []stri
 		Logf(ERROR, "UDPTransport::NewStream uuid:%v accepted:%v remotes:%v err:%v", uuid, accepted, remotes, err)
 		return nil, err
 	}
+	stream.setSnmp(t.snmp)
+	stream.rttHist = t.rttHist
+	if t.TransportOption.StreamOption != nil {
+		stream.SetOption(t.TransportOption.StreamOption)
+	}
+	stream.migrationHook = t.MigrationHook
 	return stream, err
 }
 
@@ -206,34 +346,101 @@ func (t *UDPTransport) Open(locals, remotes []string) (stream *UDPStream, err er
 }
 
 func (t *UDPTransport) OpenTimeout(locals, remotes []string, timeout time.Duration) (stream *UDPStream, err error) {
-	Logf(INFO, "UDPTransport::OpenTimeout locals:%v remotes:%v timeout:%v", locals, remotes, timeout)
+	if timeout == 0 {
+		timeout = t.DialTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return t.OpenContext(ctx, locals, remotes)
+}
+
+// OpenContext opens a stream, the dial is aborted when ctx is done.
+// If ctx has no deadline, DialTimeout is applied.
+func (t *UDPTransport) OpenContext(ctx context.Context, locals, remotes []string) (stream *UDPStream, err error) {
+	return t.OpenContextWithMetadata(ctx, locals, remotes, nil)
+}
+
+// OpenWithMetadata opens a stream sending md to the acceptor in SYN, see Metadata
+func (t *UDPTransport) OpenWithMetadata(locals, remotes []string, md Metadata) (stream *UDPStream, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), t.DialTimeout)
+	defer cancel()
+	return t.OpenContextWithMetadata(ctx, locals, remotes, md)
+}
+
+// OpenContextWithMetadata opens a stream sending md to the acceptor in SYN, the dial is aborted when ctx is done.
+// SYN must fit in a single packet, errMetadataSize is returned otherwise.
+func (t *UDPTransport) OpenContextWithMetadata(ctx context.Context, locals, remotes []string, md Metadata) (stream *UDPStream, err error) {
+	Logf(INFO, "UDPTransport::OpenContext locals:%v remotes:%v metadata:%v", locals, remotes, len(md))
+
+	start := time.Now()
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.DialTimeout)
+		defer cancel()
+	}
 
 	uuid, err := gouuid.NewV1()
 	if err != nil {
-		Logf(ERROR, "UDPTransport::OpenTimeout NewV1 failed. locals:%v remotes:%v err:%v", locals, remotes, err)
+		Logf(ERROR, "UDPTransport::OpenContext NewV1 failed. locals:%v remotes:%v err:%v", locals, remotes, err)
 		return nil, err
 	}
 
 	stream, err = t.NewStream(uuid, false, remotes)
 	if err != nil {
-		Logf(ERROR, "UDPTransport::OpenTimeout NewStream failed. uuid:%v locals:%v remotes:%v err:%v", uuid, locals, remotes, err)
+		Logf(ERROR, "UDPTransport::OpenContext NewStream failed. uuid:%v locals:%v remotes:%v err:%v", uuid, locals, remotes, err)
+		t.snmp.add(func(m *Snmp) *uint64 { return &m.DialErrs }, 1)
 		return nil, err
 	}
+	stream.metadata = md
 	t.streamm.Set(uuid, stream)
-	if timeout == 0 {
-		timeout = t.DialTimeout
+	if t.hs != nil {
+		err = t.handshake(ctx, stream)
+	}
+	if err == nil {
+		err = stream.dial(ctx, locals)
 	}
-	err = stream.dial(locals, timeout)
 	if err != nil {
-		Logf(INFO, "UDPTransport::OpenTimeout dial timeout. uuid:%v locals:%v remotes:%v err:%v", uuid, locals, remotes, err)
+		Logf(INFO, "UDPTransport::OpenContext dial failed. uuid:%v locals:%v remotes:%v err:%v", uuid, locals, remotes, err)
+		t.snmp.add(func(m *Snmp) *uint64 { return &m.DialErrs }, 1)
 		stream.Close()
+		if ctx.Err() != nil {
+			// abandoned half-open stream, send RST now and stop retransmitting SYN
+			stream.discard(true)
+			t.streamm.Remove(uuid)
+		}
 		return nil, err
 	}
+	t.dialHist.observe(time.Since(start))
 	return stream, nil
 }
 
 func (t *UDPTransport) Accept() (*UDPStream, error) {
+	return t.accept(nil)
+}
+
+// AcceptContext waits for the next stream until ctx is done
+func (t *UDPTransport) AcceptContext(ctx context.Context) (*UDPStream, error) {
+	stream, err := t.accept(ctx.Done())
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return stream, err
+}
+
+// accept waits for the next passive open, it returns when the transport or cancel is closed
+func (t *UDPTransport) accept(cancel <-chan struct{}) (*UDPStream, error) {
+	// a listener closing concurrently has closed cancel before it takes acceptMu
+	t.acceptMu.Lock()
+	select {
+	case <-cancel:
+		t.acceptMu.Unlock()
+		return nil, io.ErrClosedPipe
+	default:
+	}
 	atomic.StoreInt32(&t.startAccept, 1)
+	t.acceptMu.Unlock()
+
 	for {
 		select {
 		case acceptChan := <-t.preAcceptChan:
@@ -244,43 +451,215 @@ func (t *UDPTransport) Accept() (*UDPStream, error) {
 			}
 		case <-t.die:
 			return nil, io.ErrClosedPipe
+		case <-cancel:
+			return nil, io.ErrClosedPipe
 		}
 	}
 }
 
-func (t *UDPTransport) processInput(queue int) {
+// stopAccept disables passive opens and closes the streams waiting to be accepted,
+// established streams are not affected.
+func (t *UDPTransport) stopAccept() {
+	Logf(INFO, "UDPTransport::stopAccept")
+
+	t.acceptMu.Lock()
+	atomic.StoreInt32(&t.startAccept, 0)
+	t.acceptMu.Unlock()
 	for {
-		msg := <-t.inputQueues[queue]
-		t.handleInput(msg.data, msg.addr)
-		xmitBuf.Put(msg.data)
+		select {
+		case acceptChan := <-t.preAcceptChan:
+			if stream := <-acceptChan; stream != nil {
+				stream.Close()
+			}
+		default:
+			return
+		}
 	}
 }
 
-func (t *UDPTransport) handleInput(data []byte, rAddr net.Addr) {
+// Close closes all tunnels and resets all streams immediately, pending data is discarded.
+func (t *UDPTransport) Close() error {
+	var once bool
+	t.dieOnce.Do(func() {
+		once = true
+	})
+
+	Logf(INFO, "UDPTransport::Close once:%v", once)
+	if !once {
+		return io.ErrClosedPipe
+	}
+
+	atomic.StoreInt32(&t.closing, 1)
+	close(t.die)
+	if t.pc != nil {
+		t.pc.close()
+	}
+
+	for _, stream := range t.streams() {
+		stream.Close()
+		stream.flush()
+	}
+
+	t.tunnelMu.Lock()
+	defer t.tunnelMu.Unlock()
+	for _, tunnel := range t.tunnelHostM {
+		tunnel.Close()
+	}
+	return nil
+}
+
+// Shutdown gracefully shuts down the transport. It stops accepting new streams,
+// sends FIN to every established stream and waits for the send queues to drain,
+// then closes the transport. If ctx expires before all streams have drained,
+// the transport is closed anyway and the context's error is returned.
+func (t *UDPTransport) Shutdown(ctx context.Context) (err error) {
+	Logf(INFO, "UDPTransport::Shutdown")
+
+	atomic.StoreInt32(&t.closing, 1)
+	for _, stream := range t.streams() {
+		stream.mu.Lock()
+		state := stream.state
+		stream.mu.Unlock()
+		if state.open() {
+			stream.CloseWrite()
+		}
+	}
+
+	ticker := time.NewTicker(DefaultDrainInterval)
+	defer ticker.Stop()
+
+	for !t.drained() {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			Logf(WARN, "UDPTransport::Shutdown drain interrupted. err:%v", err)
+			t.Close()
+			return err
+		case <-t.die:
+			return io.ErrClosedPipe
+		case <-ticker.C:
+		}
+	}
+
+	t.Close()
+	return nil
+}
+
+func (t *UDPTransport) drained() bool {
+	for _, stream := range t.streams() {
+		if stream.WaitSnd() != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *UDPTransport) streams() []*UDPStream {
+	streams := make([]*UDPStream, 0)
+	t.streamm.IterCb(func(key gouuid.UUID, v interface{}) {
+		streams = append(streams, v.(*UDPStream))
+	})
+	return streams
+}
+
+func (t *UDPTransport) processInput(queue chan *inputMsg) {
+	for {
+		select {
+		case msg := <-queue:
+			t.handleInput(msg.tunnel, msg.data, msg.addr)
+			xmitBuf.Put(msg.data)
+		case <-t.die:
+			return
+		}
+	}
+}
+
+func (t *UDPTransport) handleInput(tunnel *UDPTunnel, data []byte, rAddr net.Addr) {
+	if isHandshake(data) {
+		t.handleHandshake(tunnel, data, rAddr)
+		return
+	}
+	t.handleData(tunnel, data, rAddr, nil)
+}
+
+// handleData routes a stream packet received by tunnel, a packet of an unknown stream opens
+// a new one once admitted. cookie is the retry cookie the packet was wrapped with, if any.
+func (t *UDPTransport) handleData(tunnel *UDPTunnel, data []byte, rAddr net.Addr, cookie []byte) {
 	var uuid gouuid.UUID
 	copy(uuid[:], data)
 
 	s, ok := t.streamm.Get(uuid)
 	if ok {
-		s.(*UDPStream).input(data)
+		s.(*UDPStream).input(data, tunnel, rAddr)
 		return
 	}
-	if atomic.LoadInt32(&t.startAccept) == 0 {
+	if atomic.LoadInt32(&t.startAccept) == 0 || atomic.LoadInt32(&t.closing) != 0 {
+		return
+	}
+	// a SYN retransmitted after AcceptFilter refused the stream
+	if t.verdicts != nil {
+		if _, ok := t.verdicts.get(uuid, time.Now()); ok {
+			return
+		}
+	}
+	// with a handshake the hello was admitted, the packet has passed authentication
+	if t.hs == nil && !t.admit(uuid, rAddr, cookie) {
 		return
 	}
 
+	// the backlog slot is taken once the stream passed AcceptFilter, see UDPStream.accept
 	acceptChan := make(chan *UDPStream, 1)
-	select {
-	case t.preAcceptChan <- acceptChan:
-		break
-	default:
+	reserved := false
+	stream := t.handleOpen(uuid, rAddr, data, func() bool {
+		select {
+		case t.preAcceptChan <- acceptChan:
+			reserved = true
+		default:
+		}
+		return reserved
+	})
+	if reserved {
+		acceptChan <- stream
+	}
+}
+
+// admit decides whether a new stream of uuid may be allocated for a packet from rAddr.
+// With SynCookie the dialer must first repeat the cookie of a retry, proving it receives
+// packets sent to its address, no state is kept until then.
+func (t *UDPTransport) admit(uuid gouuid.UUID, rAddr net.Addr, cookie []byte) bool {
+	if t.cookies != nil {
+		if cookie == nil || !t.cookies.valid(uuid, rAddr, cookie) {
+			if cookie != nil {
+				// forged or expired, a fresh retry lets an honest dialer go on
+				t.snmp.add(func(m *Snmp) *uint64 { return &m.RejectedOpens }, 1)
+			}
+			t.sendRetry(uuid, rAddr)
+			return false
+		}
+	}
+	if t.limiter != nil && !t.limiter.allow(rAddr) {
+		Logf(WARN, "UDPTransport::admit rate limited. uuid:%v remote:%v", uuid, rAddr)
+		t.snmp.add(func(m *Snmp) *uint64 { return &m.RejectedOpens }, 1)
+		return false
+	}
+	if t.cookies != nil {
+		t.snmp.add(func(m *Snmp) *uint64 { return &m.CookieOpens }, 1)
+	}
+	return true
+}
+
+func (t *UDPTransport) sendRetry(uuid gouuid.UUID, rAddr net.Addr) {
+	tunnels := t.sel.Pick([]string{rAddr.String()})
+	if len(tunnels) == 0 {
 		return
 	}
-	stream := t.handleOpen(uuid, []string{rAddr.String()}, data)
-	acceptChan <- stream
+	msg := &handshakeMsg{uuid: uuid, typ: hsRetry, cookie: t.cookies.make(uuid, rAddr)}
+	tunnels[0].outputRaw(msg.encode(), rAddr)
 }
 
-func (t *UDPTransport) handleOpen(uuid gouuid.UUID, remotes []string, data []byte) *UDPStream {
+// handleOpen creates the stream of a SYN, reserve takes a slot of the accept backlog
+func (t *UDPTransport) handleOpen(uuid gouuid.UUID, rAddr net.Addr, data []byte, reserve func() bool) *UDPStream {
+	remotes := []string{rAddr.String()}
 	// start := time.Now()
 	// defer Logf(INFO, "UDPTransport::handleOpen cost uuid:%v remotes:%v cost:%v", uuid, remotes, time.Since(start))
 	Logf(INFO, "UDPTransport::handleOpen start uuid:%v remotes:%v", uuid, remotes)
@@ -296,16 +675,59 @@ func (t *UDPTransport) handleOpen(uuid gouuid.UUID, remotes []string, data []byt
 	})
 	// ignore conflict stream
 	if stream != nil {
-		stream.input(data)
-		if err := stream.accept(); err != nil {
+		if t.hs != nil {
+			t.hs.done(uuid)
+		}
+		stream.input(data, nil, rAddr)
+		if err := stream.accept(t.acceptFilter(stream, rAddr), reserve); err != nil {
 			Logf(INFO, "UDPTransport::handleOpen failed. uuid:%v err:%v", stream.GetUUID(), err)
-			stream.Close()
+			switch err {
+			case errAcceptBacklog:
+				// silently, the dialer retransmits SYN
+				stream.discard(false)
+			case errStreamDropped, errStreamRejected:
+				t.snmp.add(func(m *Snmp) *uint64 { return &m.RejectedOpens }, 1)
+				if t.verdicts != nil {
+					decision := DropStream
+					if err == errStreamRejected {
+						decision = RejectStream
+					}
+					t.verdicts.put(uuid, decision, time.Now())
+				}
+				stream.discard(err == errStreamRejected)
+			case errProtoVersion:
+				stream.closeWith(reasonVersion)
+			case errRemoteStream:
+				// a stray segment of a stream already forgotten, answer RST and forget it again
+				stream.discard(true)
+			default:
+				stream.Close()
+			}
 			return nil
 		}
 	}
 	return stream
 }
 
+// acceptFilter binds AcceptFilter to an incoming stream, nil if no filter is set
+func (t *UDPTransport) acceptFilter(stream *UDPStream, rAddr net.Addr) func() AcceptDecision {
+	if t.AcceptFilter == nil {
+		return nil
+	}
+	return func() AcceptDecision {
+		info := &AcceptInfo{UUID: stream.GetUUID(), RemoteAddr: rAddr, Metadata: stream.Metadata(), Capabilities: stream.PeerCapabilities()}
+		for _, remote := range stream.RemoteAddrs() {
+			info.Remotes = append(info.Remotes, remote.String())
+		}
+		decision := t.AcceptFilter(info)
+		Logf(INFO, "UDPTransport::acceptFilter uuid:%v remote:%v remotes:%v decision:%v", info.UUID, rAddr, info.Remotes, decision)
+		return decision
+	}
+}
+
 func (t *UDPTransport) handleClose(uuid gouuid.UUID) {
 	t.streamm.Remove(uuid)
+	if t.crypt != nil {
+		t.crypt.forget(uuid)
+	}
 }
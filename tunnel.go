@@ -5,6 +5,7 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/ipv4"
@@ -43,15 +44,25 @@ type (
 		xconn           batchConn // for x/net
 		xconnWriteError error
 
-		//simulate
-		loss     int
-		delayMin int
-		delayMax int
+		pacer *pacer       // token bucket pacing all packets of the tunnel
+		crypt *packetCrypt // authenticated encryption of all packets, shared by the tunnels of a transport
+
+		health tunnelHealth // pings of all streams sent from the tunnel
+		snmp   *Snmp        // adds up in the snmp of the transport
+
+		//simulate, read atomically
+		loss     int32
+		delayMin int32
+		delayMax int32
 	}
 )
 
 // newUDPSession create a new udp session for client or server
 func NewUDPTunnel(laddr string, inputcb input_callback) (tunnel *UDPTunnel, err error) {
+	return newUDPTunnel(laddr, nil, rootSnmp(), inputcb)
+}
+
+func newUDPTunnel(laddr string, crypt *packetCrypt, snmp *Snmp, inputcb input_callback) (tunnel *UDPTunnel, err error) {
 	// network type detection
 	addr, err := net.ResolveUDPAddr("udp", laddr)
 	if err != nil {
@@ -70,6 +81,8 @@ func NewUDPTunnel(laddr string, inputcb input_callback) (tunnel *UDPTunnel, err
 	tunnel = new(UDPTunnel)
 	tunnel.conn = conn
 	tunnel.inputcb = inputcb
+	tunnel.crypt = crypt
+	tunnel.snmp = aggregateSnmp(nil, snmp)
 	tunnel.addr = addr
 	tunnel.die = make(chan struct{})
 	tunnel.chFlush = make(chan struct{}, 1)
@@ -100,6 +113,37 @@ func (t *UDPTunnel) SetWriteBuffer(bytes int) error {
 	return t.conn.SetWriteBuffer(bytes)
 }
 
+// SetPacing limits the sending rate of the tunnel to rate bytes per second with a token bucket
+// of burst bytes, rate 0 disables pacing.
+func (t *UDPTunnel) SetPacing(rate uint64, burst int) {
+	Logf(INFO, "UDPTunnel::SetPacing addr:%v rate:%v burst:%v", t.addr, rate, burst)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if rate == 0 {
+		t.pacer = nil
+		return
+	}
+	t.pacer = newPacer(rate, burst)
+	t.pacer.snmp = t.snmp
+}
+
+// SetOption applies socket buffers and pacing settings
+func (t *UDPTunnel) SetOption(opt *TunnelOption) error {
+	if opt.ReadBuffer != 0 {
+		if err := t.SetReadBuffer(opt.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if opt.WriteBuffer != 0 {
+		if err := t.SetWriteBuffer(opt.WriteBuffer); err != nil {
+			return err
+		}
+	}
+	t.SetPacing(opt.PacingRate, opt.PacingBurst)
+	return nil
+}
+
 func (t *UDPTunnel) Close() error {
 	Logf(INFO, "UDPTunnel::Close addr:%v", t.addr)
 
@@ -121,6 +165,18 @@ func (t *UDPTunnel) Close() error {
 	return nil
 }
 
+// queued returns the number of packets waiting to be sent
+func (t *UDPTunnel) queued() (n int) {
+	t.mu.RLock()
+	for _, msgq := range t.msgsm {
+		msgq.mu.Lock()
+		n += len(msgq.msgss[msgq.wIdx])
+		msgq.mu.Unlock()
+	}
+	t.mu.RUnlock()
+	return n
+}
+
 func (t *UDPTunnel) LocalAddr() (addr *net.UDPAddr) {
 	return t.addr
 }
@@ -129,9 +185,9 @@ func (t *UDPTunnel) LocalAddr() (addr *net.UDPAddr) {
 func (t *UDPTunnel) Simulate(loss float64, delayMin, delayMax int) {
 	Logf(WARN, "UDPTunnel::Simulate addr:%v loss:%v delayMin:%v delayMax:%v", t.addr, loss, delayMin, delayMax)
 
-	t.loss = int(loss * 100)
-	t.delayMin = delayMin
-	t.delayMax = delayMax
+	atomic.StoreInt32(&t.loss, int32(loss*100))
+	atomic.StoreInt32(&t.delayMin, int32(delayMin))
+	atomic.StoreInt32(&t.delayMax, int32(delayMax))
 }
 
 func (t *UDPTunnel) pushMsgs(msgs []ipv4.Message) {
@@ -196,31 +252,100 @@ func (t *UDPTunnel) output(msgs []ipv4.Message) (err error) {
 	default:
 	}
 
-	if t.loss == 0 && t.delayMin == 0 && t.delayMax == 0 {
+	if t.crypt != nil {
+		// handshake packets go in clear, packets of streams without a key are dropped.
+		// Packets wrapped with a cookie and path probes are sealed behind their header.
+		sealed := msgs[:0]
+		for k := range msgs {
+			if isClearHandshake(msgs[k].Buffers[0]) || t.crypt.seal(msgs[k].Buffers[0]) {
+				sealed = append(sealed, msgs[k])
+			} else {
+				xmitBuf.Put(msgs[k].Buffers[0])
+			}
+		}
+		if len(sealed) == 0 {
+			return
+		}
+		msgs = sealed
+	}
+
+	t.mu.RLock()
+	pacer := t.pacer
+	t.mu.RUnlock()
+
+	if pacer == nil {
+		t.transmit(msgs)
+		return
+	}
+
+	pacer.schedule(msgs, func(msgs []ipv4.Message, delay time.Duration) {
+		if delay == 0 {
+			t.transmit(msgs)
+			return
+		}
+		SystemTimedSched.Put(func() {
+			select {
+			case <-t.die:
+				t.releaseMsgss([][]ipv4.Message{msgs})
+			default:
+				t.transmit(msgs)
+			}
+		}, time.Now().Add(delay))
+	})
+	return
+}
+
+// outputRaw sends a copy of b to addr
+func (t *UDPTunnel) outputRaw(b []byte, addr net.Addr) error {
+	buf := xmitBuf.Get().([]byte)[:len(b)]
+	copy(buf, b)
+	msgs := []ipv4.Message{{Buffers: [][]byte{buf}, Addr: addr}}
+	if err := t.output(msgs); err != nil {
+		t.releaseMsgss([][]ipv4.Message{msgs})
+		return err
+	}
+	return nil
+}
+
+// transmit queues msgs for the write loop, simulating loss and delay if configured
+func (t *UDPTunnel) transmit(msgs []ipv4.Message) {
+	loss := int(atomic.LoadInt32(&t.loss))
+	delayMin, delayMax := int(atomic.LoadInt32(&t.delayMin)), int(atomic.LoadInt32(&t.delayMax))
+	if loss == 0 && delayMin == 0 && delayMax == 0 {
 		t.pushMsgs(msgs)
 		return
 	}
 
 	succMsgs := make([]ipv4.Message, 0)
 	for k := range msgs {
-		if lossRand.Intn(100) >= t.loss {
+		if lossRand.Intn(100) >= loss {
 			succMsgs = append(succMsgs, msgs[k])
 		}
 	}
 
-	if t.delayMin == 0 && t.delayMax == 0 && len(succMsgs) != 0 {
+	if delayMin == 0 && delayMax == 0 && len(succMsgs) != 0 {
 		t.pushMsgs(succMsgs)
 		return
 	}
 
 	for _, msg := range succMsgs {
-		delay := time.Duration(t.delayMin+lossRand.Intn(t.delayMax-t.delayMin)) * time.Millisecond
+		delay := time.Duration(delayMin+lossRand.Intn(delayMax-delayMin)) * time.Millisecond
 		timerSender.Send(t, msg, delay)
 	}
-	return
 }
 
 func (t *UDPTunnel) input(data []byte, addr net.Addr) {
+	t.snmp.add(func(m *Snmp) *uint64 { return &m.InPkts }, 1)
+	t.snmp.add(func(m *Snmp) *uint64 { return &m.InBytes }, uint64(len(data)))
+	if t.crypt != nil && !isClearHandshake(data) {
+		plain, ok := t.crypt.open(data)
+		if !ok {
+			t.snmp.add(func(m *Snmp) *uint64 { return &m.InCsumErrors }, 1)
+			xmitBuf.Put(data)
+			return
+		}
+		data = plain
+	}
 	t.inputcb(t, data, addr)
 }
 
@@ -233,8 +358,14 @@ func (t *UDPTunnel) notifyFlush() {
 
 func (t *UDPTunnel) notifyReadError(err error) {
 	Logf(ERROR, "UDPTunnel::notifyReadError addr:%v err:%v", t.addr, err)
+	select {
+	case <-t.die:
+	default:
+		t.snmp.add(func(m *Snmp) *uint64 { return &m.InErrs }, 1)
+	}
 }
 
 func (t *UDPTunnel) notifyWriteError(err error) {
 	Logf(ERROR, "UDPTunnel::notifyWriteError addr:%v err:%v", t.addr, err)
+	t.snmp.add(func(m *Snmp) *uint64 { return &m.OutErrs }, 1)
 }
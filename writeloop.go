@@ -1,8 +1,6 @@
 package kcp
 
 import (
-	"sync/atomic"
-
 	"golang.org/x/net/ipv4"
 )
 
@@ -18,8 +16,8 @@ func (t *UDPTunnel) writeSingle(msgs []ipv4.Message) {
 		}
 	}
 
-	atomic.AddUint64(&DefaultSnmp.OutPkts, uint64(npkts))
-	atomic.AddUint64(&DefaultSnmp.OutBytes, uint64(nbytes))
+	t.snmp.add(func(m *Snmp) *uint64 { return &m.OutPkts }, uint64(npkts))
+	t.snmp.add(func(m *Snmp) *uint64 { return &m.OutBytes }, uint64(nbytes))
 }
 
 func (t *UDPTunnel) defaultWriteLoop() {
@@ -5,7 +5,6 @@ package kcp
 import (
 	"net"
 	"os"
-	"sync/atomic"
 
 	"golang.org/x/net/ipv4"
 )
@@ -15,12 +14,15 @@ func (t *UDPTunnel) writeBatch(msgs []ipv4.Message) {
 	nbytes := 0
 	npkts := 0
 
+batch:
 	for len(msgs) > 0 {
 		if n, err := t.xconn.WriteBatch(msgs, 0); err == nil {
 			for k := range msgs[:n] {
 				nbytes += len(msgs[k].Buffers[0])
 			}
 			npkts += n
+			t.snmp.add(func(m *Snmp) *uint64 { return &m.OutBatches }, 1)
+			t.snmp.max(func(m *Snmp) *uint64 { return &m.MaxOutBatch }, uint64(n))
 			msgs = msgs[n:]
 		} else {
 			// compatibility issue:
@@ -36,11 +38,16 @@ func (t *UDPTunnel) writeBatch(msgs []ipv4.Message) {
 				}
 			}
 			t.notifyWriteError(err)
+			select {
+			case <-t.die:
+				break batch
+			default:
+			}
 		}
 	}
 
-	atomic.AddUint64(&DefaultSnmp.OutPkts, uint64(npkts))
-	atomic.AddUint64(&DefaultSnmp.OutBytes, uint64(nbytes))
+	t.snmp.add(func(m *Snmp) *uint64 { return &m.OutPkts }, uint64(npkts))
+	t.snmp.add(func(m *Snmp) *uint64 { return &m.OutBytes }, uint64(nbytes))
 }
 
 func (t *UDPTunnel) writeLoop() {